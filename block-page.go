@@ -0,0 +1,115 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"html/template"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+var blockPageReadTimeout = 10 * time.Second
+
+// WithBlockPage answers blocked CONNECTs to port 80 with an HTTP page naming the FQDN and the
+// block list instead of a SOCKS5 failure. When unblockURL is set the page links to it with the
+// fqdn and list as query parameters. Requires ConnectHandle to be installed.
+func WithBlockPage(unblockURL string) StaticFQDNBlockerOpt {
+	return func(cc *StaticFQDNBlocker) {
+		cc.blockPage = &blockPage{unblockURL: unblockURL}
+	}
+}
+
+type blockPage struct {
+	unblockURL string
+}
+
+type blockPageKey struct{}
+
+type blockPageInfo struct {
+	fqdn, list string
+}
+
+var blockPageTemplate = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Blocked: {{.FQDN}}</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:4em auto;color:#333}code{background:#eee;padding:0 .3em}</style>
+</head>
+<body>
+<h1>This site is blocked</h1>
+<p>Access to <code>{{.FQDN}}</code> was blocked by the <code>{{.List}}</code> block list of this proxy.</p>
+{{if .UnblockURL}}<p><a href="{{.UnblockURL}}">Request unblock</a></p>{{end}}
+</body>
+</html>
+`))
+
+// blockPageName is the name shown on the block page: the server name if the client sent one,
+// otherwise the requested FQDN or address
+func blockPageName(req *socks5.Request, name string) string {
+	if name != "" {
+		return name
+	}
+	if req.DestAddr.FQDN != "" {
+		return req.DestAddr.FQDN
+	}
+	return req.DestAddr.String()
+}
+
+// serveBlockPageConnect accepts a blocked CONNECT without dialing anything and answers the
+// request that follows with the block page
+func (cc *StaticFQDNBlocker) serveBlockPageConnect(writer io.Writer, req *socks5.Request, info blockPageInfo) error {
+	if err := socks5.SendReply(writer, statute.RepSuccess, bindAddrOf(writer)); err != nil {
+		return fmt.Errorf("failed to send reply, %v", err)
+	}
+	cc.serveBlockPage(writer, bufio.NewReader(req.Reader), info)
+	return nil
+}
+
+// serveBlockPage reads the client's request head and replies 403 with the block page
+func (cc *StaticFQDNBlocker) serveBlockPage(writer io.Writer, client *bufio.Reader, info blockPageInfo) {
+	if conn, ok := writer.(net.Conn); ok {
+		conn.SetReadDeadline(time.Now().Add(blockPageReadTimeout))
+		defer conn.SetReadDeadline(time.Time{})
+	}
+	req, err := http.ReadRequest(client)
+	if err != nil {
+		return
+	}
+	req.Body.Close()
+	data := struct {
+		FQDN, List, UnblockURL string
+	}{FQDN: info.fqdn, List: info.list}
+	if cc.blockPage.unblockURL != "" {
+		sep := "?"
+		if strings.Contains(cc.blockPage.unblockURL, "?") {
+			sep = "&"
+		}
+		data.UnblockURL = cc.blockPage.unblockURL + sep + url.Values{
+			"fqdn": {info.fqdn},
+			"list": {info.list},
+		}.Encode()
+	}
+	body := bytes.Buffer{}
+	if err := blockPageTemplate.Execute(&body, data); err != nil {
+		return
+	}
+	resp := &http.Response{
+		StatusCode:    http.StatusForbidden,
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{},
+		Body:          io.NopCloser(&body),
+		ContentLength: int64(body.Len()),
+		Close:         true,
+	}
+	resp.Header.Set("Content-Type", "text/html; charset=utf-8")
+	resp.Header.Set("Cache-Control", "no-store")
+	resp.Write(writer)
+}
@@ -0,0 +1,58 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBlockPage(t *testing.T) {
+	cc := NewStaticFQDNBlocker(
+		WithStaticFQDNBlockList("ads", []string{"ads.com"}),
+		WithBlockPage("http://api:8080/unblock?lang=en"),
+	)
+	req := connectRequest("ads.com", nil, 80)
+	req.Reader = strings.NewReader("GET / HTTP/1.1\r\nHost: ads.com\r\n\r\n")
+	ctx, allow := cc.Allow(context.Background(), req)
+	info, ok := ctx.Value(blockPageKey{}).(blockPageInfo)
+	if !allow || !ok || info != (blockPageInfo{fqdn: "ads.com", list: "ads"}) {
+		t.Fatalf("blocked CONNECT to port 80: allow %v, page %+v", allow, info)
+	}
+	if _, allow := cc.Allow(context.Background(), connectRequest("ads.com", nil, 443)); allow {
+		t.Error("blocked CONNECT to port 443 accepted")
+	}
+
+	// names come from clients and lists from config: both must be escaped
+	out := &bytes.Buffer{}
+	cc.serveBlockPage(out, bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nHost: x\r\n\r\n")),
+		blockPageInfo{fqdn: `<script>alert(1)</script>.com`, list: `a"b`})
+	resp, err := http.ReadResponse(bufio.NewReader(out), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	page := string(body)
+	if resp.StatusCode != http.StatusForbidden || resp.Header.Get("Cache-Control") != "no-store" {
+		t.Errorf("status %d, headers %v", resp.StatusCode, resp.Header)
+	}
+	if strings.Contains(page, "<script>") || !strings.Contains(page, "&lt;script&gt;alert(1)&lt;/script&gt;.com") {
+		t.Errorf("fqdn not escaped:\n%s", page)
+	}
+	if strings.Contains(page, `a"b`) || !strings.Contains(page, "a&#34;b") {
+		t.Errorf("list not escaped:\n%s", page)
+	}
+	if !strings.Contains(page, `href="http://api:8080/unblock?lang=en&amp;fqdn=%3Cscript%3Ealert%281%29%3C%2Fscript%3E.com&amp;list=a%22b"`) {
+		t.Errorf("unblock link missing or not encoded:\n%s", page)
+	}
+
+	// a client that never sends a request gets nothing
+	out.Reset()
+	cc.serveBlockPage(out, bufio.NewReader(strings.NewReader("\x16\x03\x01")), blockPageInfo{fqdn: "ads.com"})
+	if out.Len() != 0 {
+		t.Errorf("answered a non-HTTP client: %q", out)
+	}
+}
@@ -2,12 +2,12 @@ package main
 
 import (
 	"bytes"
-	"encoding/csv"
 	"io"
 	"log"
 	"net/http"
 	"os"
 
+	forwardproxy "github.com/arunsworld/forward-proxy"
 	"github.com/urfave/cli/v2"
 	"gopkg.in/yaml.v3"
 )
@@ -78,24 +78,5 @@ func readRemoteIPHostFile(url string, comma, comment rune) ([]string, error) {
 		return nil, err
 	}
 	log.Printf("Read %d bytes", len(contents))
-	r := csv.NewReader(bytes.NewReader(contents))
-	r.Comma = comma
-	r.TrimLeadingSpace = true
-	r.LazyQuotes = true
-	r.FieldsPerRecord = 2
-	r.Comment = comment
-
-	result := []string{}
-	for {
-		record, err := r.Read()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			log.Printf("\terror while reading: %v", err)
-			continue
-		}
-		result = append(result, record[1])
-	}
-	return result, nil
+	return forwardproxy.ParseIPHostFile(bytes.NewReader(contents), comma, comment), nil
 }
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	alertNotifyTimeout = 10 * time.Second
+	// notifications queued beyond this are dropped so a slow hook can't pile up goroutines
+	maxPendingAlerts = 100
+)
+
+// alertRule fires when more than Threshold matching events are seen within Window. At least
+// one of FQDN, Suffix or List must be given; all that are given must match. Blocked restricts
+// the rule to blocked (true) or accepted (false) events. After firing the rule stays quiet
+// for Cooldown, which defaults to Window.
+type alertRule struct {
+	Name      string
+	FQDN      string
+	Suffix    string
+	List      string
+	Blocked   *bool
+	Threshold int
+	Window    time.Duration
+	Cooldown  time.Duration
+	Webhook   string
+	Command   []string
+	// internal
+	hits      []time.Time
+	lastFired time.Time
+}
+
+func (r *alertRule) validate() error {
+	if r.FQDN == "" && r.Suffix == "" && r.List == "" {
+		return errors.New("one of fqdn, suffix or list is required")
+	}
+	if r.Threshold < 0 {
+		return errors.New("threshold must not be negative")
+	}
+	if r.Window <= 0 {
+		return errors.New("window must be positive")
+	}
+	if r.Cooldown < 0 {
+		return errors.New("cooldown must not be negative")
+	}
+	if r.Cooldown == 0 {
+		r.Cooldown = r.Window
+	}
+	r.FQDN = strings.ToLower(r.FQDN)
+	r.Suffix = strings.ToLower(strings.TrimPrefix(r.Suffix, "."))
+	return nil
+}
+
+func (r *alertRule) matches(ev forwardproxy.HistEvent) bool {
+	fqdn := strings.ToLower(ev.FQDN)
+	if r.FQDN != "" && fqdn != r.FQDN {
+		return false
+	}
+	if r.Suffix != "" && fqdn != r.Suffix && !strings.HasSuffix(fqdn, "."+r.Suffix) {
+		return false
+	}
+	if r.List != "" && ev.List != r.List {
+		return false
+	}
+	if r.Blocked != nil && ev.Blocked != *r.Blocked {
+		return false
+	}
+	return true
+}
+
+// record counts ev and reports the hits within the window if the rule should fire
+func (r *alertRule) record(ev forwardproxy.HistEvent) (int, bool) {
+	now := ev.Time
+	cutoff := now.Add(-r.Window)
+	kept := r.hits[:0]
+	for _, t := range r.hits {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	r.hits = append(kept, now)
+	if len(r.hits) <= r.Threshold {
+		return 0, false
+	}
+	if !r.lastFired.IsZero() && now.Sub(r.lastFired) < r.Cooldown {
+		return 0, false
+	}
+	r.lastFired = now
+	count := len(r.hits)
+	r.hits = r.hits[:0]
+	return count, true
+}
+
+func alertRulesFromFile(fname string) ([]*alertRule, error) {
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var rules []*alertRule
+	if err := yaml.Unmarshal(contents, &rules); err != nil {
+		return nil, err
+	}
+	for c, r := range rules {
+		if r.Name == "" {
+			r.Name = fmt.Sprintf("rule-%d", c+1)
+		}
+		if err := r.validate(); err != nil {
+			return nil, fmt.Errorf("alert rule %d (%s): %w", c+1, r.Name, err)
+		}
+	}
+	return rules, nil
+}
+
+// alert is what a notification webhook receives and what a command gets on stdin
+type alert struct {
+	Rule      string        `json:"rule"`
+	Hits      int           `json:"hits"`
+	Window    string        `json:"window"`
+	Threshold int           `json:"threshold"`
+	Event     jsonHistEvent `json:"event"`
+}
+
+// alertingHistLogger matches events against watch rules and sends notifications to each
+// rule's webhook and/or command. Rules are evaluated on a single goroutine; notifications
+// run in the background.
+type alertingHistLogger struct {
+	rules []*alertRule
+	// internal
+	events    chan forwardproxy.HistEvent
+	pending   chan struct{}
+	client    *http.Client
+	stop      context.CancelFunc
+	done      chan struct{}
+	notifying sync.WaitGroup
+	closeOnce sync.Once
+}
+
+func newAlertingHistLogger(rules []*alertRule) *alertingHistLogger {
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &alertingHistLogger{
+		rules:   rules,
+		events:  make(chan forwardproxy.HistEvent, maxEventBuffer),
+		pending: make(chan struct{}, maxPendingAlerts),
+		client:  &http.Client{Timeout: alertNotifyTimeout},
+		stop:    cancel,
+		done:    make(chan struct{}),
+	}
+	go result.run(ctx)
+	return result
+}
+
+func (a *alertingHistLogger) LogAccepted(fqdn string) {
+	a.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn})
+}
+
+func (a *alertingHistLogger) LogBlocked(fqdn string) {
+	a.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn, Blocked: true})
+}
+
+// LogEvent implements forwardproxy.HistEventLogger and never blocks
+func (a *alertingHistLogger) LogEvent(ev forwardproxy.HistEvent) {
+	select {
+	case a.events <- ev:
+	default:
+	}
+}
+
+// Close waits for notifications already in flight
+func (a *alertingHistLogger) Close() error {
+	a.closeOnce.Do(func() {
+		a.stop()
+		<-a.done
+		a.notifying.Wait()
+	})
+	return nil
+}
+
+func (a *alertingHistLogger) run(ctx context.Context) {
+	defer close(a.done)
+	for {
+		select {
+		case ev := <-a.events:
+			if ev.Time.IsZero() {
+				ev.Time = time.Now()
+			}
+			for _, r := range a.rules {
+				if !r.matches(ev) {
+					continue
+				}
+				if hits, fire := r.record(ev); fire {
+					a.fire(r, alert{
+						Rule:      r.Name,
+						Hits:      hits,
+						Window:    r.Window.String(),
+						Threshold: r.Threshold,
+						Event:     newJSONHistEvent(ev),
+					})
+				}
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (a *alertingHistLogger) fire(r *alertRule, al alert) {
+	log.Printf("alert %s: %d hits for %s within %s", al.Rule, al.Hits, al.Event.FQDN, al.Window)
+	if r.Webhook == "" && len(r.Command) == 0 {
+		return
+	}
+	select {
+	case a.pending <- struct{}{}:
+	default:
+		log.Printf("alert %s: too many pending notifications, skipping", al.Rule)
+		return
+	}
+	a.notifying.Add(1)
+	go func() {
+		defer a.notifying.Done()
+		defer func() { <-a.pending }()
+		body, err := json.Marshal(al)
+		if err != nil {
+			log.Printf("alert %s: unable to encode: %v", al.Rule, err)
+			return
+		}
+		if r.Webhook != "" {
+			if err := a.notifyWebhook(r.Webhook, body); err != nil {
+				log.Printf("alert %s: webhook failed: %v", al.Rule, err)
+			}
+		}
+		if len(r.Command) > 0 {
+			if err := notifyCommand(r.Command, body, al); err != nil {
+				log.Printf("alert %s: command failed: %v", al.Rule, err)
+			}
+		}
+	}()
+}
+
+func (a *alertingHistLogger) notifyWebhook(url string, body []byte) error {
+	resp, err := a.client.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+// notifyCommand runs command with the alert as JSON on stdin and its main fields in the
+// environment, so simple shell scripts don't need to parse JSON
+func notifyCommand(command []string, body []byte, al alert) error {
+	ctx, cancel := context.WithTimeout(context.Background(), alertNotifyTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(body)
+	cmd.Env = append(os.Environ(),
+		"FP_ALERT_RULE="+al.Rule,
+		fmt.Sprintf("FP_ALERT_HITS=%d", al.Hits),
+		"FP_ALERT_WINDOW="+al.Window,
+		"FP_ALERT_FQDN="+al.Event.FQDN,
+		fmt.Sprintf("FP_ALERT_BLOCKED=%t", al.Event.Blocked),
+		"FP_ALERT_LIST="+al.Event.List,
+		"FP_ALERT_CLIENT="+al.Event.Client,
+	)
+	out, err := cmd.CombinedOutput()
+	if err != nil && len(out) > 0 {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+func TestAlertRuleRecord(t *testing.T) {
+	start := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		// offsets of hits from start, all against a rule firing on more than 2 hits in 10m
+		hits []time.Duration
+		want []int
+	}{
+		{"inside the window", []time.Duration{0, 5 * time.Minute, 10*time.Minute - time.Second}, []int{3}},
+		{"across the window boundary", []time.Duration{0, 5 * time.Minute, 10 * time.Minute}, nil},
+		{"spread out", []time.Duration{0, 6 * time.Minute, 12 * time.Minute, 18 * time.Minute}, nil},
+		{"not again inside the cooldown", []time.Duration{0, time.Minute, 2 * time.Minute, 3 * time.Minute, 4 * time.Minute, 5 * time.Minute, 6 * time.Minute}, []int{3}},
+		{"again after the cooldown", []time.Duration{0, time.Minute, 2 * time.Minute, 10 * time.Minute, 11 * time.Minute, 12 * time.Minute}, []int{3, 3}},
+	}
+	for _, tt := range tests {
+		r := &alertRule{Suffix: "example.com", Threshold: 2, Window: 10 * time.Minute, Cooldown: 10 * time.Minute}
+		if err := r.validate(); err != nil {
+			t.Fatal(err)
+		}
+		var fired []int
+		for _, offset := range tt.hits {
+			if hits, fire := r.record(forwardproxy.HistEvent{Time: start.Add(offset), FQDN: "example.com"}); fire {
+				fired = append(fired, hits)
+			}
+		}
+		if fmt.Sprint(fired) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: fired %v, want %v", tt.name, fired, tt.want)
+		}
+	}
+}
+
+func TestAlertRuleMatches(t *testing.T) {
+	blocked := true
+	tests := []struct {
+		rule alertRule
+		ev   forwardproxy.HistEvent
+		want bool
+	}{
+		{alertRule{FQDN: "Ads.com"}, forwardproxy.HistEvent{FQDN: "ads.COM"}, true},
+		{alertRule{FQDN: "ads.com"}, forwardproxy.HistEvent{FQDN: "x.ads.com"}, false},
+		{alertRule{Suffix: ".ads.com"}, forwardproxy.HistEvent{FQDN: "ads.com"}, true},
+		{alertRule{Suffix: "ads.com"}, forwardproxy.HistEvent{FQDN: "x.ads.com"}, true},
+		{alertRule{Suffix: "ads.com"}, forwardproxy.HistEvent{FQDN: "badads.com"}, false},
+		{alertRule{List: "ads"}, forwardproxy.HistEvent{FQDN: "x.com", List: "ads"}, true},
+		{alertRule{List: "ads"}, forwardproxy.HistEvent{FQDN: "x.com", List: "trackers"}, false},
+		{alertRule{Suffix: "ads.com", List: "ads"}, forwardproxy.HistEvent{FQDN: "x.ads.com"}, false},
+		{alertRule{List: "ads", Blocked: &blocked}, forwardproxy.HistEvent{FQDN: "x.com", List: "ads"}, false},
+		{alertRule{List: "ads", Blocked: &blocked}, forwardproxy.HistEvent{FQDN: "x.com", List: "ads", Blocked: true}, true},
+	}
+	for _, tt := range tests {
+		r := tt.rule
+		r.Window = time.Minute
+		if err := r.validate(); err != nil {
+			t.Fatal(err)
+		}
+		if got := r.matches(tt.ev); got != tt.want {
+			t.Errorf("%+v matches %+v = %v, want %v", tt.rule, tt.ev, got, tt.want)
+		}
+	}
+}
+
+func TestAlertRulesFromFile(t *testing.T) {
+	write := func(contents string) string {
+		fname := filepath.Join(t.TempDir(), "alerts.yml")
+		if err := os.WriteFile(fname, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return fname
+	}
+	rules, err := alertRulesFromFile(write("- suffix: ads.com\n  threshold: 5\n  window: 10m\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := rules[0]; r.Name != "rule-1" || r.Window != 10*time.Minute || r.Cooldown != r.Window {
+		t.Errorf("rule = %+v", r)
+	}
+	for _, invalid := range []string{
+		"- threshold: 5\n  window: 10m\n",
+		"- list: ads\n  threshold: -1\n  window: 10m\n",
+		"- list: ads\n  threshold: 5\n",
+		"- list: ads\n  window: 10m\n  cooldown: -1m\n",
+		"- list: ads\n  window: soon\n",
+	} {
+		if _, err := alertRulesFromFile(write(invalid)); err == nil {
+			t.Errorf("accepted %q", invalid)
+		}
+	}
+}
+
+func TestAlertWebhook(t *testing.T) {
+	received := make(chan alert, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var al alert
+		if err := json.NewDecoder(r.Body).Decode(&al); err != nil {
+			t.Error(err)
+		}
+		received <- al
+	}))
+	defer srv.Close()
+
+	r := &alertRule{Name: "ads", List: "ads", Threshold: 1, Window: time.Minute, Webhook: srv.URL}
+	if err := r.validate(); err != nil {
+		t.Fatal(err)
+	}
+	a := newAlertingHistLogger([]*alertRule{r})
+	defer a.Close()
+	a.LogEvent(forwardproxy.HistEvent{FQDN: "ads.com", List: "ads", Blocked: true})
+	a.LogEvent(forwardproxy.HistEvent{FQDN: "other.com"})
+	a.LogEvent(forwardproxy.HistEvent{FQDN: "ads.com", List: "ads", Blocked: true})
+
+	select {
+	case al := <-received:
+		if al.Rule != "ads" || al.Hits != 2 || al.Threshold != 1 || al.Event.FQDN != "ads.com" || !al.Event.Blocked {
+			t.Errorf("alert = %+v", al)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not called")
+	}
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type apiAccess uint8
+
+const (
+	noAPIAccess apiAccess = iota
+	readAPIAccess
+	writeAPIAccess
+)
+
+func parseAPIAccess(v string) (apiAccess, error) {
+	switch strings.ToLower(v) {
+	case "read":
+		return readAPIAccess, nil
+	case "write":
+		return writeAPIAccess, nil
+	default:
+		return noAPIAccess, fmt.Errorf("unknown access %q: expected read or write", v)
+	}
+}
+
+// apiClient identifies a caller either by bearer token or by the common name of a
+// verified client certificate. Write access implies read access. Endpoints, when given,
+// restricts the client to those API paths and the paths below them.
+type apiClient struct {
+	Name       string
+	Token      string
+	CommonName string `yaml:"commonname"`
+	Access     string
+	Endpoints  []string
+	// internal
+	access apiAccess
+}
+
+type apiAuthenticator struct {
+	tokens      []apiClient
+	commonNames map[string]apiClient
+}
+
+func apiAuthenticatorFromFile(fname string) (*apiAuthenticator, error) {
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var clients []apiClient
+	if err := yaml.Unmarshal(contents, &clients); err != nil {
+		return nil, err
+	}
+	return newAPIAuthenticator(clients)
+}
+
+func newAPIAuthenticator(clients []apiClient) (*apiAuthenticator, error) {
+	result := &apiAuthenticator{
+		commonNames: make(map[string]apiClient),
+	}
+	for c, v := range clients {
+		if err := v.validate(); err != nil {
+			return nil, fmt.Errorf("api client %d (%s): %w", c+1, v.Name, err)
+		}
+		if v.Token != "" {
+			result.tokens = append(result.tokens, v)
+		} else {
+			result.commonNames[v.CommonName] = v
+		}
+	}
+	if len(result.tokens) == 0 && len(result.commonNames) == 0 {
+		return nil, errors.New("no api clients defined")
+	}
+	return result, nil
+}
+
+// validate checks the client's access and that it has exactly one of token or commonname
+func (v *apiClient) validate() error {
+	access, err := parseAPIAccess(v.Access)
+	if err != nil {
+		return err
+	}
+	v.access = access
+	switch {
+	case v.Token != "" && v.CommonName != "":
+		return errors.New("only one of token or commonname allowed")
+	case v.Token == "" && v.CommonName == "":
+		return errors.New("missing token or commonname")
+	}
+	for _, e := range v.Endpoints {
+		if !strings.HasPrefix(e, "/") {
+			return fmt.Errorf("endpoint %q must be a path starting with /", e)
+		}
+	}
+	return nil
+}
+
+// permits reports whether the client's endpoints, if any, include path
+func (v apiClient) permits(path string) bool {
+	if len(v.Endpoints) == 0 {
+		return true
+	}
+	for _, e := range v.Endpoints {
+		if underAPIPath(path, e) {
+			return true
+		}
+	}
+	return false
+}
+
+// usesCommonNames reports whether any client is identified by certificate
+func (a *apiAuthenticator) usesCommonNames() bool {
+	return a != nil && len(a.commonNames) > 0
+}
+
+func (a *apiAuthenticator) authenticate(r *http.Request) (apiClient, bool) {
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		if c, ok := a.commonNames[r.TLS.VerifiedChains[0][0].Subject.CommonName]; ok {
+			return c, true
+		}
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return apiClient{}, false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	if token == "" {
+		return apiClient{}, false
+	}
+	for _, c := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(c.Token), []byte(token)) == 1 {
+			return c, true
+		}
+	}
+	return apiClient{}, false
+}
+
+// apiRoute is the access needed to read and to change what is under an API path
+type apiRoute struct {
+	path        string
+	read, write apiAccess
+}
+
+// apiRoutes lists the API by path, most specific first. The live event feed, the connection
+// table and the block list sources, whose URLs may carry credentials, need write access even
+// to read. Paths not listed need write access.
+var apiRoutes = []apiRoute{
+	{blockListSourcesV1Path, writeAPIAccess, writeAPIAccess},
+	{blockListsV1Path, readAPIAccess, writeAPIAccess},
+	{dnsOverridesV1Path, readAPIAccess, writeAPIAccess},
+	{openAPIV1Path, readAPIAccess, writeAPIAccess},
+	{histogramV1Path, readAPIAccess, writeAPIAccess},
+	{unblockRequestsV1Path, readAPIAccess, writeAPIAccess},
+	{policyAllowV1Path, writeAPIAccess, writeAPIAccess},
+	{policyBlockV1Path, writeAPIAccess, writeAPIAccess},
+	{eventsV1Path, writeAPIAccess, writeAPIAccess},
+	{connectionsV1Path, writeAPIAccess, writeAPIAccess},
+	{"/list", readAPIAccess, writeAPIAccess},
+}
+
+// requiredAPIAccess looks the request up in apiRoutes; reads are GET, HEAD and OPTIONS
+func requiredAPIAccess(r *http.Request) apiAccess {
+	for _, route := range apiRoutes {
+		if !underAPIPath(r.URL.Path, route.path) {
+			continue
+		}
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			return route.read
+		default:
+			return route.write
+		}
+	}
+	return writeAPIAccess
+}
+
+// underAPIPath reports whether path is base or below it
+func underAPIPath(path, base string) bool {
+	base = strings.TrimSuffix(base, "/")
+	return path == base || strings.HasPrefix(path, base+"/")
+}
+
+// middleware rejects unauthenticated or unauthorised requests before they reach any handler
+func (a *apiAuthenticator) middleware(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		client, ok := a.authenticate(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="forward-proxy"`)
+			writeJSONError(w, http.StatusUnauthorized, "authentication required")
+			return
+		}
+		if client.access < requiredAPIAccess(r) || !client.permits(r.URL.Path) {
+			log.Printf("api client %s denied %s %s", client.Name, r.Method, r.URL.Path)
+			writeJSONError(w, http.StatusForbidden, "%s %s not permitted", r.Method, r.URL.Path)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func apiTLSConfig(clientCAFile string) (*tls.Config, error) {
+	result := &tls.Config{MinVersion: tls.VersionTLS12}
+	if clientCAFile == "" {
+		return result, nil
+	}
+	contents, err := os.ReadFile(clientCAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(contents) {
+		return nil, fmt.Errorf("no certificates found in %s", clientCAFile)
+	}
+	result.ClientCAs = pool
+	// tokens remain usable by clients without a certificate
+	result.ClientAuth = tls.VerifyClientCertIfGiven
+	return result, nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAPIAuthMiddleware(t *testing.T) {
+	auth, err := newAPIAuthenticator([]apiClient{
+		{Name: "viewer", Token: "r", Access: "read"},
+		{Name: "admin", Token: "w", Access: "write"},
+		{Name: "grafana", Token: "g", Access: "read", Endpoints: []string{histogramV1Path}},
+		{Name: "ops", CommonName: "ops.example", Access: "write"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := auth.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	tests := []struct {
+		method, path, token string
+		want                int
+	}{
+		{"GET", histogramV1Path, "", http.StatusUnauthorized},
+		{"GET", histogramV1Path, "wrong", http.StatusUnauthorized},
+		{"GET", histogramV1Path, "r", http.StatusNoContent},
+		{"DELETE", histogramV1Path, "r", http.StatusForbidden},
+		{"DELETE", histogramV1Path, "w", http.StatusNoContent},
+		{"GET", dnsOverridesV1Path + "/printer.lan", "r", http.StatusNoContent},
+		{"PUT", dnsOverridesV1Path + "/printer.lan", "r", http.StatusForbidden},
+		{"GET", eventsV1Path, "r", http.StatusForbidden},
+		{"GET", eventsV1Path, "w", http.StatusNoContent},
+		{"GET", connectionsV1Path, "r", http.StatusForbidden},
+		{"GET", blockListSourcesV1Path, "r", http.StatusForbidden},
+		{"GET", blockListsV1Path, "r", http.StatusNoContent},
+		{"GET", "/v1/unknown", "r", http.StatusForbidden},
+		{"GET", "/v1/histogramx", "r", http.StatusForbidden},
+		{"GET", histogramV1Path, "g", http.StatusNoContent},
+		{"GET", blockListsV1Path, "g", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.token != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.want {
+			t.Errorf("%s %s with token %q = %d, want %d", tt.method, tt.path, tt.token, w.Code, tt.want)
+		}
+	}
+
+	// a certificate only counts once verified
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "ops.example"}}
+	for _, state := range []*tls.ConnectionState{
+		{PeerCertificates: []*x509.Certificate{cert}},
+		{PeerCertificates: []*x509.Certificate{cert}, VerifiedChains: [][]*x509.Certificate{{cert}}},
+	} {
+		r := httptest.NewRequest("POST", policyBlockV1Path, nil)
+		r.TLS = state
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		want := http.StatusUnauthorized
+		if len(state.VerifiedChains) > 0 {
+			want = http.StatusNoContent
+		}
+		if w.Code != want {
+			t.Errorf("certificate with %d verified chains = %d, want %d", len(state.VerifiedChains), w.Code, want)
+		}
+	}
+}
+
+func TestAPIAuthenticatorValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		client apiClient
+	}{
+		{"unknown access", apiClient{Name: "a", Token: "t", Access: "admin"}},
+		{"token and commonname", apiClient{Name: "a", Token: "t", CommonName: "a", Access: "read"}},
+		{"no identity", apiClient{Name: "a", Access: "read"}},
+		{"relative endpoint", apiClient{Name: "a", Token: "t", Access: "read", Endpoints: []string{"v1/histogram"}}},
+	}
+	for _, tt := range tests {
+		if _, err := newAPIAuthenticator([]apiClient{tt.client}); err == nil {
+			t.Errorf("%s accepted", tt.name)
+		}
+	}
+	if _, err := newAPIAuthenticator(nil); err == nil {
+		t.Error("no clients accepted")
+	}
+
+	tokens, _ := newAPIAuthenticator([]apiClient{{Name: "a", Token: "t", Access: "read"}})
+	certs, _ := newAPIAuthenticator([]apiClient{{Name: "a", CommonName: "a", Access: "read"}})
+	if tokens.usesCommonNames() || !certs.usesCommonNames() {
+		t.Error("usesCommonNames disagrees with the clients")
+	}
+}
@@ -2,17 +2,84 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
 )
 
 type dnsAPIRequest struct {
-	Addr string `json:"addr"`
-	IP   string `json:"ip"`
+	Addr     string `json:"addr"`
+	IP       string `json:"ip"`
+	Wildcard bool   `json:"wildcard,omitempty"`
+	// TTL in seconds, 0 means the override never expires
+	TTL     int64  `json:"ttl,omitempty"`
+	Comment string `json:"comment,omitempty"`
+	// only populated in responses
+	Expires *time.Time `json:"expires,omitempty"`
+	Static  bool       `json:"static,omitempty"`
+}
+
+func (v dnsAPIRequest) validate() error {
+	if v.Addr == "" {
+		return errors.New("missing host address")
+	}
+	if !validDomainPattern(v.Addr) {
+		return fmt.Errorf("invalid host address %s: wildcard only allowed as *.domain", v.Addr)
+	}
+	if v.IP == "" {
+		return errors.New("missing IP address")
+	}
+	if net.ParseIP(v.IP) == nil {
+		return fmt.Errorf("invalid IP address %s", v.IP)
+	}
+	if v.TTL < 0 {
+		return fmt.Errorf("invalid ttl %d: must not be negative", v.TTL)
+	}
+	return nil
+}
+
+func (v dnsAPIRequest) register(dr *dnsResolver) error {
+	return dr.registry.Register(v.Addr, net.ParseIP(v.IP), time.Duration(v.TTL)*time.Second, v.Comment)
+}
+
+func newDNSAPIResponse(addr string, e dnsOverrideEntry) dnsAPIRequest {
+	result := dnsAPIRequest{
+		Addr:     addr,
+		IP:       e.ip.String(),
+		Wildcard: isWildcardDomain(addr),
+		Comment:  e.comment,
+		Static:   e.static,
+	}
+	if !e.expires.IsZero() {
+		expires := e.expires
+		result.Expires = &expires
+		result.TTL = int64(time.Until(expires).Seconds())
+	}
+	return result
 }
 
-func dnsHandler(dr dnsResolver) func(http.ResponseWriter, *http.Request) {
+func newDNSAPIResponses(reg map[string]dnsOverrideEntry) []dnsAPIRequest {
+	result := make([]dnsAPIRequest, 0, len(reg))
+	for k, v := range reg {
+		result = append(result, newDNSAPIResponse(k, v))
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Wildcard != result[j].Wildcard {
+			return !result[i].Wildcard
+		}
+		return result[i].Addr < result[j].Addr
+	})
+	return result
+}
+
+func dnsHandler(dr *dnsResolver) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method != "POST" {
 			w.WriteHeader(http.StatusBadRequest)
@@ -32,19 +99,18 @@ func dnsHandler(dr dnsResolver) func(http.ResponseWriter, *http.Request) {
 			return
 		}
 		for c, v := range input {
-			if v.Addr == "" {
-				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "missing host address on index %d of input", c+1)
-				return
-			}
-			if v.IP == "" {
+			if err := v.validate(); err != nil {
 				w.WriteHeader(http.StatusBadRequest)
-				fmt.Fprintf(w, "missing IP address on index %d of input", c+1)
+				fmt.Fprintf(w, "%v on index %d of input", err, c+1)
 				return
 			}
 		}
 		for _, v := range input {
-			dr.Register(v.Addr, v.IP)
+			if err := v.register(dr); err != nil {
+				w.WriteHeader(http.StatusInternalServerError)
+				fmt.Fprintf(w, "unable to register %s: %v", v.Addr, err)
+				return
+			}
 			log.Printf("registered: %s - %s", v.Addr, v.IP)
 		}
 		w.WriteHeader(http.StatusOK)
@@ -52,54 +118,135 @@ func dnsHandler(dr dnsResolver) func(http.ResponseWriter, *http.Request) {
 	}
 }
 
-func dnsListHandler(dr dnsResolver) func(http.ResponseWriter, *http.Request) {
+func dnsListHandler(dr *dnsResolver) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, _ *http.Request) {
-		reg := dr.Registrations()
-		result := make([]dnsAPIRequest, 0, len(reg))
-		for k, v := range reg {
-			result = append(result, dnsAPIRequest{
-				Addr: k,
-				IP:   v.String(),
-			})
-		}
-		v, err := json.Marshal(result)
-		if err != nil {
-			fmt.Fprintf(w, "error processing JSON: %v", err)
-			w.WriteHeader(http.StatusInternalServerError)
-			return
-		}
-		w.WriteHeader(http.StatusOK)
-		w.Write(v)
+		writeJSON(w, http.StatusOK, newDNSAPIResponses(dr.registry.Registrations()))
+	}
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	contents, err := json.Marshal(v)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		fmt.Fprintf(w, "error processing JSON: %v", err)
+		return
 	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(contents)
+}
+
+func writeJSONError(w http.ResponseWriter, status int, format string, args ...interface{}) {
+	writeJSON(w, status, apiError{Error: fmt.Sprintf(format, args...)})
 }
 
 type apiServer struct {
 	hostname string
 	port     int
-	dr       dnsResolver
-	srv      *http.Server
+	dr       *dnsResolver
+	blocker  *forwardproxy.StaticFQDNBlocker
+	hist     histStore
+	feed     *connFeed
+	unblock  *unblockRequests
+	conns    *connTracker
+	// optional; nil without remote block list sources
+	sources *blockListRefresher
+	// optional; without it the API is open to anyone who can reach the port
+	auth *apiAuthenticator
+	// optional TLS; clientCAFile enables client certificate verification
+	certFile, keyFile, clientCAFile string
+	// optional; when nil serve listens on hostname:port
+	listener net.Listener
+	// internal; close may race serve during startup
+	mu     sync.Mutex
+	srv    *http.Server
+	closed bool
 }
 
 func (s *apiServer) serve() error {
 	if s.port == 0 {
 		return nil
 	}
-	s.dr.Register("api", "127.0.0.1")
-	http.HandleFunc("/", dnsHandler(s.dr))
-	http.HandleFunc("/list", dnsListHandler(s.dr))
+	dashboard, err := dashboardHandler()
+	if err != nil {
+		return err
+	}
+	s.dr.registry.RegisterStatic("api", net.ParseIP("127.0.0.1"), "")
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", dnsHandler(s.dr))
+	mux.HandleFunc("/list", dnsListHandler(s.dr))
+	mux.HandleFunc(dnsOverridesV1Path, dnsOverridesV1Handler(s.dr))
+	mux.HandleFunc(dnsOverridesV1Path+"/", dnsOverrideV1Handler(s.dr))
+	mux.HandleFunc(openAPIV1Path, openAPIHandler)
+	mux.HandleFunc(histogramV1Path, histogramV1Handler(s.hist, s.blocker))
+	mux.HandleFunc(eventsV1Path, eventsV1Handler(s.feed))
+	mux.HandleFunc(blockListsV1Path, blockListsV1Handler(s.blocker))
+	mux.HandleFunc(blockListSourcesV1Path, blockListSourcesV1Handler(s.sources))
+	mux.HandleFunc(policyAllowV1Path, policyV1Handler("allowed", s.blocker.AllowFQDN))
+	mux.HandleFunc(policyBlockV1Path, policyV1Handler("blocked", s.blocker.BlockFQDN))
+	mux.HandleFunc(unblockRequestsV1Path, unblockRequestsV1Handler(s.unblock))
+	mux.HandleFunc(connectionsV1Path, connectionsV1Handler(s.conns))
+	// the dashboard assets hold no data and are served without auth;
+	// the dashboard calls the API above with the user's token
+	root := http.NewServeMux()
+	root.Handle(dashboardPath, dashboard)
+	root.HandleFunc(unblockPath, unblockHandler(s.unblock))
+	root.Handle("/", s.auth.middleware(mux))
 	addr := fmt.Sprintf("%s:%d", s.hostname, s.port)
-	srv := &http.Server{Addr: addr}
+	srv := &http.Server{Addr: addr, Handler: root}
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
 	s.srv = srv
-	log.Printf("serving api server on address: %s", addr)
+	s.mu.Unlock()
+	if s.auth == nil {
+		log.Printf("WARNING: api server has no authentication configured")
+	}
 	defer func() {
 		log.Println("api server terminated")
 	}()
-	return srv.ListenAndServe()
+	if s.certFile != "" {
+		tlsConfig, err := apiTLSConfig(s.clientCAFile)
+		if err != nil {
+			return err
+		}
+		srv.TLSConfig = tlsConfig
+		if s.listener != nil {
+			log.Printf("serving api server with TLS on address: %s", s.listener.Addr())
+			return ignoreServerClosed(srv.ServeTLS(s.listener, s.certFile, s.keyFile))
+		}
+		log.Printf("serving api server with TLS on address: %s", addr)
+		return ignoreServerClosed(srv.ListenAndServeTLS(s.certFile, s.keyFile))
+	}
+	if s.listener != nil {
+		log.Printf("serving api server on address: %s", s.listener.Addr())
+		return ignoreServerClosed(srv.Serve(s.listener))
+	}
+	log.Printf("serving api server on address: %s", addr)
+	return ignoreServerClosed(srv.ListenAndServe())
+}
+
+func ignoreServerClosed(err error) error {
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+	return err
 }
 
 func (s *apiServer) close() {
-	if s.port == 0 {
-		return
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	switch {
+	case s.srv != nil:
+		s.srv.Close()
+	case s.listener != nil:
+		s.listener.Close()
 	}
-	s.srv.Close()
 }
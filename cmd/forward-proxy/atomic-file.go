@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic writes contents to a temporary file next to fname, fsyncs it and renames it
+// into place so a crash leaves either the old or the new contents, never a partial file.
+// When backup is set the previous contents of fname are kept there.
+func writeFileAtomic(fname string, contents []byte, perm os.FileMode, backup string) error {
+	dir := filepath.Dir(fname)
+	tmp, err := os.CreateTemp(dir, filepath.Base(fname)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName) // no-op once renamed
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpName, perm); err != nil {
+		return err
+	}
+	if backup != "" {
+		// a crash right after this leaves only the backup, which readers fall back to
+		if err := os.Rename(fname, backup); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.Rename(tmpName, fname); err != nil {
+		return err
+	}
+	return syncDir(dir)
+}
+
+// syncDir makes the rename durable; not all platforms support it so failures to open are ignored
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil && !errors.Is(err, os.ErrInvalid) {
+		return err
+	}
+	return nil
+}
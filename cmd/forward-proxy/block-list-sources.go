@@ -0,0 +1,398 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	blockListSourcesV1Path = "/v1/blocklists/sources"
+
+	defaultBlockListRefresh = 24 * time.Hour
+	minBlockListRefresh     = time.Minute
+	// a failed fetch is retried sooner than the next scheduled refresh
+	blockListRetryInterval = 5 * time.Minute
+	blockListFetchTimeout  = time.Minute
+	maxBlockListSize       = 64 << 20
+)
+
+// blockListSourceConfig is a remote hosts-style block list, the same format build-block-list
+// reads. The list is named after its URL unless given a name.
+type blockListSourceConfig struct {
+	Name    string
+	URL     string
+	Refresh time.Duration
+}
+
+func blockListSourcesFromFile(fname string) ([]blockListSourceConfig, error) {
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var result []blockListSourceConfig
+	if err := yaml.Unmarshal(contents, &result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// normalise fills in defaults and checks the source
+func (cfg *blockListSourceConfig) normalise() error {
+	if cfg.URL == "" {
+		return errors.New("missing url")
+	}
+	if cfg.Name == "" {
+		cfg.Name = cfg.URL
+	}
+	if cfg.Name == forwardproxy.RuntimeBlockListName {
+		return fmt.Errorf("name %s is reserved", cfg.Name)
+	}
+	switch {
+	case cfg.Refresh == 0:
+		cfg.Refresh = defaultBlockListRefresh
+	case cfg.Refresh < minBlockListRefresh:
+		return fmt.Errorf("refresh must be at least %s", minBlockListRefresh)
+	}
+	return nil
+}
+
+// blockListRefresher keeps remote block lists in the blocker up to date. With a cache
+// directory the last good copy of each list is kept on disk, next to the ETag and
+// Last-Modified it was served with, and loaded at startup: the lists apply before the first
+// fetch completes, and a copy younger than the refresh interval isn't fetched again.
+type blockListRefresher struct {
+	blocker *forwardproxy.StaticFQDNBlocker
+	cache   string
+	sources []*blockListSource
+	client  *http.Client
+}
+
+type blockListSource struct {
+	blockListSourceConfig
+	// internal
+	refreshNow         chan struct{}
+	mu                 sync.Mutex
+	status             blockListSourceStatus
+	etag, lastModified string
+	// when the cached copy was last known to be current; zero without one
+	cachedAt time.Time
+}
+
+// blockListCacheMeta is kept beside a cached list so a restart can make conditional requests
+type blockListCacheMeta struct {
+	ETag         string `yaml:"etag,omitempty"`
+	LastModified string `yaml:"lastModified,omitempty"`
+}
+
+type blockListSourceStatus struct {
+	Name        string     `json:"name"`
+	URL         string     `json:"url"`
+	Refresh     string     `json:"refresh"`
+	Entries     int        `json:"entries"`
+	FromCache   bool       `json:"fromCache,omitempty"`
+	LastAttempt *time.Time `json:"lastAttempt,omitempty"`
+	LastSuccess *time.Time `json:"lastSuccess,omitempty"`
+	LastError   string     `json:"lastError,omitempty"`
+	NextRefresh *time.Time `json:"nextRefresh,omitempty"`
+}
+
+// newBlockListRefresher adds an (initially cached or empty) list to blocker for every source.
+// Source names must not clash with the lists blocker already has.
+func newBlockListRefresher(blocker *forwardproxy.StaticFQDNBlocker, configs []blockListSourceConfig, cache string) (*blockListRefresher, error) {
+	result := &blockListRefresher{
+		blocker: blocker,
+		cache:   cache,
+		client:  &http.Client{Timeout: blockListFetchTimeout},
+	}
+	existing := blocker.BlockListSizes()
+	seen := make(map[string]struct{})
+	for c, cfg := range configs {
+		if err := cfg.normalise(); err != nil {
+			return nil, fmt.Errorf("block list source %d (%s): %w", c+1, cfg.URL, err)
+		}
+		if _, ok := existing[cfg.Name]; ok {
+			return nil, fmt.Errorf("block list source %d: list %s is already defined", c+1, cfg.Name)
+		}
+		if _, ok := seen[cfg.Name]; ok {
+			return nil, fmt.Errorf("block list source %d: duplicate name %s", c+1, cfg.Name)
+		}
+		seen[cfg.Name] = struct{}{}
+		s := &blockListSource{
+			blockListSourceConfig: cfg,
+			refreshNow:            make(chan struct{}, 1),
+			status: blockListSourceStatus{
+				Name:    cfg.Name,
+				URL:     cfg.URL,
+				Refresh: cfg.Refresh.String(),
+			},
+		}
+		var fqdns []string
+		if contents, cachedAt, err := result.readCache(s); err == nil {
+			fqdns = forwardproxy.ParseIPHostFile(bytes.NewReader(contents), ' ', '#')
+			s.status.Entries = len(fqdns)
+			s.status.FromCache = true
+			s.cachedAt = cachedAt
+			log.Printf("block list %s: loaded %d entries from cache", s.Name, len(fqdns))
+		} else if !errors.Is(err, os.ErrNotExist) {
+			log.Printf("block list %s: unable to read cache: %v", s.Name, err)
+		}
+		blocker.ReplaceBlockList(s.Name, fqdns)
+		result.sources = append(result.sources, s)
+	}
+	return result, nil
+}
+
+// run refreshes every source on its schedule until ctx is done
+func (r *blockListRefresher) run(ctx context.Context) {
+	if r == nil {
+		return
+	}
+	var wg sync.WaitGroup
+	for _, s := range r.sources {
+		wg.Add(1)
+		go func(s *blockListSource) {
+			defer wg.Done()
+			r.refreshLoop(ctx, s)
+		}(s)
+	}
+	wg.Wait()
+}
+
+func (r *blockListRefresher) refreshLoop(ctx context.Context, s *blockListSource) {
+	for first := true; ; first = false {
+		wait := s.Refresh
+		if age := time.Since(s.cachedAt); first && age < s.Refresh {
+			// the cached copy is recent enough: fetch when it is due
+			wait = s.Refresh - age
+			log.Printf("block list %s: cached copy is %v old, next refresh in %v", s.Name, age.Round(time.Second), wait.Round(time.Second))
+		} else if err := r.refresh(ctx, s); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("block list %s: refresh failed: %v", s.Name, err)
+			if blockListRetryInterval < wait {
+				wait = blockListRetryInterval
+			}
+		}
+		next := time.Now().Add(wait)
+		s.mu.Lock()
+		s.status.NextRefresh = &next
+		s.mu.Unlock()
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-s.refreshNow:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// refresh fetches s and swaps it into the blocker. The current list is kept when the fetch
+// fails or finds no entries at all.
+func (r *blockListRefresher) refresh(ctx context.Context, s *blockListSource) error {
+	now := time.Now()
+	s.mu.Lock()
+	s.status.LastAttempt = &now
+	etag, lastModified := s.etag, s.lastModified
+	s.mu.Unlock()
+
+	contents, resp, err := r.fetch(ctx, s.URL, etag, lastModified)
+	if err == nil && resp.StatusCode == http.StatusNotModified {
+		// the cached copy is still current as of now
+		if err := r.touchCache(s, now); err != nil {
+			log.Printf("block list %s: unable to update cache: %v", s.Name, err)
+		}
+	}
+	if err == nil && resp.StatusCode != http.StatusNotModified {
+		fqdns := forwardproxy.ParseIPHostFile(bytes.NewReader(contents), ' ', '#')
+		if len(fqdns) == 0 {
+			err = errors.New("no entries found")
+		} else {
+			r.blocker.ReplaceBlockList(s.Name, fqdns)
+			log.Printf("block list %s: refreshed with %d entries", s.Name, len(fqdns))
+			meta := blockListCacheMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+			if err := r.writeCache(s, contents, meta); err != nil {
+				log.Printf("block list %s: unable to write cache: %v", s.Name, err)
+			}
+			s.mu.Lock()
+			s.status.Entries = len(fqdns)
+			s.status.FromCache = false
+			s.etag, s.lastModified = meta.ETag, meta.LastModified
+			s.mu.Unlock()
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		s.status.LastError = err.Error()
+		return err
+	}
+	done := time.Now()
+	s.status.LastSuccess = &done
+	s.status.LastError = ""
+	return nil
+}
+
+func (r *blockListRefresher) fetch(ctx context.Context, url, etag, lastModified string) ([]byte, *http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, resp, nil
+	default:
+		return nil, nil, fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	contents, err := io.ReadAll(io.LimitReader(resp.Body, maxBlockListSize+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(contents) > maxBlockListSize {
+		return nil, nil, fmt.Errorf("larger than %d bytes", maxBlockListSize)
+	}
+	return contents, resp, nil
+}
+
+func (r *blockListRefresher) cacheFile(s *blockListSource, ext string) string {
+	sum := sha256.Sum256([]byte(s.URL))
+	return filepath.Join(r.cache, hex.EncodeToString(sum[:8])+ext)
+}
+
+// readCache returns the cached copy of s and when it was last known to be current, and
+// restores the validators it was served with
+func (r *blockListRefresher) readCache(s *blockListSource) ([]byte, time.Time, error) {
+	if r.cache == "" {
+		return nil, time.Time{}, os.ErrNotExist
+	}
+	fname := r.cacheFile(s, ".hosts")
+	fi, err := os.Stat(fname)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	var meta blockListCacheMeta
+	if raw, err := os.ReadFile(r.cacheFile(s, ".meta")); err == nil {
+		if err := yaml.Unmarshal(raw, &meta); err != nil {
+			log.Printf("block list %s: ignoring unreadable cache metadata: %v", s.Name, err)
+		}
+	}
+	s.etag, s.lastModified = meta.ETag, meta.LastModified
+	return contents, fi.ModTime(), nil
+}
+
+func (r *blockListRefresher) writeCache(s *blockListSource, contents []byte, meta blockListCacheMeta) error {
+	if r.cache == "" {
+		return nil
+	}
+	if err := os.MkdirAll(r.cache, 0755); err != nil {
+		return err
+	}
+	raw, err := yaml.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	// the list first: stale validators beside a newer list only cost a full fetch, while
+	// new ones beside an older list would have it confirmed as current
+	if err := writeFileAtomic(r.cacheFile(s, ".hosts"), contents, 0644, ""); err != nil {
+		return err
+	}
+	return writeFileAtomic(r.cacheFile(s, ".meta"), raw, 0644, "")
+}
+
+// touchCache records that the cached copy was confirmed current at t
+func (r *blockListRefresher) touchCache(s *blockListSource, t time.Time) error {
+	if r.cache == "" {
+		return nil
+	}
+	err := os.Chtimes(r.cacheFile(s, ".hosts"), t, t)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// refreshNow asks for name, or every source when name is empty, to be refreshed straight away
+func (r *blockListRefresher) refreshNow(name string) bool {
+	found := false
+	for _, s := range r.sources {
+		if name != "" && s.Name != name {
+			continue
+		}
+		found = true
+		select {
+		case s.refreshNow <- struct{}{}:
+		default:
+		}
+	}
+	return found
+}
+
+func (r *blockListRefresher) statuses() []blockListSourceStatus {
+	result := []blockListSourceStatus{}
+	if r == nil {
+		return result
+	}
+	for _, s := range r.sources {
+		s.mu.Lock()
+		result = append(result, s.status)
+		s.mu.Unlock()
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+// blockListSourcesV1Handler reports the refresh status of each remote block list; POST
+// refreshes them now, or only the one named by ?name=
+func blockListSourcesV1Handler(r *blockListRefresher) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, r.statuses())
+		case http.MethodPost:
+			name := req.URL.Query().Get("name")
+			if r == nil || !r.refreshNow(name) {
+				writeJSONError(w, http.StatusNotFound, "no block list source %s", name)
+				return
+			}
+			writeJSON(w, http.StatusAccepted, r.statuses())
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", req.Method)
+		}
+	}
+}
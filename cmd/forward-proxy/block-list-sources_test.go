@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+// hostsServer serves a hosts file under an ETag and answers 304 when the client has it
+type hostsServer struct {
+	mu          sync.Mutex
+	etag, body  string
+	status      int
+	requests    int
+	notModified int
+}
+
+func (h *hostsServer) set(etag, body string, status int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.etag, h.body, h.status = etag, body, status
+}
+
+func (h *hostsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.requests++
+	if h.status != http.StatusOK {
+		w.WriteHeader(h.status)
+		return
+	}
+	if r.Header.Get("If-None-Match") == h.etag {
+		h.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", h.etag)
+	w.Write([]byte(h.body))
+}
+
+func TestBlockListRefresh(t *testing.T) {
+	hosts := &hostsServer{}
+	hosts.set(`"v1"`, "# ads\n0.0.0.0 ads.com\n0.0.0.0 tracker.com\n", http.StatusOK)
+	srv := httptest.NewServer(hosts)
+	defer srv.Close()
+	cache := t.TempDir()
+	ctx := context.Background()
+
+	blocker := forwardproxy.NewStaticFQDNBlocker()
+	r, err := newBlockListRefresher(blocker, []blockListSourceConfig{{Name: "remote", URL: srv.URL}}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := r.sources[0]
+	blockedBy := func(fqdn string) string {
+		list, _ := blocker.BlockedBy(fqdn)
+		return list
+	}
+	if blockedBy("ads.com") != "" {
+		t.Fatal("list populated before the first fetch")
+	}
+
+	if err := r.refresh(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if blockedBy("ads.com") != "remote" || blockedBy("tracker.com") != "remote" {
+		t.Fatal("fetched list not applied")
+	}
+	if err := r.refresh(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if hosts.notModified != 1 || blockedBy("ads.com") != "remote" {
+		t.Errorf("unchanged list: %d 304 responses, ads.com blocked by %q", hosts.notModified, blockedBy("ads.com"))
+	}
+
+	hosts.set(`"v2"`, "0.0.0.0 ads.com\n0.0.0.0 new.com\n", http.StatusOK)
+	if err := r.refresh(ctx, s); err != nil {
+		t.Fatal(err)
+	}
+	if blockedBy("new.com") != "remote" || blockedBy("tracker.com") != "" {
+		t.Error("changed list not applied")
+	}
+
+	// a list with no entries or a failing server leaves the current list in place
+	hosts.set(`"v3"`, "# nothing here\n", http.StatusOK)
+	if err := r.refresh(ctx, s); err == nil {
+		t.Error("empty list accepted")
+	}
+	hosts.set(`"v3"`, "", http.StatusInternalServerError)
+	if err := r.refresh(ctx, s); err == nil {
+		t.Error("server error not reported")
+	}
+	if blockedBy("new.com") != "remote" {
+		t.Error("list dropped after failed refreshes")
+	}
+	status := r.statuses()[0]
+	if status.Entries != 2 || status.LastError == "" || status.LastSuccess == nil {
+		t.Errorf("status = %+v", status)
+	}
+
+	// a restart applies the cached copy before fetching anything and revalidates it with
+	// the ETag it was served with
+	restarted := forwardproxy.NewStaticFQDNBlocker()
+	r, err = newBlockListRefresher(restarted, []blockListSourceConfig{{Name: "remote", URL: srv.URL}}, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list, _ := restarted.BlockedBy("new.com"); list != "remote" || !r.statuses()[0].FromCache {
+		t.Errorf("cached list not loaded: %q, %+v", list, r.statuses()[0])
+	}
+	hosts.set(`"v2"`, "0.0.0.0 ads.com\n0.0.0.0 new.com\n", http.StatusOK)
+	stale := time.Now().Add(-2 * time.Hour)
+	cached := r.cacheFile(r.sources[0], ".hosts")
+	os.Chtimes(cached, stale, stale)
+	if err := r.refresh(ctx, r.sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	if hosts.notModified != 2 {
+		t.Errorf("restart fetched the list again: %d 304 responses", hosts.notModified)
+	}
+	if fi, err := os.Stat(cached); err != nil || !fi.ModTime().After(stale) {
+		t.Errorf("304 did not mark the cache as current: %v", err)
+	}
+}
+
+func TestBlockListRefreshLoopUsesFreshCache(t *testing.T) {
+	hosts := &hostsServer{}
+	hosts.set(`"v1"`, "0.0.0.0 ads.com\n", http.StatusOK)
+	srv := httptest.NewServer(hosts)
+	defer srv.Close()
+	cache := t.TempDir()
+	configs := []blockListSourceConfig{{Name: "remote", URL: srv.URL, Refresh: time.Hour}}
+	r, err := newBlockListRefresher(forwardproxy.NewStaticFQDNBlocker(), configs, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.refresh(context.Background(), r.sources[0]); err != nil {
+		t.Fatal(err)
+	}
+	// run the loop of a restarted refresher until it has scheduled its next refresh
+	startLoop := func() {
+		t.Helper()
+		r, err := newBlockListRefresher(forwardproxy.NewStaticFQDNBlocker(), configs, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			r.refreshLoop(ctx, r.sources[0])
+			close(done)
+		}()
+		for i := 0; i < 100 && r.statuses()[0].NextRefresh == nil; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		cancel()
+		<-done
+	}
+
+	startLoop()
+	if hosts.requests != 1 {
+		t.Errorf("fresh cache fetched again: %d requests", hosts.requests)
+	}
+	stale := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(r.cacheFile(r.sources[0], ".hosts"), stale, stale)
+	startLoop()
+	if hosts.requests != 2 || hosts.notModified != 1 {
+		t.Errorf("stale cache: %d requests, %d 304 responses", hosts.requests, hosts.notModified)
+	}
+}
+
+func TestBlockListSourceConfig(t *testing.T) {
+	blocker := forwardproxy.NewStaticFQDNBlocker(forwardproxy.WithStaticFQDNBlockList("ads", []string{"ads.com"}))
+	for name, configs := range map[string][]blockListSourceConfig{
+		"missing url":      {{Name: "a"}},
+		"reserved name":    {{Name: forwardproxy.RuntimeBlockListName, URL: "http://example.com/hosts"}},
+		"short refresh":    {{URL: "http://example.com/hosts", Refresh: 1}},
+		"existing list":    {{Name: "ads", URL: "http://example.com/hosts"}},
+		"duplicate source": {{URL: "http://example.com/hosts"}, {URL: "http://example.com/hosts"}},
+	} {
+		if _, err := newBlockListRefresher(blocker, configs, ""); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+	cfg := blockListSourceConfig{URL: "http://example.com/hosts"}
+	if err := cfg.normalise(); err != nil || cfg.Name != cfg.URL || cfg.Refresh != defaultBlockListRefresh {
+		t.Errorf("normalise() = %+v, %v", cfg, err)
+	}
+}
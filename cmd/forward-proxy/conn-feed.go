@@ -0,0 +1,102 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+const (
+	connFeedHistory          = 200
+	connFeedSubscriberBuffer = 100
+)
+
+// jsonHistEvent is the JSON form of a forwardproxy.HistEvent
+type jsonHistEvent struct {
+	Time    time.Time `json:"time"`
+	FQDN    string    `json:"fqdn"`
+	Blocked bool      `json:"blocked"`
+	List    string    `json:"list,omitempty"`
+	Client  string    `json:"client,omitempty"`
+	User    string    `json:"user,omitempty"`
+	Port    int       `json:"port,omitempty"`
+}
+
+// connFeed is a HistLogger that keeps the most recent events and broadcasts them to
+// live subscribers before handing them on to the next HistLogger
+type connFeed struct {
+	next forwardproxy.HistLogger
+	// internal
+	mu          sync.Mutex
+	recent      []jsonHistEvent
+	subscribers map[chan jsonHistEvent]struct{}
+}
+
+func newConnFeed(next forwardproxy.HistLogger) *connFeed {
+	return &connFeed{
+		next:        next,
+		recent:      make([]jsonHistEvent, 0, connFeedHistory),
+		subscribers: make(map[chan jsonHistEvent]struct{}),
+	}
+}
+
+func (f *connFeed) LogAccepted(fqdn string) {
+	f.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn})
+}
+
+func (f *connFeed) LogBlocked(fqdn string) {
+	f.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn, Blocked: true})
+}
+
+func newJSONHistEvent(ev forwardproxy.HistEvent) jsonHistEvent {
+	return jsonHistEvent{
+		Time:    ev.Time,
+		FQDN:    ev.FQDN,
+		Blocked: ev.Blocked,
+		List:    ev.List,
+		Client:  ev.Client,
+		User:    ev.User,
+		Port:    ev.Port,
+	}
+}
+
+// LogEvent implements forwardproxy.HistEventLogger
+func (f *connFeed) LogEvent(ev forwardproxy.HistEvent) {
+	f.publish(newJSONHistEvent(ev))
+	if f.next != nil {
+		forwardproxy.LogHistEvent(f.next, ev)
+	}
+}
+
+func (f *connFeed) publish(ev jsonHistEvent) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.recent) == connFeedHistory {
+		copy(f.recent, f.recent[1:])
+		f.recent = f.recent[:connFeedHistory-1]
+	}
+	f.recent = append(f.recent, ev)
+	for ch := range f.subscribers {
+		select {
+		case ch <- ev:
+		default:
+			// slow subscribers miss events rather than hold up the proxy
+		}
+	}
+}
+
+// subscribe returns the recent history plus a channel of new events; call cancel when done
+func (f *connFeed) subscribe() ([]jsonHistEvent, <-chan jsonHistEvent, func()) {
+	ch := make(chan jsonHistEvent, connFeedSubscriberBuffer)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	recent := make([]jsonHistEvent, len(f.recent))
+	copy(recent, f.recent)
+	f.subscribers[ch] = struct{}{}
+	return recent, ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.subscribers, ch)
+	}
+}
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+const connectionsV1Path = "/v1/connections"
+
+var (
+	connReapFrequency = time.Second
+	// limit hits are logged at most this often per client
+	connLimitLogInterval = 10 * time.Second
+)
+
+// connLimits are applied to client connections of the proxy listeners; zero means unlimited
+type connLimits struct {
+	maxConns, maxConnsPerClient                int
+	handshakeTimeout, idleTimeout, maxDuration time.Duration
+}
+
+// connTracker admits client connections within the limits and closes those that outstay
+// their welcome: still handshaking after HandshakeTimeout, with no traffic in either
+// direction for IdleTimeout or open for longer than MaxDuration
+type connTracker struct {
+	limits connLimits
+	// internal
+	mu         sync.Mutex
+	conns      map[*trackedConn]struct{}
+	byRemote   map[string]*trackedConn
+	perClient  map[string]int
+	lastLogged map[string]time.Time
+
+	accepted, rejectedGlobal, rejectedPerClient atomic.Uint64
+	closedHandshake, closedIdle, closedDuration atomic.Uint64
+}
+
+func newConnTracker(limits connLimits) *connTracker {
+	return &connTracker{
+		limits:     limits,
+		conns:      make(map[*trackedConn]struct{}),
+		byRemote:   make(map[string]*trackedConn),
+		perClient:  make(map[string]int),
+		lastLogged: make(map[string]time.Time),
+	}
+}
+
+// listener wraps l so its connections are admitted and tracked
+func (t *connTracker) listener(l net.Listener) net.Listener {
+	return &trackedListener{Listener: l, t: t}
+}
+
+type trackedListener struct {
+	net.Listener
+	t *connTracker
+}
+
+func (l *trackedListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		if tc := l.t.admit(c); tc != nil {
+			return tc, nil
+		}
+		c.Close()
+	}
+}
+
+func (t *connTracker) admit(c net.Conn) *trackedConn {
+	client := clientHost(c.RemoteAddr().String())
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.limits.maxConns > 0 && len(t.conns) >= t.limits.maxConns {
+		t.rejectedGlobal.Add(1)
+		t.logLimited("", "connection limit of %d reached: rejecting %s", t.limits.maxConns, client)
+		return nil
+	}
+	if t.limits.maxConnsPerClient > 0 && t.perClient[client] >= t.limits.maxConnsPerClient {
+		t.rejectedPerClient.Add(1)
+		t.logLimited(client, "per-client connection limit of %d reached: rejecting %s", t.limits.maxConnsPerClient, client)
+		return nil
+	}
+	now := time.Now()
+	tc := &trackedConn{Conn: c, t: t, client: client, accepted: now}
+	tc.lastActive.Store(now.UnixNano())
+	t.conns[tc] = struct{}{}
+	t.byRemote[c.RemoteAddr().String()] = tc
+	t.perClient[client]++
+	t.accepted.Add(1)
+	return tc
+}
+
+// logLimited logs at most once per connLimitLogInterval per key; t.mu must be held
+func (t *connTracker) logLimited(key string, format string, args ...interface{}) {
+	now := time.Now()
+	if now.Sub(t.lastLogged[key]) < connLimitLogInterval {
+		return
+	}
+	if len(t.lastLogged) > 1000 {
+		t.lastLogged = make(map[string]time.Time)
+	}
+	t.lastLogged[key] = now
+	log.Printf(format, args...)
+}
+
+func (t *connTracker) release(tc *trackedConn) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.conns[tc]; !ok {
+		return
+	}
+	delete(t.conns, tc)
+	if t.byRemote[tc.RemoteAddr().String()] == tc {
+		delete(t.byRemote, tc.RemoteAddr().String())
+	}
+	if t.perClient[tc.client]--; t.perClient[tc.client] <= 0 {
+		delete(t.perClient, tc.client)
+	}
+}
+
+// handshakeDone is called once a client has made its request. The control connection of a
+// UDP association stays silent while datagrams flow, so it is exempt from the idle timeout.
+func (t *connTracker) handshakeDone(remote net.Addr, command byte) {
+	if remote == nil {
+		return
+	}
+	t.mu.Lock()
+	tc := t.byRemote[remote.String()]
+	t.mu.Unlock()
+	if tc == nil {
+		return
+	}
+	tc.handshaken.Store(true)
+	if command == statute.CommandAssociate {
+		tc.noIdle.Store(true)
+	}
+}
+
+// run closes connections that exceed the timeouts until ctx is done
+func (t *connTracker) run(ctx context.Context) {
+	if t.limits.handshakeTimeout == 0 && t.limits.idleTimeout == 0 && t.limits.maxDuration == 0 {
+		return
+	}
+	ticker := time.NewTicker(connReapFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			t.reap(now)
+		}
+	}
+}
+
+func (t *connTracker) reap(now time.Time) {
+	type expired struct {
+		tc     *trackedConn
+		reason string
+	}
+	var victims []expired
+	t.mu.Lock()
+	for tc := range t.conns {
+		switch {
+		case t.limits.handshakeTimeout > 0 && !tc.handshaken.Load() && now.Sub(tc.accepted) > t.limits.handshakeTimeout:
+			t.closedHandshake.Add(1)
+			victims = append(victims, expired{tc, "handshake timeout"})
+		case t.limits.maxDuration > 0 && now.Sub(tc.accepted) > t.limits.maxDuration:
+			t.closedDuration.Add(1)
+			victims = append(victims, expired{tc, "maximum duration"})
+		case t.limits.idleTimeout > 0 && !tc.noIdle.Load() && now.Sub(time.Unix(0, tc.lastActive.Load())) > t.limits.idleTimeout:
+			t.closedIdle.Add(1)
+			victims = append(victims, expired{tc, "idle timeout"})
+		}
+	}
+	for _, v := range victims {
+		t.logLimited(v.tc.client+v.reason, "closing connection from %s: %s", v.tc.RemoteAddr(), v.reason)
+	}
+	t.mu.Unlock()
+	for _, v := range victims {
+		v.tc.Close()
+	}
+}
+
+// drain waits until every tracked connection has closed or ctx is done and returns the
+// number still open
+func (t *connTracker) drain(ctx context.Context) int {
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		t.mu.Lock()
+		active := len(t.conns)
+		t.mu.Unlock()
+		if active == 0 {
+			return 0
+		}
+		select {
+		case <-ctx.Done():
+			return active
+		case <-ticker.C:
+		}
+	}
+}
+
+// closeAll closes every tracked connection and returns how many there were
+func (t *connTracker) closeAll() int {
+	t.mu.Lock()
+	victims := make([]*trackedConn, 0, len(t.conns))
+	for tc := range t.conns {
+		victims = append(victims, tc)
+	}
+	t.mu.Unlock()
+	for _, tc := range victims {
+		tc.Close()
+	}
+	return len(victims)
+}
+
+type connStats struct {
+	Active            int            `json:"active"`
+	Accepted          uint64         `json:"accepted"`
+	RejectedGlobal    uint64         `json:"rejectedGlobal"`
+	RejectedPerClient uint64         `json:"rejectedPerClient"`
+	ClosedHandshake   uint64         `json:"closedHandshake"`
+	ClosedIdle        uint64         `json:"closedIdle"`
+	ClosedMaxDuration uint64         `json:"closedMaxDuration"`
+	Clients           map[string]int `json:"clients"`
+	Limits            connLimitsJSON `json:"limits"`
+}
+
+// connLimitsJSON shows durations as strings such as 30s
+type connLimitsJSON struct {
+	MaxConns          int    `json:"maxConns"`
+	MaxConnsPerClient int    `json:"maxConnsPerClient"`
+	HandshakeTimeout  string `json:"handshakeTimeout"`
+	IdleTimeout       string `json:"idleTimeout"`
+	MaxDuration       string `json:"maxDuration"`
+}
+
+func (t *connTracker) stats() connStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	result := connStats{
+		Active:            len(t.conns),
+		Accepted:          t.accepted.Load(),
+		RejectedGlobal:    t.rejectedGlobal.Load(),
+		RejectedPerClient: t.rejectedPerClient.Load(),
+		ClosedHandshake:   t.closedHandshake.Load(),
+		ClosedIdle:        t.closedIdle.Load(),
+		ClosedMaxDuration: t.closedDuration.Load(),
+		Clients:           make(map[string]int, len(t.perClient)),
+		Limits: connLimitsJSON{
+			MaxConns:          t.limits.maxConns,
+			MaxConnsPerClient: t.limits.maxConnsPerClient,
+			HandshakeTimeout:  t.limits.handshakeTimeout.String(),
+			IdleTimeout:       t.limits.idleTimeout.String(),
+			MaxDuration:       t.limits.maxDuration.String(),
+		},
+	}
+	for k, v := range t.perClient {
+		result.Clients[k] = v
+	}
+	return result
+}
+
+// trackedConn records activity in both directions and releases its slot when closed
+type trackedConn struct {
+	net.Conn
+	t        *connTracker
+	client   string
+	accepted time.Time
+	// internal
+	lastActive atomic.Int64
+	handshaken atomic.Bool
+	noIdle     atomic.Bool
+	closeOnce  sync.Once
+}
+
+func (c *trackedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+func (c *trackedConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// CloseWrite keeps half-closes working for the relays
+func (c *trackedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return fmt.Errorf("close write not supported")
+}
+
+func (c *trackedConn) Close() error {
+	c.closeOnce.Do(func() { c.t.release(c) })
+	return c.Conn.Close()
+}
+
+// trackedRules tells the tracker when a client's handshake is complete
+type trackedRules struct {
+	next    socks5.RuleSet
+	tracker *connTracker
+}
+
+func (r trackedRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	r.tracker.handshakeDone(req.RemoteAddr, req.Command)
+	return r.next.Allow(ctx, req)
+}
+
+// connectionsV1Handler reports active connections, limit hits and the limits in force
+func connectionsV1Handler(tracker *connTracker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+			return
+		}
+		writeJSON(w, http.StatusOK, tracker.stats())
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// remoteConn gives one end of a net.Pipe a client address
+type remoteConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c remoteConn) RemoteAddr() net.Addr { return c.remote }
+
+// pipeFrom returns the proxy end of a pipe from addr and closes both ends when the test ends
+func pipeFrom(t *testing.T, addr string) (proxy net.Conn, client net.Conn) {
+	t.Helper()
+	p, c := net.Pipe()
+	t.Cleanup(func() { p.Close(); c.Close() })
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return remoteConn{Conn: p, remote: remote}, c
+}
+
+func TestConnTrackerAdmit(t *testing.T) {
+	tests := []struct {
+		name                              string
+		limits                            connLimits
+		clients                           []string
+		wantAdmitted                      int
+		wantRejectedGlobal, wantPerClient uint64
+	}{
+		{"unlimited", connLimits{}, []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1"}, 3, 0, 0},
+		{"global", connLimits{maxConns: 2}, []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"}, 2, 1, 0},
+		{"per client", connLimits{maxConnsPerClient: 1}, []string{"10.0.0.1:1", "10.0.0.1:2", "10.0.0.2:1"}, 2, 0, 1},
+	}
+	for _, tt := range tests {
+		tracker := newConnTracker(tt.limits)
+		admitted := 0
+		for _, client := range tt.clients {
+			c, _ := pipeFrom(t, client)
+			if tracker.admit(c) != nil {
+				admitted++
+			}
+		}
+		stats := tracker.stats()
+		if admitted != tt.wantAdmitted || stats.Active != tt.wantAdmitted {
+			t.Errorf("%s: admitted %d, active %d, want %d", tt.name, admitted, stats.Active, tt.wantAdmitted)
+		}
+		if stats.RejectedGlobal != tt.wantRejectedGlobal || stats.RejectedPerClient != tt.wantPerClient {
+			t.Errorf("%s: rejected %d global, %d per client", tt.name, stats.RejectedGlobal, stats.RejectedPerClient)
+		}
+	}
+}
+
+func TestConnTrackerReap(t *testing.T) {
+	const limit = time.Minute
+	tests := []struct {
+		name   string
+		limits connLimits
+		// prepare runs against the admitted conn and the client end before reaping
+		prepare   func(tc *trackedConn, client net.Conn)
+		after     time.Duration
+		wantClose bool
+		counter   func(s connStats) uint64
+	}{
+		{"handshake timeout", connLimits{handshakeTimeout: limit}, nil, limit + time.Second, true,
+			func(s connStats) uint64 { return s.ClosedHandshake }},
+		{"handshake in time", connLimits{handshakeTimeout: limit}, nil, limit - time.Second, false,
+			func(s connStats) uint64 { return s.ClosedHandshake }},
+		{"idle timeout", connLimits{idleTimeout: limit}, nil, limit + time.Second, true,
+			func(s connStats) uint64 { return s.ClosedIdle }},
+		{"idle exempt for udp associate", connLimits{idleTimeout: limit}, func(tc *trackedConn, _ net.Conn) {
+			tc.t.handshakeDone(tc.RemoteAddr(), statute.CommandAssociate)
+		}, limit + time.Second, false, func(s connStats) uint64 { return s.ClosedIdle }},
+		{"read resets idle", connLimits{idleTimeout: limit}, func(tc *trackedConn, client net.Conn) {
+			tc.lastActive.Store(time.Now().Add(-2 * limit).UnixNano())
+			go client.Write([]byte("x"))
+			tc.Read(make([]byte, 1))
+		}, 0, false, func(s connStats) uint64 { return s.ClosedIdle }},
+		{"write resets idle", connLimits{idleTimeout: limit}, func(tc *trackedConn, client net.Conn) {
+			tc.lastActive.Store(time.Now().Add(-2 * limit).UnixNano())
+			go client.Read(make([]byte, 1))
+			tc.Write([]byte("x"))
+		}, 0, false, func(s connStats) uint64 { return s.ClosedIdle }},
+		{"maximum duration", connLimits{maxDuration: limit, idleTimeout: 2 * limit}, func(tc *trackedConn, _ net.Conn) {
+			tc.t.handshakeDone(tc.RemoteAddr(), statute.CommandConnect)
+		}, limit + time.Second, true, func(s connStats) uint64 { return s.ClosedMaxDuration }},
+	}
+	for _, tt := range tests {
+		tracker := newConnTracker(tt.limits)
+		c, client := pipeFrom(t, "10.0.0.1:50000")
+		tc := tracker.admit(c)
+		if tt.prepare != nil {
+			tt.prepare(tc, client)
+		}
+		tracker.reap(time.Now().Add(tt.after))
+		stats := tracker.stats()
+		if closed := stats.Active == 0; closed != tt.wantClose {
+			t.Errorf("%s: closed = %v, want %v", tt.name, closed, tt.wantClose)
+		}
+		if got, want := tt.counter(stats), map[bool]uint64{true: 1}[tt.wantClose]; got != want {
+			t.Errorf("%s: counter = %d, want %d", tt.name, got, want)
+		}
+		if tt.wantClose {
+			client.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+				t.Errorf("%s: client end not closed: %v", tt.name, err)
+			}
+		}
+	}
+}
+
+func TestConnTrackerReleasesOnce(t *testing.T) {
+	tracker := newConnTracker(connLimits{maxConnsPerClient: 2})
+	first, _ := pipeFrom(t, "10.0.0.1:1")
+	second, _ := pipeFrom(t, "10.0.0.1:2")
+	tc := tracker.admit(first)
+	tracker.admit(second)
+	tc.Close()
+	tc.Close()
+	if stats := tracker.stats(); stats.Active != 1 || stats.Clients["10.0.0.1"] != 1 {
+		t.Errorf("after double close: %+v", stats)
+	}
+	third, _ := pipeFrom(t, "10.0.0.1:3")
+	fourth, _ := pipeFrom(t, "10.0.0.1:4")
+	if tracker.admit(third) == nil || tracker.admit(fourth) != nil {
+		t.Error("per-client slots miscounted after double close")
+	}
+}
+
+func TestConnTrackerDrain(t *testing.T) {
+	tracker := newConnTracker(connLimits{})
+	c, _ := pipeFrom(t, "10.0.0.1:1")
+	tc := tracker.admit(c)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+	defer cancel()
+	if active := tracker.drain(ctx); active != 1 {
+		t.Errorf("drain with an open conn = %d, want 1", active)
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() { tc.Close() })
+	done := make(chan int, 1)
+	go func() { done <- tracker.drain(context.Background()) }()
+	select {
+	case active := <-done:
+		if active != 0 {
+			t.Errorf("drain = %d, want 0", active)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("drain did not return once the conn closed")
+	}
+
+	for _, client := range []string{"10.0.0.1:2", "10.0.0.2:1"} {
+		c, _ := pipeFrom(t, client)
+		tracker.admit(c)
+	}
+	if n := tracker.closeAll(); n != 2 || tracker.drain(context.Background()) != 0 {
+		t.Errorf("closeAll = %d", n)
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"sort"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+const (
+	dashboardPath     = "/ui/"
+	eventsV1Path      = "/v1/events"
+	blockListsV1Path  = "/v1/blocklists"
+	policyAllowV1Path = "/v1/policy/allow"
+	policyBlockV1Path = "/v1/policy/block"
+)
+
+//go:embed ui
+var dashboardFS embed.FS
+
+// dashboardHandler serves the embedded dashboard under dashboardPath
+func dashboardHandler() (http.Handler, error) {
+	sub, err := fs.Sub(dashboardFS, "ui")
+	if err != nil {
+		return nil, fmt.Errorf("dashboard assets: %w", err)
+	}
+	return http.StripPrefix(dashboardPath, http.FileServer(http.FS(sub))), nil
+}
+
+// eventsV1Handler streams connection events as server-sent events, starting with recent history
+func eventsV1Handler(feed *connFeed) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+			return
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			writeJSONError(w, http.StatusInternalServerError, "streaming not supported")
+			return
+		}
+		recent, events, cancel := feed.subscribe()
+		defer cancel()
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(http.StatusOK)
+		send := func(ev jsonHistEvent) error {
+			contents, err := json.Marshal(ev)
+			if err != nil {
+				return err
+			}
+			_, err = fmt.Fprintf(w, "data: %s\n\n", contents)
+			return err
+		}
+		for _, ev := range recent {
+			if err := send(ev); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+		for {
+			select {
+			case ev := <-events:
+				if err := send(ev); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+type blockListSize struct {
+	Name string `json:"name"`
+	Size int    `json:"size"`
+}
+
+func blockListsV1Handler(blocker *forwardproxy.StaticFQDNBlocker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+			return
+		}
+		sizes := blocker.BlockListSizes()
+		result := make([]blockListSize, 0, len(sizes))
+		for k, v := range sizes {
+			result = append(result, blockListSize{Name: k, Size: v})
+		}
+		sort.Slice(result, func(i, j int) bool {
+			return result[i].Name < result[j].Name
+		})
+		writeJSON(w, http.StatusOK, result)
+	}
+}
+
+type policyAPIRequest struct {
+	FQDN string `json:"fqdn"`
+}
+
+// policyV1Handler applies apply to the FQDN in the request body; used for allow and block
+func policyV1Handler(action string, apply func(string)) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+			return
+		}
+		var input policyAPIRequest
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			writeJSONError(w, http.StatusBadRequest, "unable to parse request: %v", err)
+			return
+		}
+		if input.FQDN == "" {
+			writeJSONError(w, http.StatusBadRequest, "missing fqdn")
+			return
+		}
+		apply(input.FQDN)
+		log.Printf("%s: %s", action, input.FQDN)
+		writeJSON(w, http.StatusOK, input)
+	}
+}
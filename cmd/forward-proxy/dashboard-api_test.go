@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDashboardHandler(t *testing.T) {
+	handler, err := dashboardHandler()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path        string
+		status      int
+		contentType string
+		contains    string
+	}{
+		{"/ui/", http.StatusOK, "text/html", `src="app.js"`},
+		{"/ui/index.html", http.StatusMovedPermanently, "", ""},
+		{"/ui/app.js", http.StatusOK, "javascript", ""},
+		{"/ui/style.css", http.StatusOK, "text/css", ""},
+		{"/ui/missing.js", http.StatusNotFound, "", ""},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status {
+			t.Errorf("GET %s = %d, want %d", tt.path, w.Code, tt.status)
+			continue
+		}
+		if ct := w.Header().Get("Content-Type"); tt.contentType != "" && !strings.Contains(ct, tt.contentType) {
+			t.Errorf("GET %s content type %s, want %s", tt.path, ct, tt.contentType)
+		}
+		if tt.status == http.StatusOK && w.Body.Len() == 0 {
+			t.Errorf("GET %s served nothing", tt.path)
+		}
+		if !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("GET %s does not contain %s", tt.path, tt.contains)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	dnsOverridesV1Path = "/v1/dns/overrides"
+	openAPIV1Path      = "/v1/openapi.yaml"
+)
+
+//go:embed openapi.yaml
+var openAPISpec []byte
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.WriteHeader(http.StatusOK)
+	w.Write(openAPISpec)
+}
+
+// dnsOverridesV1Handler serves the collection: GET lists and POST registers in bulk
+func dnsOverridesV1Handler(dr *dnsResolver) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, newDNSAPIResponses(dr.registry.Registrations()))
+		case http.MethodPost:
+			var input []dnsAPIRequest
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "unable to parse request: %v", err)
+				return
+			}
+			for c, v := range input {
+				if err := v.validate(); err != nil {
+					writeJSONError(w, http.StatusBadRequest, "%v on index %d of input", err, c+1)
+					return
+				}
+			}
+			for _, v := range input {
+				if err := v.register(dr); err != nil {
+					writeJSONError(w, http.StatusInternalServerError, "unable to register %s: %v", v.Addr, err)
+					return
+				}
+				log.Printf("registered: %s - %s", v.Addr, v.IP)
+			}
+			writeJSON(w, http.StatusOK, map[string]int{"processed": len(input)})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+		}
+	}
+}
+
+// dnsOverrideV1Handler serves a single override addressed by name: GET, PUT (create or replace) and DELETE
+func dnsOverrideV1Handler(dr *dnsResolver) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, dnsOverridesV1Path+"/")
+		if name == "" || strings.Contains(name, "/") {
+			writeJSONError(w, http.StatusNotFound, "invalid override name: %q", name)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			e, found := dr.registry.Get(name)
+			if !found {
+				writeJSONError(w, http.StatusNotFound, "no override registered for %s", name)
+				return
+			}
+			writeJSON(w, http.StatusOK, newDNSAPIResponse(name, e))
+		case http.MethodPut:
+			var input dnsAPIRequest
+			if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "unable to parse request: %v", err)
+				return
+			}
+			if input.Addr != "" && input.Addr != name {
+				writeJSONError(w, http.StatusBadRequest, "addr %s in body does not match %s in path", input.Addr, name)
+				return
+			}
+			input.Addr = name
+			if err := input.validate(); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			_, existed := dr.registry.Get(name)
+			if err := input.register(dr); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, "unable to register %s: %v", name, err)
+				return
+			}
+			log.Printf("registered: %s - %s", name, input.IP)
+			status := http.StatusCreated
+			if existed {
+				status = http.StatusOK
+			}
+			e, _ := dr.registry.Get(name)
+			writeJSON(w, status, newDNSAPIResponse(name, e))
+		case http.MethodDelete:
+			if err := dr.registry.Delete(name); err != nil {
+				if errors.Is(err, errDNSOverrideNotFound) {
+					writeJSONError(w, http.StatusNotFound, "no override registered for %s", name)
+					return
+				}
+				if errors.Is(err, errDNSOverrideStatic) {
+					writeJSONError(w, http.StatusConflict, "override for %s is set by configuration", name)
+					return
+				}
+				writeJSONError(w, http.StatusInternalServerError, "unable to delete %s: %v", name, err)
+				return
+			}
+			log.Printf("deregistered: %s", name)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+		}
+	}
+}
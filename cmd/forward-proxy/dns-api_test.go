@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDNSOverridesAPI(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "dns.yml")
+	registry, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	registry.RegisterStatic("api", net.ParseIP("127.0.0.1"), "")
+	dr := newDNSResolver("api", registry)
+	mux := http.NewServeMux()
+	mux.HandleFunc(dnsOverridesV1Path, dnsOverridesV1Handler(dr))
+	mux.HandleFunc(dnsOverridesV1Path+"/", dnsOverrideV1Handler(dr))
+	call := func(method, path, body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path, strings.NewReader(body)))
+		return w
+	}
+
+	steps := []struct {
+		method, path, body string
+		want               int
+	}{
+		{"POST", dnsOverridesV1Path, `[{"addr":"printer.lan","ip":"192.168.1.20"},{"addr":"*.dev.internal","ip":"10.0.0.5","ttl":3600}]`, http.StatusOK},
+		{"POST", dnsOverridesV1Path, `[{"addr":"ok.lan","ip":"10.0.0.1"},{"addr":"bad.lan","ip":"nope"}]`, http.StatusBadRequest},
+		{"PUT", dnsOverridesV1Path + "/nas.lan", `{"ip":"192.168.1.30","comment":"attic"}`, http.StatusCreated},
+		{"PUT", dnsOverridesV1Path + "/nas.lan", `{"ip":"192.168.1.31"}`, http.StatusOK},
+		{"PUT", dnsOverridesV1Path + "/nas.lan", `{"addr":"other.lan","ip":"192.168.1.31"}`, http.StatusBadRequest},
+		{"PUT", dnsOverridesV1Path + "/a.*.lan", `{"ip":"192.168.1.31"}`, http.StatusBadRequest},
+		{"GET", dnsOverridesV1Path + "/nas.lan", "", http.StatusOK},
+		{"GET", dnsOverridesV1Path + "/missing.lan", "", http.StatusNotFound},
+		{"DELETE", dnsOverridesV1Path + "/printer.lan", "", http.StatusNoContent},
+		{"DELETE", dnsOverridesV1Path + "/printer.lan", "", http.StatusNotFound},
+		{"DELETE", dnsOverridesV1Path + "/api", "", http.StatusConflict},
+		{"PATCH", dnsOverridesV1Path, "", http.StatusMethodNotAllowed},
+	}
+	for _, s := range steps {
+		if w := call(s.method, s.path, s.body); w.Code != s.want {
+			t.Fatalf("%s %s = %d, want %d: %s", s.method, s.path, w.Code, s.want, w.Body)
+		}
+	}
+	if _, ok := registry.Lookup("ok.lan"); ok {
+		t.Error("a rejected bulk request registered part of its input")
+	}
+
+	var listed []dnsAPIRequest
+	if err := json.Unmarshal(call("GET", dnsOverridesV1Path, "").Body.Bytes(), &listed); err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]dnsAPIRequest)
+	for _, v := range listed {
+		got[v.Addr] = v
+	}
+	if len(got) != 3 || got["nas.lan"].IP != "192.168.1.31" || got["*.dev.internal"].Expires == nil || !got["api"].Static {
+		t.Errorf("listed %+v", listed)
+	}
+
+	reloaded, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ip, ok := reloaded.Lookup("build.dev.internal"); !ok || !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Errorf("wildcard not persisted: %v, %v", ip, ok)
+	}
+	if len(reloaded.Registrations()) != 2 {
+		t.Errorf("persisted %v", reloaded.Registrations())
+	}
+}
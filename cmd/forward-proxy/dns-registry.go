@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	errDNSOverrideNotFound = errors.New("dns override not found")
+	errDNSOverrideStatic   = errors.New("dns override is set by configuration")
+)
+
+var dnsExpiryFrequency = time.Minute
+
+type dnsOverrideEntry struct {
+	ip      net.IP
+	expires time.Time
+	comment string
+	// static entries come from configuration and are never persisted
+	static bool
+}
+
+func (e dnsOverrideEntry) expired(now time.Time) bool {
+	return !e.expires.IsZero() && !now.Before(e.expires)
+}
+
+// dnsRegistry is a concurrency-safe store of DNS overrides. When fname is set every
+// mutation is written to it before it takes effect so registrations survive restarts.
+// Static overrides, such as those of the config file, sit underneath the registered ones
+// and are never written to fname.
+type dnsRegistry struct {
+	fname string
+	// internal
+	mu      sync.RWMutex
+	entries map[string]dnsOverrideEntry
+	static  map[string]dnsOverrideEntry
+	// serialises mutations so the file always reflects the latest state
+	writeMu sync.Mutex
+}
+
+func newDNSRegistry(fname string) (*dnsRegistry, error) {
+	result := &dnsRegistry{
+		fname:   fname,
+		entries: make(map[string]dnsOverrideEntry),
+		static:  make(map[string]dnsOverrideEntry),
+	}
+	if fname == "" {
+		return result, nil
+	}
+	entries, err := dnsOverridesFromFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	result.entries = entries
+	return result, nil
+}
+
+// Lookup prefers an exact match and otherwise falls back to the most
+// specific wildcard, i.e. for a.b.dev.internal *.b.dev.internal wins over *.dev.internal
+func (r *dnsRegistry) Lookup(name string) (net.IP, bool) {
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if e, found := r.entry(name, now); found {
+		return e.ip, true
+	}
+	for suffix := name; ; {
+		idx := strings.IndexByte(suffix, '.')
+		if idx < 0 {
+			return nil, false
+		}
+		suffix = suffix[idx+1:]
+		if e, found := r.entry(wildcardPrefix+suffix, now); found {
+			return e.ip, true
+		}
+	}
+}
+
+// entry returns the live override registered under exactly name, the caller holding mu
+func (r *dnsRegistry) entry(name string, now time.Time) (dnsOverrideEntry, bool) {
+	if e, found := r.entries[name]; found && !e.expired(now) {
+		return e, true
+	}
+	e, found := r.static[name]
+	return e, found
+}
+
+// Get returns the override registered under exactly domainName
+func (r *dnsRegistry) Get(domainName string) (dnsOverrideEntry, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.entry(domainName, time.Now())
+}
+
+// RegisterStatic adds an override that lasts until the process exits and is never persisted.
+// Registered overrides of the same name take precedence.
+func (r *dnsRegistry) RegisterStatic(domainName string, ip net.IP, comment string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.static[domainName] = dnsOverrideEntry{ip: ip, comment: comment, static: true}
+}
+
+// Register adds or replaces an override. A zero ttl never expires.
+func (r *dnsRegistry) Register(domainName string, ip net.IP, ttl time.Duration, comment string) error {
+	return r.mutate(func(entries map[string]dnsOverrideEntry) error {
+		entries[domainName] = newDNSOverrideEntry(ip, ttl, comment)
+		return nil
+	})
+}
+
+// Delete removes a registered override; static overrides can't be deleted
+func (r *dnsRegistry) Delete(domainName string) error {
+	return r.mutate(func(entries map[string]dnsOverrideEntry) error {
+		if _, found := entries[domainName]; !found {
+			r.mu.RLock()
+			_, static := r.static[domainName]
+			r.mu.RUnlock()
+			if static {
+				return errDNSOverrideStatic
+			}
+			return errDNSOverrideNotFound
+		}
+		delete(entries, domainName)
+		return nil
+	})
+}
+
+// mutate applies fn to a copy of the registered overrides and swaps the copy in once it has
+// been persisted, so a failed write leaves the live overrides as they were
+func (r *dnsRegistry) mutate(fn func(entries map[string]dnsOverrideEntry) error) error {
+	r.writeMu.Lock()
+	defer r.writeMu.Unlock()
+	r.mu.RLock()
+	next := make(map[string]dnsOverrideEntry, len(r.entries)+1)
+	for k, v := range r.entries {
+		next[k] = v
+	}
+	r.mu.RUnlock()
+	if err := fn(next); err != nil {
+		return err
+	}
+	if err := r.write(next); err != nil {
+		return err
+	}
+	r.mu.Lock()
+	r.entries = next
+	r.mu.Unlock()
+	return nil
+}
+
+// Registrations returns a copy of all live overrides, static ones included
+func (r *dnsRegistry) Registrations() map[string]dnsOverrideEntry {
+	now := time.Now()
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	result := make(map[string]dnsOverrideEntry, len(r.entries)+len(r.static))
+	for k, v := range r.static {
+		result[k] = v
+	}
+	for k, v := range r.entries {
+		if v.expired(now) {
+			continue
+		}
+		result[k] = v
+	}
+	return result
+}
+
+// expireRegistrations periodically drops expired overrides until ctx is done
+func (r *dnsRegistry) expireRegistrations(ctx context.Context) {
+	for {
+		select {
+		case <-time.After(dnsExpiryFrequency):
+			removed, err := r.removeExpired()
+			if err != nil {
+				log.Printf("unable to persist dns overrides: %v", err)
+			} else if removed > 0 {
+				log.Printf("expired %d dns overrides", removed)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// removeExpired drops expired overrides and persists the rest when any were dropped
+func (r *dnsRegistry) removeExpired() (int, error) {
+	now := time.Now()
+	if !r.anyExpired(now) {
+		return 0, nil
+	}
+	removed := 0
+	err := r.mutate(func(entries map[string]dnsOverrideEntry) error {
+		for k, v := range entries {
+			if v.expired(now) {
+				delete(entries, k)
+				removed++
+			}
+		}
+		return nil
+	})
+	return removed, err
+}
+
+func (r *dnsRegistry) anyExpired(now time.Time) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, v := range r.entries {
+		if v.expired(now) {
+			return true
+		}
+	}
+	return false
+}
+
+// write persists the registered, unexpired overrides in entries
+func (r *dnsRegistry) write(entries map[string]dnsOverrideEntry) error {
+	if r.fname == "" {
+		return nil
+	}
+	now := time.Now()
+	live := make(map[string]dnsOverrideEntry, len(entries))
+	for k, v := range entries {
+		if !v.expired(now) {
+			live[k] = v
+		}
+	}
+	contents, err := yaml.Marshal(newDNSOverrides(live))
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(r.fname, contents, 0644, ""); err != nil {
+		return fmt.Errorf("unable to write dns overrides to %s: %w", r.fname, err)
+	}
+	return nil
+}
+
+func newDNSOverrideEntry(ip net.IP, ttl time.Duration, comment string) dnsOverrideEntry {
+	result := dnsOverrideEntry{ip: ip, comment: comment}
+	if ttl > 0 {
+		result.expires = time.Now().Add(ttl)
+	}
+	return result
+}
+
+type dnsOverride struct {
+	FQDN    string
+	IP      string
+	Expires time.Time `yaml:",omitempty"`
+	Comment string    `yaml:",omitempty"`
+}
+
+func newDNSOverrides(entries map[string]dnsOverrideEntry) []dnsOverride {
+	result := make([]dnsOverride, 0, len(entries))
+	for k, v := range entries {
+		result = append(result, dnsOverride{FQDN: k, IP: v.ip.String(), Expires: v.expires, Comment: v.comment})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].FQDN < result[j].FQDN
+	})
+	return result
+}
+
+func dnsOverridesFromFile(fname string) (map[string]dnsOverrideEntry, error) {
+	result := make(map[string]dnsOverrideEntry)
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			// will be created on first registration
+			return result, nil
+		}
+		return nil, err
+	}
+	var overrides []dnsOverride
+	if err := yaml.Unmarshal(contents, &overrides); err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	for _, ov := range overrides {
+		if ov.FQDN == "" {
+			continue
+		}
+		if !validDomainPattern(ov.FQDN) {
+			log.Printf("ignoring invalid dns override pattern: %s", ov.FQDN)
+			continue
+		}
+		entry := dnsOverrideEntry{ip: net.ParseIP(ov.IP), expires: ov.Expires, comment: ov.Comment}
+		if entry.expired(now) {
+			continue
+		}
+		result[ov.FQDN] = entry
+	}
+	return result, nil
+}
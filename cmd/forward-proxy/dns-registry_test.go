@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDNSRegistryPersists(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "dns.yml")
+	r, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("printer.lan", net.ParseIP("192.168.1.20"), 0, "office"); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("*.dev.internal", net.ParseIP("10.0.0.5"), time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("gone.lan", net.ParseIP("10.0.0.6"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Delete("gone.lan"); err != nil {
+		t.Fatal(err)
+	}
+
+	reloaded, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := reloaded.Registrations()
+	if len(got) != 2 {
+		t.Fatalf("reloaded %d overrides: %v", len(got), got)
+	}
+	if e := got["printer.lan"]; !e.ip.Equal(net.ParseIP("192.168.1.20")) || e.comment != "office" || !e.expires.IsZero() {
+		t.Errorf("printer.lan = %+v", e)
+	}
+	if e := got["*.dev.internal"]; e.expires.IsZero() {
+		t.Errorf("*.dev.internal lost its expiry: %+v", e)
+	}
+	if err := reloaded.Delete("gone.lan"); err != errDNSOverrideNotFound {
+		t.Errorf("Delete of a missing override = %v", err)
+	}
+}
+
+func TestDNSRegistryStaticOverridesAreNotPersisted(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "dns.yml")
+	r, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.RegisterStatic("api", net.ParseIP("127.0.0.1"), "")
+	r.RegisterStatic("nas.lan", net.ParseIP("192.168.1.30"), "from config.yml")
+	if err := r.Register("printer.lan", net.ParseIP("192.168.1.20"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ip, ok := r.Lookup("nas.lan"); !ok || !ip.Equal(net.ParseIP("192.168.1.30")) {
+		t.Errorf("Lookup(nas.lan) = %v, %v", ip, ok)
+	}
+	if e, ok := r.Get("api"); !ok || !e.static {
+		t.Errorf("Get(api) = %+v, %v", e, ok)
+	}
+	if len(r.Registrations()) != 3 {
+		t.Errorf("Registrations() = %v", r.Registrations())
+	}
+	if err := r.Delete("nas.lan"); err != errDNSOverrideStatic {
+		t.Errorf("Delete of a static override = %v", err)
+	}
+
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(contents), "nas.lan") || strings.Contains(string(contents), "api") {
+		t.Errorf("static overrides persisted:\n%s", contents)
+	}
+
+	// a registered override shadows a static one of the same name
+	if err := r.Register("nas.lan", net.ParseIP("192.168.1.31"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	if ip, _ := r.Lookup("nas.lan"); !ip.Equal(net.ParseIP("192.168.1.31")) {
+		t.Errorf("Lookup(nas.lan) = %v after Register", ip)
+	}
+}
+
+func TestDNSRegistryFailedWriteLeavesOverridesUnchanged(t *testing.T) {
+	dir := t.TempDir()
+	r, err := newDNSRegistry(filepath.Join(dir, "dns.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("printer.lan", net.ParseIP("192.168.1.20"), 0, ""); err != nil {
+		t.Fatal(err)
+	}
+	// the directory going away makes every later write fail
+	r.fname = filepath.Join(dir, "missing", "dns.yml")
+
+	if err := r.Register("nas.lan", net.ParseIP("192.168.1.30"), 0, ""); err == nil {
+		t.Fatal("Register succeeded without persisting")
+	}
+	if _, ok := r.Lookup("nas.lan"); ok {
+		t.Error("failed Register took effect")
+	}
+	if err := r.Delete("printer.lan"); err == nil {
+		t.Fatal("Delete succeeded without persisting")
+	}
+	if _, ok := r.Lookup("printer.lan"); !ok {
+		t.Error("failed Delete took effect")
+	}
+}
+
+func TestDNSRegistryExpiry(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "dns.yml")
+	r, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("short.lan", net.ParseIP("10.0.0.1"), 20*time.Millisecond, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Register("long.lan", net.ParseIP("10.0.0.2"), time.Hour, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := r.Lookup("short.lan"); !ok {
+		t.Fatal("short.lan not registered")
+	}
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := r.Lookup("short.lan"); ok {
+		t.Error("expired override still resolves")
+	}
+	if _, ok := r.Get("short.lan"); ok {
+		t.Error("expired override still returned by Get")
+	}
+	removed, err := r.removeExpired()
+	if err != nil || removed != 1 {
+		t.Fatalf("removeExpired() = %d, %v", removed, err)
+	}
+	if removed, _ := r.removeExpired(); removed != 0 {
+		t.Errorf("second removeExpired() = %d", removed)
+	}
+	reloaded, err := newDNSRegistry(fname)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := reloaded.Registrations(); len(got) != 1 {
+		t.Errorf("reloaded %v", got)
+	}
+}
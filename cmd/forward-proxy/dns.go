@@ -4,36 +4,41 @@ import (
 	"context"
 	"log"
 	"net"
-	"os"
-
-	"gopkg.in/yaml.v3"
+	"strings"
 )
 
+const wildcardPrefix = "*."
+
 type dnsResolver struct {
-	adminDomain     string
-	adminIP         net.IP
-	domainOverrides map[string]net.IP
+	adminDomain string
+	adminIP     net.IP
+	registry    *dnsRegistry
+	// optional; names routed via an upstream proxy are left for the upstream to resolve
+	upstreams *upstreamRouter
 }
 
-func newDNSResolver(adminDomain string, domainOverrides map[string]net.IP) dnsResolver {
-	if domainOverrides == nil {
-		domainOverrides = make(map[string]net.IP)
-	}
-	return dnsResolver{
-		adminDomain:     adminDomain,
-		adminIP:         net.ParseIP("127.0.0.1"),
-		domainOverrides: domainOverrides,
+func newDNSResolver(adminDomain string, registry *dnsRegistry) *dnsResolver {
+	return &dnsResolver{
+		adminDomain: adminDomain,
+		adminIP:     net.ParseIP("127.0.0.1"),
+		registry:    registry,
 	}
 }
 
 // Resolve implement interface NameResolver
-func (d dnsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+func (d *dnsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
 	if name == d.adminDomain {
-		return ctx, d.adminIP, nil
+		return d.direct(ctx, name), d.adminIP, nil
 	}
-	overrideIP, found := d.domainOverrides[name]
-	if found {
-		return ctx, overrideIP, nil
+	if overrideIP, found := d.registry.Lookup(name); found {
+		return d.direct(ctx, name), overrideIP, nil
+	}
+	if d.upstreams != nil {
+		ctx = withUpstreamTarget(ctx, name, false)
+		if d.upstreams.resolvesRemotely(name) {
+			// the unspecified address stands in until the upstream resolves the name
+			return ctx, net.IPv4zero, nil
+		}
 	}
 	addr, err := net.ResolveIPAddr("ip", name)
 	if err != nil {
@@ -43,34 +48,23 @@ func (d dnsResolver) Resolve(ctx context.Context, name string) (context.Context,
 	return ctx, addr.IP, err
 }
 
-func (d *dnsResolver) Register(domainName string, address string) {
-	d.domainOverrides[domainName] = net.ParseIP(address)
-}
-
-func (d dnsResolver) Registrations() map[string]net.IP {
-	return d.domainOverrides
+// direct pins name to a direct connection; the admin domain and overrides are always local
+func (d *dnsResolver) direct(ctx context.Context, name string) context.Context {
+	if d.upstreams == nil {
+		return ctx
+	}
+	return withUpstreamTarget(ctx, name, true)
 }
 
-type dnsOverride struct {
-	FQDN string
-	IP   string
+// isWildcardDomain returns true for names of the form *.example.com
+func isWildcardDomain(domainName string) bool {
+	return strings.HasPrefix(domainName, wildcardPrefix)
 }
 
-func dnsOverridesFromFile(fname string) (map[string]net.IP, error) {
-	contents, err := os.ReadFile(fname)
-	if err != nil {
-		return nil, err
-	}
-	var overrides []dnsOverride
-	if err := yaml.Unmarshal(contents, &overrides); err != nil {
-		return nil, err
-	}
-	result := make(map[string]net.IP)
-	for _, ov := range overrides {
-		if ov.FQDN == "" {
-			continue
-		}
-		result[ov.FQDN] = net.ParseIP(ov.IP)
+// validDomainPattern only allows a wildcard as the entire left-most label
+func validDomainPattern(domainName string) bool {
+	if isWildcardDomain(domainName) {
+		domainName = strings.TrimPrefix(domainName, wildcardPrefix)
 	}
-	return result, nil
+	return domainName != "" && !strings.Contains(domainName, "*")
 }
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestDNSWildcardLookup(t *testing.T) {
+	r, err := newDNSRegistry(filepath.Join(t.TempDir(), "dns.yml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, ip := range map[string]string{
+		"*.dev.internal":   "10.0.0.1",
+		"*.b.dev.internal": "10.0.0.2",
+		"b.dev.internal":   "10.0.0.3",
+	} {
+		if err := r.Register(name, net.ParseIP(ip), 0, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"a.dev.internal", "10.0.0.1"},
+		{"x.y.dev.internal", "10.0.0.1"},
+		{"a.b.dev.internal", "10.0.0.2"},
+		{"b.dev.internal", "10.0.0.3"},
+		{"dev.internal", ""},
+		{"dev.internal.example.com", ""},
+	}
+	for _, tt := range tests {
+		ip, ok := r.Lookup(tt.name)
+		if tt.want == "" {
+			if ok {
+				t.Errorf("Lookup(%s) = %v, want no override", tt.name, ip)
+			}
+			continue
+		}
+		if !ok || !ip.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("Lookup(%s) = %v, %v, want %s", tt.name, ip, ok, tt.want)
+		}
+	}
+
+	d := newDNSResolver("api", r)
+	if _, ip, err := d.Resolve(context.Background(), "a.b.dev.internal"); err != nil || !ip.Equal(net.ParseIP("10.0.0.2")) {
+		t.Errorf("Resolve(a.b.dev.internal) = %v, %v", ip, err)
+	}
+	if _, ip, err := d.Resolve(context.Background(), "api"); err != nil || !ip.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("Resolve(api) = %v, %v", ip, err)
+	}
+}
+
+func TestValidDomainPattern(t *testing.T) {
+	for pattern, want := range map[string]bool{
+		"printer.lan":      true,
+		"*.dev.internal":   true,
+		"*":                false,
+		"*.":               false,
+		"a.*.dev.internal": false,
+		"**.dev.internal":  false,
+	} {
+		if got := validDomainPattern(pattern); got != want {
+			t.Errorf("validDomainPattern(%q) = %v, want %v", pattern, got, want)
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"io"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+// fanOutHistLogger hands every event to each of its sinks
+type fanOutHistLogger struct {
+	sinks []forwardproxy.HistLogger
+}
+
+// newFanOutHistLogger ignores nil sinks
+func newFanOutHistLogger(sinks ...forwardproxy.HistLogger) *fanOutHistLogger {
+	result := &fanOutHistLogger{}
+	for _, s := range sinks {
+		if s != nil {
+			result.sinks = append(result.sinks, s)
+		}
+	}
+	return result
+}
+
+func (f *fanOutHistLogger) LogAccepted(fqdn string) {
+	for _, s := range f.sinks {
+		s.LogAccepted(fqdn)
+	}
+}
+
+func (f *fanOutHistLogger) LogBlocked(fqdn string) {
+	for _, s := range f.sinks {
+		s.LogBlocked(fqdn)
+	}
+}
+
+// LogEvent implements forwardproxy.HistEventLogger
+func (f *fanOutHistLogger) LogEvent(ev forwardproxy.HistEvent) {
+	for _, s := range f.sinks {
+		forwardproxy.LogHistEvent(s, ev)
+	}
+}
+
+// fileBackedSink is implemented by sinks that persist to local files. abandon stops the sink
+// without a final write, for when another process has taken those files over.
+type fileBackedSink interface {
+	abandon()
+}
+
+// Close closes every sink that can be closed and returns the first error
+func (f *fanOutHistLogger) Close() error {
+	return f.close(false)
+}
+
+// abandon closes the sinks like Close but abandons file-backed ones without flushing them
+func (f *fanOutHistLogger) abandon() error {
+	return f.close(true)
+}
+
+func (f *fanOutHistLogger) close(abandonFiles bool) error {
+	var result error
+	for _, s := range f.sinks {
+		if fb, ok := s.(fileBackedSink); ok && abandonFiles {
+			fb.abandon()
+			continue
+		}
+		if c, ok := s.(io.Closer); ok {
+			if err := c.Close(); err != nil && result == nil {
+				result = err
+			}
+		}
+	}
+	return result
+}
@@ -3,20 +3,32 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"log"
 	"os"
 	"sort"
+	"sync/atomic"
 	"time"
 
+	forwardproxy "github.com/arunsworld/forward-proxy"
 	"gopkg.in/yaml.v3"
 )
 
-const maxMessageBuffer = 100
+const (
+	maxMessageBuffer = 100
+	// events beyond this backlog are dropped (and counted) rather than stall the proxy
+	maxEventBuffer = 10000
+	// upper bound on events applied per iteration of the run loop
+	maxEventBatch = 1000
+)
 
 var writeFrequency = time.Second * 5
 
-func newFileBasedHistLogger(fname string) *fHistLogger {
+var errHistLoggerDisabled = errors.New("histogram logger not enabled")
+
+func newFileBasedHistLogger(fname string, retention histRetention) *fHistLogger {
 	if fname == "" {
 		return nil
 	}
@@ -24,7 +36,9 @@ func newFileBasedHistLogger(fname string) *fHistLogger {
 	ctx, cancel := context.WithCancel(context.Background())
 	result := &fHistLogger{
 		fname:                       fname,
+		retention:                   retention,
 		ch:                          make(chan message, maxMessageBuffer),
+		events:                      make(chan forwardproxy.HistEvent, maxEventBuffer),
 		blocked:                     blocked,
 		accepted:                    accepted,
 		stopGeneratingWriteWorkload: cancel,
@@ -35,37 +49,91 @@ func newFileBasedHistLogger(fname string) *fHistLogger {
 }
 
 type fHistLogger struct {
-	fname string
+	fname     string
+	retention histRetention
 	// internal
 	ch                          chan message
+	events                      chan forwardproxy.HistEvent
+	dropped                     atomic.Uint64
+	reportedDropped             uint64
 	closed                      bool
+	writing                     bool
+	pendingClose                chan responsePayloadWithError[struct{}]
 	modified                    int
-	blocked                     map[string]int
-	accepted                    map[string]int
+	lastPruned                  time.Time
+	blocked                     map[string]*fqdnStats
+	accepted                    map[string]*fqdnStats
 	stopGeneratingWriteWorkload context.CancelFunc
 }
 
 type histContent struct {
-	Blocked  []fqdnDetails
-	Accepted []fqdnDetails
+	Blocked  []fqdnDetails `json:"blocked"`
+	Accepted []fqdnDetails `json:"accepted"`
+	// Dropped counts events lost to backpressure; only populated in API responses
+	Dropped uint64 `json:"dropped,omitempty" yaml:"-"`
 }
 
+// fqdnDetails is the persisted form of fqdnStats. Files written before timestamps and
+// buckets were introduced only carry FQDN and Count and load with the rest zeroed.
 type fqdnDetails struct {
 	FQDN  string
 	Count int
+	// List is the block list responsible for most blocks; only populated in API responses
+	List      string         `yaml:"-"`
+	FirstSeen time.Time      `yaml:"firstseen,omitempty"`
+	LastSeen  time.Time      `yaml:"lastseen,omitempty"`
+	Lists     map[string]int `yaml:",omitempty"`
+	Clients   map[string]int `yaml:",omitempty"`
+	Hourly    []bucketCount  `yaml:",omitempty"`
+	Daily     []bucketCount  `yaml:",omitempty"`
 }
 
-func newHistContent(blocked map[string]int, accepted map[string]int) histContent {
+// MarshalJSON leaves out buckets and timestamps that are unknown for upgraded entries
+func (d fqdnDetails) MarshalJSON() ([]byte, error) {
+	result := struct {
+		FQDN      string         `json:"fqdn"`
+		Count     int            `json:"count"`
+		List      string         `json:"list,omitempty"`
+		FirstSeen *time.Time     `json:"firstSeen,omitempty"`
+		LastSeen  *time.Time     `json:"lastSeen,omitempty"`
+		Lists     map[string]int `json:"lists,omitempty"`
+		Clients   map[string]int `json:"clients,omitempty"`
+	}{
+		FQDN:    d.FQDN,
+		Count:   d.Count,
+		List:    d.List,
+		Lists:   d.Lists,
+		Clients: d.Clients,
+	}
+	if !d.FirstSeen.IsZero() {
+		result.FirstSeen = &d.FirstSeen
+	}
+	if !d.LastSeen.IsZero() {
+		result.LastSeen = &d.LastSeen
+	}
+	return json.Marshal(result)
+}
+
+func newHistContent(blocked map[string]*fqdnStats, accepted map[string]*fqdnStats) histContent {
 	return histContent{
 		Blocked:  newFQDNDetails(blocked),
 		Accepted: newFQDNDetails(accepted),
 	}
 }
 
-func newFQDNDetails(input map[string]int) []fqdnDetails {
+func newFQDNDetails(input map[string]*fqdnStats) []fqdnDetails {
 	result := make([]fqdnDetails, 0, len(input))
 	for k, v := range input {
-		result = append(result, fqdnDetails{FQDN: k, Count: v})
+		result = append(result, fqdnDetails{
+			FQDN:      k,
+			Count:     v.count,
+			FirstSeen: v.firstSeen,
+			LastSeen:  v.lastSeen,
+			Lists:     copyCounts(v.lists),
+			Clients:   copyCounts(v.clients),
+			Hourly:    newBucketCounts(v.hourly),
+			Daily:     newBucketCounts(v.daily),
+		})
 	}
 	sort.Slice(result, func(i, j int) bool {
 		return result[i].Count > result[j].Count
@@ -73,36 +141,98 @@ func newFQDNDetails(input map[string]int) []fqdnDetails {
 	return result
 }
 
-func parseHistogramFile(fname string) (map[string]int, map[string]int) {
-	blocked := make(map[string]int)
-	accepted := make(map[string]int)
-	contents, err := os.ReadFile(fname)
+func histBackupFile(fname string) string {
+	return fname + ".backup"
+}
+
+// parseHistogramFile loads fname, falling back to its backup when fname is missing or
+// unparsable. An unparsable fname is moved aside so the next write can't rotate it over
+// the good backup.
+func parseHistogramFile(fname string) (map[string]*fqdnStats, map[string]*fqdnStats) {
+	blocked := make(map[string]*fqdnStats)
+	accepted := make(map[string]*fqdnStats)
+	buffer, err := readHistogramFile(fname)
 	if err != nil {
 		log.Printf("Error reading histogram file %s: %v", fname, err)
-		return blocked, accepted
-	}
-	buffer := histContent{}
-	if err := yaml.Unmarshal(contents, &buffer); err != nil {
-		log.Printf("Error reading histogram file %s: %v", fname, err)
-		return blocked, accepted
+		if !errors.Is(err, os.ErrNotExist) {
+			corrupt := fmt.Sprintf("%s.corrupt.%d", fname, time.Now().Unix())
+			if err := os.Rename(fname, corrupt); err != nil {
+				log.Printf("Error moving aside histogram file %s: %v", fname, err)
+			} else {
+				log.Printf("Moved unreadable histogram file to %s", corrupt)
+			}
+		}
+		backup := histBackupFile(fname)
+		buffer, err = readHistogramFile(backup)
+		if err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				log.Printf("Error reading histogram backup file %s: %v", backup, err)
+			}
+			return blocked, accepted
+		}
+		log.Printf("Recovered histogram from backup file %s", backup)
 	}
 	for _, v := range buffer.Blocked {
-		blocked[v.FQDN] = v.Count
+		blocked[v.FQDN] = newFQDNStatsFromDetails(v)
 	}
 	for _, v := range buffer.Accepted {
-		accepted[v.FQDN] = v.Count
+		accepted[v.FQDN] = newFQDNStatsFromDetails(v)
 	}
 	return blocked, accepted
 }
 
+func readHistogramFile(fname string) (histContent, error) {
+	buffer := histContent{}
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return buffer, err
+	}
+	if err := yaml.Unmarshal(contents, &buffer); err != nil {
+		return buffer, err
+	}
+	return buffer, nil
+}
+
+func newFQDNStatsFromDetails(v fqdnDetails) *fqdnStats {
+	return &fqdnStats{
+		count:     v.Count,
+		firstSeen: v.FirstSeen,
+		lastSeen:  v.LastSeen,
+		hourly:    bucketsFromCounts(v.Hourly, hourlyBucket),
+		daily:     bucketsFromCounts(v.Daily, dailyBucket),
+		lists:     copyCounts(v.Lists),
+		clients:   copyCounts(v.Clients),
+	}
+}
+
+// copyCounts never returns nil so the result is safe to write to
+func copyCounts(input map[string]int) map[string]int {
+	result := make(map[string]int, len(input))
+	for k, v := range input {
+		result[k] = v
+	}
+	return result
+}
+
+func recordEvent(m map[string]*fqdnStats, ev forwardproxy.HistEvent) {
+	stats, ok := m[ev.FQDN]
+	if !ok {
+		stats = newFQDNStats()
+		m[ev.FQDN] = stats
+	}
+	stats.record(ev)
+}
+
 func (fhl *fHistLogger) run() {
 	for {
-		msg := <-fhl.ch
+		var msg message
+		select {
+		case ev := <-fhl.events:
+			fhl.processEvents(ev)
+			continue
+		case msg = <-fhl.ch:
+		}
 		switch msg.messageType() {
-		case logAcceptedAsynchMessageType:
-			fhl.processLogAcceptedMessage(msg.request().(requestMessage[string, struct{}]))
-		case logBlockedAsyncMessageType:
-			fhl.processLogBlockedMessage(msg.request().(requestMessage[string, struct{}]))
 		case writeMessageType:
 			incoming := msg.request().(requestMessage[struct{}, struct{}])
 			if !fhl.closed {
@@ -112,12 +242,31 @@ func (fhl *fHistLogger) run() {
 					err: errors.New("logger already closed"),
 				}
 			}
+		case writeDoneMessageType:
+			fhl.processWriteDoneMessage(msg.request().(requestMessage[writeResult, struct{}]))
+		case queryMessageType:
+			fhl.processQueryMessage(msg.request().(requestMessage[histQuery, histContent]))
+		case resetMessageType:
+			fhl.processResetMessage(msg.request().(requestMessage[histReset, int]))
+		case abandonMessageType:
+			incoming := msg.request().(requestMessage[struct{}, struct{}])
+			if !fhl.closed {
+				fhl.stopGeneratingWriteWorkload()
+				fhl.closed = true
+			}
+			close(incoming.resp)
 		case closeAsynchMessageType:
 			incoming := msg.request().(requestMessage[struct{}, struct{}])
 			if !fhl.closed {
 				fhl.stopGeneratingWriteWorkload()
+				fhl.drainEvents()
 				fhl.closed = true
-				fhl.processWriteMessage(msg.request().(requestMessage[struct{}, struct{}]))
+				if fhl.writing {
+					// the final write starts once the one in flight is done
+					fhl.pendingClose = incoming.resp
+				} else {
+					fhl.processWriteMessage(incoming)
+				}
 			} else {
 				close(incoming.resp)
 			}
@@ -133,7 +282,7 @@ func (fhl *fHistLogger) generateWriteWorkload(ctx context.Context) {
 	for {
 		select {
 		case <-time.After(writeFrequency):
-			resp := make(chan responsePayloadWithError[struct{}])
+			resp := newWriteResponse()
 			fhl.ch <- asynchMessage[struct{}, struct{}]{
 				mType: writeMessageType,
 				req: requestMessage[struct{}, struct{}]{
@@ -154,11 +303,18 @@ func (fhl *fHistLogger) generateWriteWorkload(ctx context.Context) {
 	}
 }
 
+// newWriteResponse returns the channel a write reports back on. It is buffered because the run
+// loop answers once the write completes, by which time the ticker may have stopped listening;
+// an unbuffered send would then block the loop and with it Close.
+func newWriteResponse() chan responsePayloadWithError[struct{}] {
+	return make(chan responsePayloadWithError[struct{}], 1)
+}
+
 func (fhl *fHistLogger) Close() error {
 	if fhl == nil {
 		return nil
 	}
-	resp := make(chan responsePayloadWithError[struct{}])
+	resp := newWriteResponse()
 	fhl.ch <- asynchMessage[struct{}, struct{}]{
 		mType: closeAsynchMessageType,
 		req: requestMessage[struct{}, struct{}]{
@@ -173,96 +329,259 @@ func (fhl *fHistLogger) Close() error {
 	return nil
 }
 
-func (fhl *fHistLogger) LogAccepted(fqdn string) {
+// abandon stops the logger without writing the histogram file, which another process has
+// taken over. A write already in flight still completes.
+func (fhl *fHistLogger) abandon() {
 	if fhl == nil {
 		return
 	}
-	resp := make(chan responsePayloadWithError[struct{}])
-	fhl.ch <- asynchMessage[string, struct{}]{
-		mType: logAcceptedAsynchMessageType,
-		req: requestMessage[string, struct{}]{
-			req:  fqdn,
+	resp := newWriteResponse()
+	fhl.ch <- asynchMessage[struct{}, struct{}]{
+		mType: abandonMessageType,
+		req: requestMessage[struct{}, struct{}]{
 			resp: resp,
 		},
 	}
 	<-resp
 }
 
+func (fhl *fHistLogger) LogAccepted(fqdn string) {
+	fhl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn})
+}
+
 func (fhl *fHistLogger) LogBlocked(fqdn string) {
+	fhl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn, Blocked: true})
+}
+
+// LogEvent implements forwardproxy.HistEventLogger. It never blocks: when the run loop
+// falls behind by more than maxEventBuffer events further events are dropped and counted.
+func (fhl *fHistLogger) LogEvent(ev forwardproxy.HistEvent) {
 	if fhl == nil {
 		return
 	}
-	resp := make(chan responsePayloadWithError[struct{}])
-	fhl.ch <- asynchMessage[string, struct{}]{
-		mType: logBlockedAsyncMessageType,
-		req: requestMessage[string, struct{}]{
-			req:  fqdn,
+	select {
+	case fhl.events <- ev:
+	default:
+		fhl.dropped.Add(1)
+	}
+}
+
+// Dropped returns the number of events lost to backpressure since startup
+func (fhl *fHistLogger) Dropped() uint64 {
+	if fhl == nil {
+		return 0
+	}
+	return fhl.dropped.Load()
+}
+
+// Query returns the in-memory histogram entries selected by q, most frequent first
+func (fhl *fHistLogger) Query(q histQuery) (histContent, error) {
+	if fhl == nil {
+		return histContent{}, errHistLoggerDisabled
+	}
+	resp := make(chan responsePayloadWithError[histContent])
+	fhl.ch <- asynchMessage[histQuery, histContent]{
+		mType: queryMessageType,
+		req: requestMessage[histQuery, histContent]{
+			req:  q,
 			resp: resp,
 		},
 	}
-	<-resp
+	v := <-resp
+	return v.payload, v.err
+}
+
+// Reset clears counters and returns the number of entries removed
+func (fhl *fHistLogger) Reset(r histReset) (int, error) {
+	if fhl == nil {
+		return 0, errHistLoggerDisabled
+	}
+	resp := make(chan responsePayloadWithError[int])
+	fhl.ch <- asynchMessage[histReset, int]{
+		mType: resetMessageType,
+		req: requestMessage[histReset, int]{
+			req:  r,
+			resp: resp,
+		},
+	}
+	v := <-resp
+	return v.payload, v.err
 }
 
-func (fhl *fHistLogger) processLogAcceptedMessage(msg requestMessage[string, struct{}]) {
-	defer close(msg.resp)
+func (fhl *fHistLogger) processQueryMessage(msg requestMessage[histQuery, histContent]) {
 	if fhl.closed {
+		msg.resp <- responsePayloadWithError[histContent]{
+			err: errors.New("logger already closed"),
+		}
 		return
 	}
-	fhl.accepted[msg.req] = fhl.accepted[msg.req] + 1
-	fhl.modified++
+	now := time.Now()
+	result := histContent{}
+	if msg.req.blocked {
+		result.Blocked = msg.req.apply(fhl.blocked, fhl.retention, now)
+	}
+	if msg.req.accepted {
+		result.Accepted = msg.req.apply(fhl.accepted, fhl.retention, now)
+	}
+	result.Dropped = fhl.dropped.Load()
+	msg.resp <- responsePayloadWithError[histContent]{
+		payload: result,
+	}
 }
 
-func (fhl *fHistLogger) processLogBlockedMessage(msg requestMessage[string, struct{}]) {
-	defer close(msg.resp)
+func (fhl *fHistLogger) processResetMessage(msg requestMessage[histReset, int]) {
 	if fhl.closed {
+		msg.resp <- responsePayloadWithError[int]{
+			err: errors.New("logger already closed"),
+		}
 		return
 	}
-	fhl.blocked[msg.req] = fhl.blocked[msg.req] + 1
+	removed := 0
+	if msg.req.blocked {
+		removed += msg.req.apply(fhl.blocked)
+	}
+	if msg.req.accepted {
+		removed += msg.req.apply(fhl.accepted)
+	}
+	if removed > 0 {
+		fhl.modified++
+	}
+	msg.resp <- responsePayloadWithError[int]{
+		payload: removed,
+	}
+}
+
+// processEvents applies ev plus whatever else is already queued, up to maxEventBatch
+func (fhl *fHistLogger) processEvents(ev forwardproxy.HistEvent) {
+	fhl.processEvent(ev)
+	for i := 1; i < maxEventBatch; i++ {
+		select {
+		case ev := <-fhl.events:
+			fhl.processEvent(ev)
+		default:
+			return
+		}
+	}
+}
+
+// drainEvents applies everything queued so nothing is lost on close
+func (fhl *fHistLogger) drainEvents() {
+	for {
+		select {
+		case ev := <-fhl.events:
+			fhl.processEvent(ev)
+		default:
+			return
+		}
+	}
+}
+
+func (fhl *fHistLogger) processEvent(ev forwardproxy.HistEvent) {
+	if fhl.closed {
+		return
+	}
+	if ev.Blocked {
+		recordEvent(fhl.blocked, ev)
+	} else {
+		recordEvent(fhl.accepted, ev)
+	}
 	fhl.modified++
 }
 
 func (fhl *fHistLogger) processWriteMessage(msg requestMessage[struct{}, struct{}]) {
-	if fhl.modified == 0 {
+	if dropped := fhl.dropped.Load(); dropped != fhl.reportedDropped {
+		log.Printf("Histogram logger dropped %d events under backpressure (%d total)", dropped-fhl.reportedDropped, dropped)
+		fhl.reportedDropped = dropped
+	}
+	fhl.pruneIfDue(time.Now())
+	if fhl.modified == 0 || fhl.writing {
 		// log.Printf("Histogram logger save skipping... no changes...")
 		close(msg.resp)
 		return
 	}
+	fhl.startWrite(msg.resp)
+}
+
+// startWrite persists a snapshot in the background. modified is only reduced once the write
+// succeeds so a failed write is retried on the next tick.
+func (fhl *fHistLogger) startWrite(resp chan responsePayloadWithError[struct{}]) {
 	content := newHistContent(fhl.blocked, fhl.accepted)
 	toBeModified := fhl.modified
-	// NOTE: WARNING: if write fails it will not be attempted again because modified flag is reset!
-	// We're willing to lose data for efficiency
-	fhl.modified = 0
-	go fhl.write(content, msg.resp, toBeModified)
+	fhl.writing = true
+	go func() {
+		err := fhl.write(content)
+		fhl.ch <- asynchMessage[writeResult, struct{}]{
+			mType: writeDoneMessageType,
+			req: requestMessage[writeResult, struct{}]{
+				req:  writeResult{numModified: toBeModified, err: err},
+				resp: resp,
+			},
+		}
+	}()
 }
 
-func (fhl *fHistLogger) write(content histContent, resp chan responsePayloadWithError[struct{}], numModified int) {
-	contentBytes := bytes.Buffer{}
-	enc := yaml.NewEncoder(&contentBytes)
-	enc.SetIndent(2)
-	if err := enc.Encode(content); err != nil {
-		resp <- responsePayloadWithError[struct{}]{
-			err: err,
+func (fhl *fHistLogger) processWriteDoneMessage(msg requestMessage[writeResult, struct{}]) {
+	fhl.writing = false
+	if msg.req.err != nil {
+		// modified is left as is so the next tick retries
+		msg.resp <- responsePayloadWithError[struct{}]{
+			err: msg.req.err,
 		}
-		return
+	} else {
+		fhl.modified -= msg.req.numModified
+		log.Printf("Histogram logger saved %d entries...", msg.req.numModified)
+		close(msg.resp)
 	}
-	if err := os.WriteFile(fhl.fname, contentBytes.Bytes(), 0644); err != nil {
-		resp <- responsePayloadWithError[struct{}]{
-			err: err,
+	if fhl.pendingClose != nil {
+		resp := fhl.pendingClose
+		fhl.pendingClose = nil
+		if fhl.modified == 0 {
+			close(resp)
+			return
 		}
+		fhl.startWrite(resp)
+	}
+}
+
+func (fhl *fHistLogger) pruneIfDue(now time.Time) {
+	if now.Sub(fhl.lastPruned) < histPruneFrequency {
 		return
 	}
-	close(resp)
-	log.Printf("Histogram logger saved %d entries...", numModified)
+	fhl.lastPruned = now
+	for _, m := range []map[string]*fqdnStats{fhl.blocked, fhl.accepted} {
+		for _, v := range m {
+			if v.prune(now, fhl.retention) {
+				fhl.modified++
+			}
+		}
+	}
+}
+
+func (fhl *fHistLogger) write(content histContent) error {
+	contentBytes := bytes.Buffer{}
+	enc := yaml.NewEncoder(&contentBytes)
+	enc.SetIndent(2)
+	if err := enc.Encode(content); err != nil {
+		return err
+	}
+	return writeFileAtomic(fhl.fname, contentBytes.Bytes(), 0644, histBackupFile(fhl.fname))
+}
+
+type writeResult struct {
+	numModified int
+	err         error
 }
 
 type asynchMessageType uint8
 
 const (
 	undefinedAsyncMessageType asynchMessageType = iota
-	logAcceptedAsynchMessageType
-	logBlockedAsyncMessageType
 	writeMessageType
 	closeAsynchMessageType
+	queryMessageType
+	resetMessageType
+	writeDoneMessageType
+	abandonMessageType
 )
 
 type message interface {
@@ -271,11 +590,11 @@ type message interface {
 }
 
 type requestPayload interface {
-	struct{} | string
+	struct{} | string | histQuery | histReset | writeResult
 }
 
 type responsePayload interface {
-	struct{} | string
+	struct{} | string | int | histContent
 }
 
 type responsePayloadWithError[T responsePayload] struct {
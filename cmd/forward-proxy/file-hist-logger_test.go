@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+func setWriteFrequency(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := writeFrequency
+	writeFrequency = d
+	t.Cleanup(func() { writeFrequency = old })
+}
+
+func closeWithin(t *testing.T, fhl *fHistLogger, d time.Duration) error {
+	t.Helper()
+	done := make(chan error, 1)
+	go func() { done <- fhl.Close() }()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(d):
+		t.Fatal("Close did not return")
+		return nil
+	}
+}
+
+// waitForHistEntries waits for the run loop to apply n blocked entries
+func waitForHistEntries(t *testing.T, fhl *fHistLogger, n int) {
+	t.Helper()
+	for i := 0; i < 100; i++ {
+		v, err := fhl.Query(histQuery{blocked: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(v.Blocked) == n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("histogram never reached %d blocked entries", n)
+}
+
+func TestFileHistLoggerSavesOnClose(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "hist.yml")
+	fhl := newFileBasedHistLogger(fname, histRetention{})
+	fhl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: "a.com", Blocked: true, List: "ads", Client: "10.0.0.1"})
+	fhl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: "a.com", Blocked: true, List: "ads", Client: "10.0.0.2"})
+	fhl.LogAccepted("b.com")
+	if err := closeWithin(t, fhl, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, accepted := parseHistogramFile(fname)
+	if got := blocked["a.com"]; got == nil || got.count != 2 || got.lists["ads"] != 2 || len(got.clients) != 2 {
+		t.Fatalf("blocked a.com = %+v", got)
+	}
+	if got := accepted["b.com"]; got == nil || got.count != 1 {
+		t.Fatalf("accepted b.com = %+v", got)
+	}
+}
+
+func TestFileHistLoggerRecoversFromBackup(t *testing.T) {
+	fname := filepath.Join(t.TempDir(), "hist.yml")
+	for _, fqdn := range []string{"first.com", "second.com"} {
+		fhl := newFileBasedHistLogger(fname, histRetention{})
+		fhl.LogBlocked(fqdn)
+		if err := closeWithin(t, fhl, 5*time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writeFileAtomic(fname, []byte("blocked: [unterminated"), 0644, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, _ := parseHistogramFile(fname)
+	if blocked["first.com"] == nil {
+		t.Fatalf("backup not used: %v", blocked)
+	}
+	if matches, _ := filepath.Glob(fname + ".corrupt.*"); len(matches) != 1 {
+		t.Fatalf("corrupt file not moved aside: %v", matches)
+	}
+}
+
+// A write that fails while Close waits must still be reported to Close, even though the
+// ticker that started it has stopped listening.
+func TestFileHistLoggerCloseReportsWriteError(t *testing.T) {
+	setWriteFrequency(t, time.Hour)
+	fhl := newFileBasedHistLogger(filepath.Join(t.TempDir(), "missing", "hist.yml"), histRetention{})
+	fhl.LogBlocked("a.com")
+	waitForHistEntries(t, fhl, 1)
+	// a tick whose response nobody reads, as when Close cancels the ticker mid-write
+	fhl.ch <- asynchMessage[struct{}, struct{}]{
+		mType: writeMessageType,
+		req:   requestMessage[struct{}, struct{}]{resp: newWriteResponse()},
+	}
+	if err := closeWithin(t, fhl, 5*time.Second); err == nil {
+		t.Fatal("expected write error from Close")
+	}
+}
+
+// After a handover the file belongs to the new process and must not be written again
+func TestFileHistLoggerAbandonLeavesFileAlone(t *testing.T) {
+	setWriteFrequency(t, time.Hour)
+	fname := filepath.Join(t.TempDir(), "hist.yml")
+	fhl := newFileBasedHistLogger(fname, histRetention{})
+	fhl.LogBlocked("a.com")
+	if err := closeWithin(t, fhl, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	fhl = newFileBasedHistLogger(fname, histRetention{})
+	fhl.LogBlocked("b.com")
+	waitForHistEntries(t, fhl, 2)
+	newFanOutHistLogger(fhl).abandon()
+	if err := fhl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	blocked, _ := parseHistogramFile(fname)
+	if len(blocked) != 1 || blocked["a.com"] == nil {
+		t.Fatalf("file written after abandon: %v", blocked)
+	}
+}
+
+// BenchmarkAllow shows what the file histogram adds to Allow on the request path
+func BenchmarkAllow(b *testing.B) {
+	reqs := make([]*socks5.Request, 64)
+	for i := range reqs {
+		fqdn := fmt.Sprintf("www%d.example.org", i)
+		if i%2 == 0 {
+			fqdn = fmt.Sprintf("tracker.ads%d.example.com", i)
+		}
+		dest := &statute.AddrSpec{FQDN: fqdn, Port: 443}
+		reqs[i] = &socks5.Request{
+			Request:    statute.Request{Command: statute.CommandConnect},
+			RemoteAddr: &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000},
+			DestAddr:   dest,
+		}
+	}
+	list := make([]string, 64)
+	for i := range list {
+		list[i] = fmt.Sprintf("ads%d.example.com", i)
+	}
+	run := func(b *testing.B, opts ...forwardproxy.StaticFQDNBlockerOpt) {
+		cc := forwardproxy.NewStaticFQDNBlocker(append(opts, forwardproxy.WithStaticFQDNBlockList("ads", list))...)
+		b.ReportAllocs()
+		b.ResetTimer()
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				cc.Allow(context.Background(), reqs[i%len(reqs)])
+			}
+		})
+	}
+	b.Run("no logger", func(b *testing.B) { run(b) })
+	b.Run("file logger", func(b *testing.B) {
+		fhl := newFileBasedHistLogger(filepath.Join(b.TempDir(), "hist.yml"), defaultHistRetention)
+		defer fhl.Close()
+		run(b, forwardproxy.WithHistLogger(fhl))
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+const (
+	histogramV1Path      = "/v1/histogram"
+	defaultHistogramTopN = 20
+)
+
+// histogramV1Handler queries (GET) or resets (DELETE) the in-memory histogram.
+//
+// GET parameters: type (blocked, accepted or all), top (0 for all), contains, domain,
+// list, client, since (duration, e.g. 24h) or from/to (RFC 3339).
+// DELETE parameters: type and fqdn (all entries when absent).
+func histogramV1Handler(hist histStore, blocker *forwardproxy.StaticFQDNBlocker) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if hist == nil {
+			writeHistError(w, errHistLoggerDisabled)
+			return
+		}
+		params := r.URL.Query()
+		blocked, accepted, err := parseHistType(params.Get("type"))
+		if err != nil {
+			writeJSONError(w, http.StatusBadRequest, "%v", err)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			q, err := parseHistQuery(params, time.Now())
+			if err != nil {
+				writeJSONError(w, http.StatusBadRequest, "%v", err)
+				return
+			}
+			q.blocked, q.accepted = blocked, accepted
+			content, err := hist.Query(q)
+			if err != nil {
+				writeHistError(w, err)
+				return
+			}
+			for c, v := range content.Blocked {
+				// entries recorded before block lists were tracked fall back to current policy
+				if v.List == "" {
+					content.Blocked[c].List, _ = blocker.BlockedBy(v.FQDN)
+				}
+			}
+			writeJSON(w, http.StatusOK, content)
+		case http.MethodDelete:
+			removed, err := hist.Reset(histReset{
+				blocked:  blocked,
+				accepted: accepted,
+				fqdn:     params.Get("fqdn"),
+			})
+			if err != nil {
+				writeHistError(w, err)
+				return
+			}
+			log.Printf("histogram reset: removed %d entries", removed)
+			writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+		}
+	}
+}
+
+func writeHistError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errHistLoggerDisabled) {
+		writeJSONError(w, http.StatusNotFound, "%v", err)
+		return
+	}
+	writeJSONError(w, http.StatusServiceUnavailable, "%v", err)
+}
+
+func parseHistType(v string) (blocked bool, accepted bool, err error) {
+	switch v {
+	case "", "all":
+		return true, true, nil
+	case "blocked":
+		return true, false, nil
+	case "accepted":
+		return false, true, nil
+	default:
+		return false, false, fmt.Errorf("invalid type %q: expected blocked, accepted or all", v)
+	}
+}
+
+func parseHistQuery(params url.Values, now time.Time) (histQuery, error) {
+	result := histQuery{
+		top:      defaultHistogramTopN,
+		contains: params.Get("contains"),
+		domain:   params.Get("domain"),
+		list:     params.Get("list"),
+		client:   params.Get("client"),
+	}
+	if v := params.Get("top"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return result, fmt.Errorf("invalid top: %s", v)
+		}
+		result.top = n
+	}
+	if v := params.Get("since"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			return result, fmt.Errorf("invalid since: %s", v)
+		}
+		result.from = now.Add(-d)
+	}
+	for _, p := range []struct {
+		name string
+		dest *time.Time
+	}{{"from", &result.from}, {"to", &result.to}} {
+		v := params.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return result, fmt.Errorf("invalid %s: %v", p.name, err)
+		}
+		*p.dest = t
+	}
+	if !result.from.IsZero() && !result.to.IsZero() && !result.from.Before(result.to) {
+		return result, errors.New("from must be before to")
+	}
+	return result, nil
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+func TestHistogramAPI(t *testing.T) {
+	fhl := newFileBasedHistLogger(filepath.Join(t.TempDir(), "hist.yml"), defaultHistRetention)
+	defer fhl.Close()
+	now := time.Now()
+	// events are applied in order, so once the last blocked entry shows all of them have been
+	for _, ev := range []forwardproxy.HistEvent{
+		{FQDN: "example.org", Client: "192.168.1.10:50000"},
+		{FQDN: "ads.com", Blocked: true, List: "ads", Client: "192.168.1.10:50000"},
+		{FQDN: "ads.com", Blocked: true, List: "ads", Client: "192.168.1.10:50001"},
+		{FQDN: "ads.com", Blocked: true, List: "ads", Client: "192.168.1.11:50000"},
+		{FQDN: "tracker.example.com", Blocked: true, List: "trackers", Client: "192.168.1.11:50000"},
+		{FQDN: "old.example.com", Blocked: true, List: "ads", Time: now.Add(-72 * time.Hour)},
+	} {
+		if ev.Time.IsZero() {
+			ev.Time = now
+		}
+		fhl.LogEvent(ev)
+	}
+	waitForHistEntries(t, fhl, 3)
+	handler := histogramV1Handler(fhl, forwardproxy.NewStaticFQDNBlocker())
+	call := func(method, query string) (*httptest.ResponseRecorder, histContent) {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest(method, histogramV1Path+query, nil))
+		var content histContent
+		json.Unmarshal(w.Body.Bytes(), &content)
+		return w, content
+	}
+	names := func(v []fqdnDetails) []string {
+		result := []string{}
+		for _, d := range v {
+			result = append(result, d.FQDN)
+		}
+		return result
+	}
+
+	tests := []struct {
+		query    string
+		blocked  []string
+		accepted []string
+	}{
+		{"", []string{"ads.com", "old.example.com", "tracker.example.com"}, []string{"example.org"}},
+		{"?type=blocked&top=1", []string{"ads.com"}, nil},
+		{"?type=blocked&list=trackers", []string{"tracker.example.com"}, nil},
+		{"?type=blocked&client=192.168.1.10", []string{"ads.com"}, nil},
+		{"?domain=example.com", []string{"old.example.com", "tracker.example.com"}, []string{}},
+		{"?contains=track", []string{"tracker.example.com"}, []string{}},
+		{"?type=blocked&since=24h", []string{"ads.com", "tracker.example.com"}, nil},
+	}
+	for _, tt := range tests {
+		w, content := call("GET", tt.query)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %s = %d: %s", tt.query, w.Code, w.Body)
+		}
+		if got := names(content.Blocked); !equalStrings(got, tt.blocked) {
+			t.Errorf("GET %s blocked = %v, want %v", tt.query, got, tt.blocked)
+		}
+		if tt.accepted != nil {
+			if got := names(content.Accepted); !equalStrings(got, tt.accepted) {
+				t.Errorf("GET %s accepted = %v, want %v", tt.query, got, tt.accepted)
+			}
+		}
+	}
+	if _, content := call("GET", "?type=blocked&top=1"); content.Blocked[0].Count != 3 || content.Blocked[0].List != "ads" {
+		t.Errorf("ads.com = %+v", content.Blocked[0])
+	}
+
+	for _, query := range []string{"?type=some", "?top=-1", "?since=yesterday", "?from=2026-01-02T00:00:00Z&to=2026-01-01T00:00:00Z"} {
+		if w, _ := call("GET", query); w.Code != http.StatusBadRequest {
+			t.Errorf("GET %s = %d, want 400", query, w.Code)
+		}
+	}
+
+	removed := func(query string) int {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("DELETE", histogramV1Path+query, nil))
+		var result map[string]int
+		json.Unmarshal(w.Body.Bytes(), &result)
+		return result["removed"]
+	}
+	if n := removed("?type=blocked&fqdn=ads.com"); n != 1 {
+		t.Errorf("reset of ads.com removed %d", n)
+	}
+	if n := removed("?type=accepted"); n != 1 {
+		t.Errorf("reset of accepted removed %d", n)
+	}
+	if _, content := call("GET", ""); len(content.Blocked) != 2 || len(content.Accepted) != 0 {
+		t.Errorf("after reset: %+v", content)
+	}
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
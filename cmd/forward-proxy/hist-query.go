@@ -0,0 +1,96 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// histQuery selects and ranks histogram entries. Zero values mean no filtering.
+type histQuery struct {
+	blocked, accepted bool
+	top               int
+	contains          string
+	domain            string
+	list              string
+	client            string
+	from, to          time.Time
+}
+
+func (q histQuery) timeFiltered() bool {
+	return !q.from.IsZero() || !q.to.IsZero()
+}
+
+func (q histQuery) matches(fqdn string, stats *fqdnStats) bool {
+	if q.list != "" && stats.lists[q.list] == 0 {
+		return false
+	}
+	if q.client != "" && stats.clients[q.client] == 0 {
+		return false
+	}
+	if q.contains != "" && !strings.Contains(fqdn, q.contains) {
+		return false
+	}
+	if q.domain != "" && fqdn != q.domain && !strings.HasSuffix(fqdn, "."+q.domain) {
+		return false
+	}
+	return true
+}
+
+// apply returns matching entries, most frequent first. With a time range Count is the
+// number of hits within that range.
+func (q histQuery) apply(m map[string]*fqdnStats, retention histRetention, now time.Time) []fqdnDetails {
+	result := []fqdnDetails{}
+	for k, v := range m {
+		if !q.matches(k, v) {
+			continue
+		}
+		count := v.count
+		if q.timeFiltered() {
+			count = v.countBetween(q.from, q.to, retention, now)
+			if count == 0 {
+				continue
+			}
+		}
+		result = append(result, fqdnDetails{
+			FQDN:      k,
+			Count:     count,
+			List:      v.topList(),
+			FirstSeen: v.firstSeen,
+			LastSeen:  v.lastSeen,
+			Lists:     copyCounts(v.lists),
+			Clients:   copyCounts(v.clients),
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Count != result[j].Count {
+			return result[i].Count > result[j].Count
+		}
+		return result[i].FQDN < result[j].FQDN
+	})
+	if q.top > 0 && len(result) > q.top {
+		result = result[:q.top]
+	}
+	return result
+}
+
+// histReset clears counters; an empty fqdn resets every entry of the selected kinds
+type histReset struct {
+	blocked, accepted bool
+	fqdn              string
+}
+
+func (r histReset) apply(m map[string]*fqdnStats) int {
+	if r.fqdn == "" {
+		removed := len(m)
+		for k := range m {
+			delete(m, k)
+		}
+		return removed
+	}
+	if _, ok := m[r.fqdn]; !ok {
+		return 0
+	}
+	delete(m, r.fqdn)
+	return 1
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"net"
+	"sort"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+const (
+	hourlyBucket = time.Hour
+	dailyBucket  = 24 * time.Hour
+)
+
+var histPruneFrequency = 10 * time.Minute
+
+// histRetention is how long hourly and daily buckets are kept
+type histRetention struct {
+	hourly time.Duration
+	daily  time.Duration
+}
+
+var defaultHistRetention = histRetention{
+	hourly: 48 * time.Hour,
+	daily:  30 * 24 * time.Hour,
+}
+
+// fqdnStats is the in-memory state for a single FQDN. Lifetime count is kept alongside
+// rolling buckets keyed by the unix time of the bucket start.
+type fqdnStats struct {
+	count     int
+	firstSeen time.Time
+	lastSeen  time.Time
+	hourly    map[int64]int
+	daily     map[int64]int
+	// hits per block list and per client host
+	lists   map[string]int
+	clients map[string]int
+}
+
+func newFQDNStats() *fqdnStats {
+	return &fqdnStats{
+		hourly:  make(map[int64]int),
+		daily:   make(map[int64]int),
+		lists:   make(map[string]int),
+		clients: make(map[string]int),
+	}
+}
+
+func (s *fqdnStats) record(ev forwardproxy.HistEvent) {
+	now := ev.Time
+	if now.IsZero() {
+		now = time.Now()
+	}
+	s.count++
+	if s.firstSeen.IsZero() {
+		s.firstSeen = now
+	}
+	s.lastSeen = now
+	s.hourly[bucketStart(now, hourlyBucket)]++
+	s.daily[bucketStart(now, dailyBucket)]++
+	if ev.List != "" {
+		s.lists[ev.List]++
+	}
+	if client := clientHost(ev.Client); client != "" {
+		s.clients[client]++
+	}
+}
+
+// topList returns the block list responsible for most hits
+func (s *fqdnStats) topList() string {
+	return topCount(s.lists)
+}
+
+func topCount(counts map[string]int) string {
+	result, max := "", 0
+	for k, v := range counts {
+		if v > max || (v == max && k < result) {
+			result, max = k, v
+		}
+	}
+	return result
+}
+
+// clientHost drops the ephemeral port so hits aggregate per client machine
+func clientHost(client string) string {
+	if host, _, err := net.SplitHostPort(client); err == nil {
+		return host
+	}
+	return client
+}
+
+// prune drops buckets that have fallen out of retention and reports if anything changed
+func (s *fqdnStats) prune(now time.Time, retention histRetention) bool {
+	pruned := pruneBuckets(s.hourly, bucketStart(now.Add(-retention.hourly), hourlyBucket))
+	return pruneBuckets(s.daily, bucketStart(now.Add(-retention.daily), dailyBucket)) || pruned
+}
+
+func pruneBuckets(buckets map[int64]int, oldest int64) bool {
+	pruned := false
+	for k := range buckets {
+		if k < oldest {
+			delete(buckets, k)
+			pruned = true
+		}
+	}
+	return pruned
+}
+
+// bucketStart truncates in UTC so daily buckets start at midnight UTC
+func bucketStart(t time.Time, size time.Duration) int64 {
+	return t.UTC().Truncate(size).Unix()
+}
+
+// countBetween sums hits in [from, to) at bucket granularity. Hourly buckets are used while
+// from is still within hourly retention, daily buckets otherwise.
+func (s *fqdnStats) countBetween(from, to time.Time, retention histRetention, now time.Time) int {
+	buckets, size := s.daily, dailyBucket
+	if bucketSizeFor(from, retention, now) == hourlyBucket {
+		buckets, size = s.hourly, hourlyBucket
+	}
+	start := bucketStart(from, size)
+	result := 0
+	for k, v := range buckets {
+		if !from.IsZero() && k < start {
+			continue
+		}
+		if !to.IsZero() && k >= to.Unix() {
+			continue
+		}
+		result += v
+	}
+	return result
+}
+
+// bucketSizeFor picks hourly buckets while from is still within hourly retention
+func bucketSizeFor(from time.Time, retention histRetention, now time.Time) time.Duration {
+	if !from.IsZero() && !from.Before(now.Add(-retention.hourly)) {
+		return hourlyBucket
+	}
+	return dailyBucket
+}
+
+type bucketCount struct {
+	Start time.Time
+	Count int
+}
+
+func newBucketCounts(buckets map[int64]int) []bucketCount {
+	if len(buckets) == 0 {
+		return nil
+	}
+	result := make([]bucketCount, 0, len(buckets))
+	for k, v := range buckets {
+		result = append(result, bucketCount{Start: time.Unix(k, 0).UTC(), Count: v})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Start.Before(result[j].Start)
+	})
+	return result
+}
+
+func bucketsFromCounts(counts []bucketCount, size time.Duration) map[int64]int {
+	result := make(map[int64]int, len(counts))
+	for _, v := range counts {
+		result[bucketStart(v.Start, size)] += v.Count
+	}
+	return result
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+func TestFQDNStatsTimeWindows(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 30, 0, 0, time.UTC)
+	s := newFQDNStats()
+	for _, ago := range []time.Duration{72 * time.Hour, 5 * time.Hour, 90 * time.Minute, 10 * time.Minute, 5 * time.Minute} {
+		s.record(forwardproxy.HistEvent{Time: now.Add(-ago), List: "ads", Client: "192.168.1.10:50000"})
+	}
+	if s.count != 5 || !s.firstSeen.Equal(now.Add(-72*time.Hour)) || !s.lastSeen.Equal(now.Add(-5*time.Minute)) {
+		t.Errorf("count %d, first seen %v, last seen %v", s.count, s.firstSeen, s.lastSeen)
+	}
+	if s.lists["ads"] != 5 || s.clients["192.168.1.10"] != 5 {
+		t.Errorf("lists %v, clients %v", s.lists, s.clients)
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     int
+	}{
+		// hourly buckets: the 12:00 bucket holds both recent hits, 11:00 the one 90m ago
+		{"last hour", now.Add(-time.Hour), time.Time{}, 3},
+		{"last 2 hours to 12:00", now.Add(-2 * time.Hour), now.Truncate(time.Hour), 1},
+		{"last 24 hours", now.Add(-24 * time.Hour), time.Time{}, 4},
+		// beyond hourly retention daily buckets are used, whole days at a time
+		{"last 4 days", now.Add(-4 * 24 * time.Hour), time.Time{}, 5},
+		{"until midnight", time.Time{}, now.Truncate(24 * time.Hour), 1},
+	}
+	for _, tt := range tests {
+		if got := s.countBetween(tt.from, tt.to, defaultHistRetention, now); got != tt.want {
+			t.Errorf("%s: countBetween = %d, want %d", tt.name, got, tt.want)
+		}
+	}
+
+	if !s.prune(now.Add(24*time.Hour), histRetention{hourly: 6 * time.Hour, daily: 2 * 24 * time.Hour}) {
+		t.Fatal("nothing pruned")
+	}
+	if len(s.hourly) != 0 || len(s.daily) != 1 || s.count != 5 {
+		t.Errorf("after prune: hourly %v, daily %v, count %d", s.hourly, s.daily, s.count)
+	}
+}
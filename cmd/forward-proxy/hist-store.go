@@ -0,0 +1,34 @@
+package main
+
+import (
+	"io"
+	"strings"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+const (
+	fileHistScheme   = "file://"
+	sqliteHistScheme = "sqlite://"
+)
+
+// histStore is a HistLogger whose collected data can be queried and reset through the API
+type histStore interface {
+	forwardproxy.HistEventLogger
+	io.Closer
+	Query(q histQuery) (histContent, error)
+	Reset(r histReset) (int, error)
+}
+
+// newHistStore picks the backend from the scheme of spec: sqlite:///path/to/db for SQLite and
+// a plain path (optionally file://) for YAML. An empty spec disables the histogram and returns nil.
+func newHistStore(spec string, retention histRetention) (histStore, error) {
+	switch {
+	case spec == "":
+		return nil, nil
+	case strings.HasPrefix(spec, sqliteHistScheme):
+		return newSQLiteHistLogger(strings.TrimPrefix(spec, sqliteHistScheme), retention)
+	default:
+		return newFileBasedHistLogger(strings.TrimPrefix(spec, fileHistScheme), retention), nil
+	}
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+var httpProxyDialTimeout = 30 * time.Second
+
+type dialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// httpProxy is an HTTP forward proxy that tunnels CONNECT requests and forwards absolute-URI
+// requests. Destinations are resolved and checked by the same resolver and rules as the
+// SOCKS5 server, which also records them in the histogram.
+type httpProxy struct {
+	rules    socks5.RuleSet
+	resolver socks5.NameResolver
+	dial     dialFunc
+	// internal
+	forward *httputil.ReverseProxy
+	srv     *http.Server
+}
+
+type httpProxyDialAddrKey struct{}
+
+func newHTTPProxy(rules socks5.RuleSet, resolver socks5.NameResolver, dial dialFunc) *httpProxy {
+	if dial == nil {
+		dial = (&net.Dialer{Timeout: httpProxyDialTimeout}).DialContext
+	}
+	result := &httpProxy{
+		rules:    rules,
+		resolver: resolver,
+		dial:     dial,
+	}
+	transport := &http.Transport{
+		// always dial the address that was checked, never re-resolve the URL host
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if v, ok := ctx.Value(httpProxyDialAddrKey{}).(string); ok {
+				addr = v
+			}
+			return result.dial(ctx, network, addr)
+		},
+		MaxIdleConns:          100,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   10 * time.Second,
+		ExpectContinueTimeout: time.Second,
+	}
+	result.forward = &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			// a forward proxy should not reveal its clients
+			r.Header["X-Forwarded-For"] = nil
+		},
+		Transport: transport,
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			log.Printf("http proxy: %s %s failed: %v", r.Method, r.URL, err)
+			http.Error(w, "bad gateway", http.StatusBadGateway)
+		},
+	}
+	result.srv = &http.Server{Handler: result, ReadHeaderTimeout: 30 * time.Second}
+	return result
+}
+
+func (p *httpProxy) serve(l net.Listener) error {
+	log.Printf("Serving HTTP proxy on: %s", l.Addr().String())
+	if err := p.srv.Serve(l); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// shutdown stops accepting and closes idle keep-alive connections, waiting for in-flight
+// requests until ctx is done. Hijacked CONNECT tunnels are left to the caller.
+func (p *httpProxy) shutdown(ctx context.Context) {
+	p.srv.Shutdown(ctx)
+}
+
+func (p *httpProxy) close() {
+	p.srv.Close()
+}
+
+func (p *httpProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	host, defaultPort := r.URL.Host, "80"
+	switch {
+	case r.Method == http.MethodConnect:
+		host, defaultPort = r.Host, "443"
+	case r.URL.Scheme == "https":
+		defaultPort = "443"
+	case r.URL.Scheme != "http" || r.URL.Host == "":
+		http.Error(w, "this is a proxy: absolute URI or CONNECT required", http.StatusBadRequest)
+		return
+	}
+	ctx, dest, err := p.destination(r.Context(), host, defaultPort)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	ctx, ok := p.rules.Allow(ctx, newHTTPProxySocksRequest(r, dest))
+	if !ok {
+		http.Error(w, fmt.Sprintf("%s is blocked", host), http.StatusForbidden)
+		return
+	}
+	if r.Method == http.MethodConnect {
+		p.tunnel(w, r.WithContext(ctx), dest)
+		return
+	}
+	p.forward.ServeHTTP(w, r.WithContext(context.WithValue(ctx, httpProxyDialAddrKey{}, dest.String())))
+}
+
+// destination resolves host[:port] the way the SOCKS5 server does
+func (p *httpProxy) destination(ctx context.Context, hostport, defaultPort string) (context.Context, *statute.AddrSpec, error) {
+	host, port, err := net.SplitHostPort(hostport)
+	if err != nil {
+		host, port = hostport, defaultPort
+	}
+	portNum, err := strconv.Atoi(port)
+	if err != nil || portNum <= 0 || portNum > 65535 {
+		return ctx, nil, fmt.Errorf("invalid port in %s", hostport)
+	}
+	dest := &statute.AddrSpec{Port: portNum}
+	if ip := net.ParseIP(host); ip != nil {
+		dest.IP = ip
+		return ctx, dest, nil
+	}
+	dest.FQDN = host
+	ctx, dest.IP, err = p.resolver.Resolve(ctx, host)
+	if err != nil {
+		return ctx, nil, fmt.Errorf("unable to resolve %s", host)
+	}
+	return ctx, dest, nil
+}
+
+// newHTTPProxySocksRequest presents r to the SOCKS5 rules as the equivalent CONNECT
+func newHTTPProxySocksRequest(r *http.Request, dest *statute.AddrSpec) *socks5.Request {
+	result := &socks5.Request{
+		Request: statute.Request{
+			Version: statute.VersionSocks5,
+			Command: statute.CommandConnect,
+			DstAddr: *dest,
+		},
+		DestAddr:    dest,
+		RawDestAddr: dest,
+	}
+	if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+		result.RemoteAddr = addr
+	}
+	return result
+}
+
+func (p *httpProxy) tunnel(w http.ResponseWriter, r *http.Request, dest *statute.AddrSpec) {
+	target, err := p.dial(r.Context(), "tcp", dest.String())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("unable to connect to %s", r.Host), http.StatusBadGateway)
+		return
+	}
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		target.Close()
+		http.Error(w, "tunnelling not supported", http.StatusInternalServerError)
+		return
+	}
+	client, buffered, err := hj.Hijack()
+	if err != nil {
+		target.Close()
+		log.Printf("http proxy: unable to hijack connection: %v", err)
+		return
+	}
+	defer client.Close()
+	defer target.Close()
+	if _, err := io.WriteString(client, "HTTP/1.1 200 Connection established\r\n\r\n"); err != nil {
+		return
+	}
+	done := make(chan struct{}, 2)
+	go func() {
+		// the client may already have sent data that was buffered with the request
+		io.Copy(target, buffered)
+		if tc, ok := target.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, target)
+		if tc, ok := client.(interface{ CloseWrite() error }); ok {
+			tc.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+// loopbackNames resolves every name to 127.0.0.1
+type loopbackNames struct{}
+
+func (loopbackNames) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+// histRecorder keeps the events handed to the blocker's HistLogger
+type histRecorder struct {
+	mu     sync.Mutex
+	events []forwardproxy.HistEvent
+}
+
+func (h *histRecorder) LogAccepted(fqdn string) {
+	h.LogEvent(forwardproxy.HistEvent{FQDN: fqdn})
+}
+
+func (h *histRecorder) LogBlocked(fqdn string) {
+	h.LogEvent(forwardproxy.HistEvent{FQDN: fqdn, Blocked: true})
+}
+
+func (h *histRecorder) LogEvent(ev forwardproxy.HistEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, ev)
+}
+
+// proxyRequest sends raw to the proxy at addr and returns the response; the conn is left
+// open for tunnels
+func proxyRequest(t *testing.T, addr, raw string) (*http.Response, net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(c, raw); err != nil {
+		t.Fatal(err)
+	}
+	br := bufio.NewReader(c)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, c, br
+}
+
+func TestHTTPProxy(t *testing.T) {
+	headers := make(chan http.Header, 1)
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		headers <- r.Header.Clone()
+		io.WriteString(w, "hello")
+	}))
+	defer upstream.Close()
+	_, webPort, _ := net.SplitHostPort(upstream.Listener.Addr().String())
+	_, echoPort, _ := net.SplitHostPort(echoServer(t))
+
+	hist := &histRecorder{}
+	blocker := forwardproxy.NewStaticFQDNBlocker(
+		forwardproxy.WithStaticFQDNBlockList("ads", []string{"ads.test"}),
+		forwardproxy.WithHistLogger(hist),
+	)
+	p := newHTTPProxy(blocker, loopbackNames{}, nil)
+	srv := httptest.NewServer(p)
+	defer srv.Close()
+	proxy := srv.Listener.Addr().String()
+
+	t.Run("connect tunnel", func(t *testing.T) {
+		resp, c, br := proxyRequest(t, proxy, "CONNECT allowed.test:"+echoPort+" HTTP/1.1\r\nHost: allowed.test:"+echoPort+"\r\n\r\n")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("CONNECT = %s", resp.Status)
+		}
+		io.WriteString(c, "ping")
+		got := make([]byte, 4)
+		if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+			t.Errorf("tunnel echoed %q, %v", got, err)
+		}
+	})
+
+	t.Run("forward strips hop-by-hop headers", func(t *testing.T) {
+		resp, _, br := proxyRequest(t, proxy, "GET http://allowed.test:"+webPort+"/page HTTP/1.1\r\n"+
+			"Host: allowed.test:"+webPort+"\r\n"+
+			"Connection: close, X-Hop\r\n"+
+			"X-Hop: 1\r\n"+
+			"Keep-Alive: timeout=5\r\n"+
+			"Proxy-Authorization: Basic dXNlcjpwYXNz\r\n"+
+			"X-Forwarded-For: 10.0.0.1\r\n"+
+			"X-End-To-End: kept\r\n\r\n")
+		body, _ := io.ReadAll(br)
+		if resp.StatusCode != http.StatusOK || !strings.Contains(string(body), "hello") {
+			t.Fatalf("GET = %s: %q", resp.Status, body)
+		}
+		got := <-headers
+		for _, h := range []string{"X-Hop", "Keep-Alive", "Proxy-Authorization", "X-Forwarded-For"} {
+			if v := got.Get(h); v != "" {
+				t.Errorf("%s forwarded: %q", h, v)
+			}
+		}
+		if got.Get("X-End-To-End") != "kept" {
+			t.Errorf("end-to-end header dropped: %v", got)
+		}
+	})
+
+	for _, tt := range []struct{ name, raw string }{
+		{"blocked connect", "CONNECT ads.test:443 HTTP/1.1\r\nHost: ads.test:443\r\n\r\n"},
+		{"blocked absolute uri", "GET http://ads.test/ HTTP/1.1\r\nHost: ads.test\r\n\r\n"},
+	} {
+		if resp, _, _ := proxyRequest(t, proxy, tt.raw); resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%s = %s, want 403", tt.name, resp.Status)
+		}
+	}
+	if resp, _, _ := proxyRequest(t, proxy, "GET /page HTTP/1.1\r\nHost: allowed.test\r\n\r\n"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("relative URI = %s, want 400", resp.Status)
+	}
+
+	hist.mu.Lock()
+	defer hist.mu.Unlock()
+	var accepted, blocked int
+	for _, ev := range hist.events {
+		switch {
+		case ev.FQDN == "allowed.test" && !ev.Blocked:
+			accepted++
+		case ev.FQDN == "ads.test" && ev.Blocked && ev.List == "ads":
+			blocked++
+		default:
+			t.Errorf("unexpected event %+v", ev)
+		}
+	}
+	if accepted != 2 || blocked != 2 {
+		t.Errorf("recorded %d accepted and %d blocked, want 2 and 2", accepted, blocked)
+	}
+}
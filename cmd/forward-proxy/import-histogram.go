@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/urfave/cli/v2"
+)
+
+// importHistogramCommand migrates a YAML histogram into a SQLite histogram database
+func importHistogramCommand() *cli.Command {
+	var from, to string
+	var merge bool
+	return &cli.Command{
+		Name:  "import-histogram",
+		Usage: "import a YAML histogram file into a SQLite histogram database",
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "from",
+				Usage:       "YAML histogram file written by --histlogger",
+				Required:    true,
+				Destination: &from,
+			},
+			&cli.StringFlag{
+				Name:        "to",
+				Usage:       "sqlite:///path/to/db",
+				Required:    true,
+				Destination: &to,
+			},
+			&cli.BoolFlag{
+				Name:        "merge",
+				Usage:       "add to a database that already holds a histogram; importing the same file twice doubles its counts",
+				Destination: &merge,
+			},
+		},
+		Action: func(cCtx *cli.Context) error {
+			if !strings.HasPrefix(to, sqliteHistScheme) {
+				return fmt.Errorf("--to must be of the form %s/path/to/db", sqliteHistScheme)
+			}
+			imported, err := importHistogramFile(strings.TrimPrefix(from, fileHistScheme), strings.TrimPrefix(to, sqliteHistScheme), merge)
+			if err != nil {
+				return err
+			}
+			log.Printf("imported %d histogram entries from %s into %s", imported, from, to)
+			return nil
+		},
+	}
+}
@@ -0,0 +1,37 @@
+//go:build unix
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestListenUnixMode(t *testing.T) {
+	dir := t.TempDir()
+	umask := syscall.Umask(0077)
+	defer syscall.Umask(umask)
+	for _, tt := range []struct {
+		mode, want os.FileMode
+	}{
+		{0, 0700},
+		{0660, 0660},
+	} {
+		path := filepath.Join(dir, fmt.Sprintf("proxy-%o.sock", tt.mode))
+		l, err := listenUnix(path, tt.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer l.Close()
+		fi, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := fi.Mode().Perm(); got != tt.want {
+			t.Errorf("mode %04o: socket has %04o, want %04o", tt.mode, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// listenSpec is a --listen value: [tcp://]host:port or unix:///path/to/socket, optionally
+// followed by @profile to decide the listener's requests under that policy profile. A unix
+// socket may be given a mode such as unix:///run/proxy.sock?mode=0660; without one its
+// permissions follow the umask.
+type listenSpec struct {
+	network, address string
+	profile          string
+	mode             os.FileMode
+}
+
+func parseListenSpec(v string) (listenSpec, error) {
+	result := listenSpec{network: "tcp"}
+	if i := strings.LastIndex(v, "@"); i >= 0 {
+		v, result.profile = v[:i], v[i+1:]
+		if result.profile == "" {
+			return listenSpec{}, errors.New("empty profile after @")
+		}
+	}
+	switch {
+	case strings.HasPrefix(v, "unix://"):
+		result.network, result.address = "unix", strings.TrimPrefix(v, "unix://")
+		if i := strings.Index(result.address, "?"); i >= 0 {
+			mode, err := parseSocketMode(result.address[i+1:])
+			if err != nil {
+				return listenSpec{}, err
+			}
+			result.address, result.mode = result.address[:i], mode
+		}
+		if result.address == "" {
+			return listenSpec{}, errors.New("missing unix socket path")
+		}
+		return result, nil
+	case strings.HasPrefix(v, "tcp://"):
+		v = strings.TrimPrefix(v, "tcp://")
+	case strings.Contains(v, "://"):
+		return listenSpec{}, errors.New("unsupported scheme: use tcp:// or unix://")
+	}
+	if _, _, err := net.SplitHostPort(v); err != nil {
+		return listenSpec{}, err
+	}
+	result.address = v
+	return result, nil
+}
+
+// parseSocketMode parses the query of a unix listen spec, which may only hold an octal mode
+func parseSocketMode(query string) (os.FileMode, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return 0, err
+	}
+	var result os.FileMode
+	for k, v := range values {
+		if k != "mode" || len(v) != 1 {
+			return 0, fmt.Errorf("unsupported unix socket option %s: only mode is supported", k)
+		}
+		mode, err := strconv.ParseUint(v[0], 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return 0, fmt.Errorf("invalid unix socket mode %s: use octal permissions such as 0660", v[0])
+		}
+		result = os.FileMode(mode)
+	}
+	return result, nil
+}
+
+func (s listenSpec) String() string {
+	result := s.address
+	if s.network == "unix" {
+		result = "unix://" + s.address
+		if s.mode != 0 {
+			result += fmt.Sprintf("?mode=%04o", uint32(s.mode))
+		}
+	}
+	if s.profile != "" {
+		result += "@" + s.profile
+	}
+	return result
+}
+
+// listenUnix listens on path, replacing a socket left behind by a process that is gone. The
+// socket gets mode when it is not zero and otherwise keeps the permissions the umask gives it.
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil && errors.Is(err, syscall.EADDRINUSE) {
+		if fi, serr := os.Stat(path); serr == nil && fi.Mode()&os.ModeSocket != 0 {
+			if c, derr := net.Dial("unix", path); derr == nil {
+				c.Close()
+				return nil, err
+			}
+			os.Remove(path)
+			l, err = net.Listen("unix", path)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if mode != 0 {
+		if err := os.Chmod(path, mode); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+// unixPeerListener names each accepted connection unix:<n>. Unix socket peers have no address
+// of their own, yet connections are told apart and clients grouped by their remote address.
+type unixPeerListener struct {
+	net.Listener
+	// internal
+	seq atomic.Uint64
+}
+
+func (l *unixPeerListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &unixPeerConn{
+		Conn:   c,
+		remote: &net.UnixAddr{Net: "unix", Name: fmt.Sprintf("unix:%d", l.seq.Add(1))},
+	}, nil
+}
+
+type unixPeerConn struct {
+	net.Conn
+	remote net.Addr
+}
+
+func (c *unixPeerConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *unixPeerConn) CloseWrite() error {
+	if cw, ok := c.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
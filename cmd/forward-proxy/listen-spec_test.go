@@ -0,0 +1,82 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenSpec(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    listenSpec
+		wantErr bool
+	}{
+		{in: "127.0.0.1:1080", want: listenSpec{network: "tcp", address: "127.0.0.1:1080"}},
+		{in: "tcp://:1080@kids", want: listenSpec{network: "tcp", address: ":1080", profile: "kids"}},
+		{in: "[::1]:1080@open", want: listenSpec{network: "tcp", address: "[::1]:1080", profile: "open"}},
+		{in: "unix:///run/proxy.sock", want: listenSpec{network: "unix", address: "/run/proxy.sock"}},
+		{in: "unix:///run/user@1000/proxy.sock@kids", want: listenSpec{network: "unix", address: "/run/user@1000/proxy.sock", profile: "kids"}},
+		{in: "unix:///run/proxy.sock?mode=0660@kids", want: listenSpec{network: "unix", address: "/run/proxy.sock", profile: "kids", mode: 0660}},
+		{in: "unix:///run/proxy.sock?mode=660", want: listenSpec{network: "unix", address: "/run/proxy.sock", mode: 0660}},
+		{in: "unix:///run/proxy.sock?mode=0999", wantErr: true},
+		{in: "unix:///run/proxy.sock?mode=01777", wantErr: true},
+		{in: "unix:///run/proxy.sock?owner=me", wantErr: true},
+		{in: "unix://?mode=0600", wantErr: true},
+		{in: "127.0.0.1:1080@", wantErr: true},
+		{in: "unix://", wantErr: true},
+		{in: "udp://127.0.0.1:1080", wantErr: true},
+		{in: "localhost", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := parseListenSpec(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("parseListenSpec(%q) = %+v, want an error", tt.in, got)
+			}
+			continue
+		}
+		if err != nil || got != tt.want {
+			t.Errorf("parseListenSpec(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+	if s := (listenSpec{network: "unix", address: "/run/proxy.sock", profile: "kids", mode: 0660}).String(); s != "unix:///run/proxy.sock?mode=0660@kids" {
+		t.Errorf("String() = %s", s)
+	}
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path, 0)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	defer l.Close()
+	if _, err := listenUnix(path, 0); err == nil {
+		t.Error("socket of a live listener replaced")
+	}
+
+	peers := &unixPeerListener{Listener: l}
+	for _, want := range []string{"unix:1", "unix:2"} {
+		c, err := net.Dial("unix", path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		accepted, err := peers.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer accepted.Close()
+		if got := accepted.RemoteAddr().String(); got != want {
+			t.Errorf("RemoteAddr() = %s, want %s", got, want)
+		}
+	}
+}
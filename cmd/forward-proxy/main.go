@@ -2,13 +2,16 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"strings"
+	"sync/atomic"
 	"syscall"
+	"time"
 
 	forwardproxy "github.com/arunsworld/forward-proxy"
 	"github.com/arunsworld/nursery"
@@ -21,17 +24,45 @@ func main() {
 	var hostname string
 	var port int
 	var apiPort int
+	var httpPort int
 	var acceptLogging bool
 	var blockedLogging bool
 	var discardErrLogging bool
 	var blockFile string
+	var blockSourcesFile, blockSourceCache string
 	var histLoggerFile string
+	var histHourlyRetention, histDailyRetention time.Duration
 	var allowiponly bool
+	var inspectSNI, strictSNI bool
+	var blockPage bool
+	var unblockURL string
 	var adminDomainName string
 	var dnsFile string
+	var apiAuthFile string
+	var apiCertFile, apiKeyFile, apiClientCAFile string
+	var syslogTarget, syslogFacility string
+	var webhookURL, webhookSpoolDir string
+	var webhookSpoolMax int64
+	var alertRulesFile string
+	var upstreamsFile string
+	var limits connLimits
+	var drainTimeout time.Duration
+	var profilesFile string
+	var configFile string
+	var bindPolicy, associatePolicy string
 	app := &cli.App{
 		Name: "forward-proxy",
+		Commands: []*cli.Command{
+			importHistogramCommand(),
+			configCommand(),
+		},
 		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:        "config",
+				Usage:       "yaml file holding the whole configuration; flags and environment variables override it",
+				EnvVars:     []string{"FORWARD_PROXY_CONFIG"},
+				Destination: &configFile,
+			},
 			&cli.StringFlag{
 				Name:        "hostname",
 				EnvVars:     []string{"FORWARD_PROXY_HOSTNAME"},
@@ -44,12 +75,29 @@ func main() {
 				EnvVars:     []string{"FORWARD_PROXY_PORT"},
 				Destination: &port,
 			},
+			&cli.StringSliceFlag{
+				Name:    "listen",
+				Usage:   "serve SOCKS5 on [tcp://]host:port or unix:///path[?mode=0660], with @profile to apply a policy profile; repeat for more (default hostname:port)",
+				EnvVars: []string{"FORWARD_PROXY_LISTEN"},
+			},
+			&cli.StringFlag{
+				Name:        "profiles",
+				Usage:       "yaml file of named policy profiles for --listen addresses; replaces the profiles in --config",
+				Destination: &profilesFile,
+			},
 			&cli.IntFlag{
 				Name:        "api",
 				Value:       0,
 				EnvVars:     []string{"FORWARD_PROXY_API_PORT"},
 				Destination: &apiPort,
 			},
+			&cli.IntFlag{
+				Name:        "httpport",
+				Value:       0,
+				Usage:       "also serve an HTTP/HTTPS forward proxy on this port",
+				EnvVars:     []string{"FORWARD_PROXY_HTTP_PORT"},
+				Destination: &httpPort,
+			},
 			&cli.BoolFlag{
 				Name:        "acceptlogging",
 				Value:       false,
@@ -70,24 +118,124 @@ func main() {
 			},
 			&cli.StringFlag{
 				Name:        "blockfile",
-				Value:       "fqdn-block.yml",
+				Value:       defaultBlockFile,
 				Aliases:     []string{"f"},
 				EnvVars:     []string{"FQDN_BLOCK_FILE"},
 				Destination: &blockFile,
 			},
+			&cli.StringFlag{
+				Name:        "blocksources",
+				Usage:       "YAML list of remote hosts files (name, url, refresh) fetched into block lists on a schedule",
+				EnvVars:     []string{"FORWARD_PROXY_BLOCK_SOURCES"},
+				Destination: &blockSourcesFile,
+			},
+			&cli.StringFlag{
+				Name:        "blocksourcecache",
+				Usage:       "directory keeping the last good copy of each remote block list for the next start",
+				EnvVars:     []string{"FORWARD_PROXY_BLOCK_SOURCE_CACHE"},
+				Destination: &blockSourceCache,
+			},
 			&cli.StringFlag{
 				Name: "histlogger",
 				// Value:       "hist-logger.yml",
+				Usage:       "YAML file path, or sqlite:///path/to/db for SQLite",
 				Aliases:     []string{"l"},
 				EnvVars:     []string{"HIST_LOGGER_FILE"},
 				Destination: &histLoggerFile,
 			},
+			&cli.DurationFlag{
+				Name:        "histhourlyretention",
+				Value:       defaultHistRetention.hourly,
+				Usage:       "how long hourly histogram buckets are kept",
+				Destination: &histHourlyRetention,
+			},
+			&cli.DurationFlag{
+				Name:        "histdailyretention",
+				Value:       defaultHistRetention.daily,
+				Usage:       "how long daily histogram buckets are kept",
+				Destination: &histDailyRetention,
+			},
 			&cli.BoolFlag{
 				Name:        "allowiponly",
 				Value:       false,
 				Aliases:     []string{"ip"},
 				Destination: &allowiponly,
 			},
+			&cli.BoolFlag{
+				Name:        "inspectsni",
+				Value:       false,
+				Usage:       "apply block lists to the TLS SNI or HTTP Host sent over CONNECT, including IP-only connections",
+				Destination: &inspectSNI,
+			},
+			&cli.BoolFlag{
+				Name:        "strictsni",
+				Value:       false,
+				Usage:       "with --inspectsni, also block CONNECTs whose SNI or Host differs from the requested name; breaks CDN-fronted sites",
+				Destination: &strictSNI,
+			},
+			&cli.BoolFlag{
+				Name:        "blockpage",
+				Value:       false,
+				Usage:       "answer blocked port 80 CONNECTs with an HTML page naming the block list",
+				Destination: &blockPage,
+			},
+			&cli.StringFlag{
+				Name:        "unblockurl",
+				Usage:       "unblock link on the block page; defaults to the api server's /unblock when --api is set",
+				Destination: &unblockURL,
+			},
+			&cli.StringFlag{
+				Name:        "bindpolicy",
+				Value:       "allowed",
+				Usage:       "BIND requests: disabled, allowed or filtered",
+				Destination: &bindPolicy,
+			},
+			&cli.StringFlag{
+				Name:        "udppolicy",
+				Value:       "allowed",
+				Usage:       "UDP ASSOCIATE requests: disabled, allowed or filtered (checked per destination)",
+				Destination: &associatePolicy,
+			},
+			&cli.StringFlag{
+				Name:        "upstreams",
+				Aliases:     []string{"dialrules"},
+				Usage:       "YAML list of dial rules (match, list, client, profile, via, source, interface): upstream proxies and source addresses",
+				EnvVars:     []string{"FORWARD_PROXY_UPSTREAMS"},
+				Destination: &upstreamsFile,
+			},
+			&cli.IntFlag{
+				Name:        "maxconns",
+				Usage:       "maximum concurrent client connections, 0 for unlimited",
+				Destination: &limits.maxConns,
+			},
+			&cli.IntFlag{
+				Name:        "maxconnsperclient",
+				Usage:       "maximum concurrent connections per client host, 0 for unlimited",
+				Destination: &limits.maxConnsPerClient,
+			},
+			&cli.DurationFlag{
+				Name:        "handshaketimeout",
+				Value:       30 * time.Second,
+				Usage:       "close client connections that haven't made a request within this time",
+				Destination: &limits.handshakeTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "idletimeout",
+				Usage:       "close tunnels without traffic in either direction for this long, 0 to disable",
+				Destination: &limits.idleTimeout,
+			},
+			&cli.DurationFlag{
+				Name:        "maxtunnelduration",
+				Usage:       "close tunnels open for longer than this, 0 to disable",
+				Destination: &limits.maxDuration,
+			},
+			&cli.DurationFlag{
+				Name:        "draintimeout",
+				Value:       30 * time.Second,
+				Usage:       "on shutdown wait this long for open tunnels to finish before closing them",
+				EnvVars:     []string{"FORWARD_PROXY_DRAIN_TIMEOUT"},
+				Destination: &drainTimeout,
+			},
 			&cli.StringFlag{
 				Name:        "admindomain",
 				Value:       "i",
@@ -97,51 +245,295 @@ func main() {
 				Name:        "dns",
 				Destination: &dnsFile,
 			},
+			&cli.StringFlag{
+				Name:        "apiauth",
+				Usage:       "YAML list of api clients (name, token or commonname, access: read|write, endpoints)",
+				EnvVars:     []string{"FORWARD_PROXY_API_AUTH_FILE"},
+				Destination: &apiAuthFile,
+			},
+			&cli.StringFlag{
+				Name:        "apicert",
+				EnvVars:     []string{"FORWARD_PROXY_API_CERT"},
+				Destination: &apiCertFile,
+			},
+			&cli.StringFlag{
+				Name:        "apikey",
+				EnvVars:     []string{"FORWARD_PROXY_API_KEY"},
+				Destination: &apiKeyFile,
+			},
+			&cli.StringFlag{
+				Name:        "apiclientca",
+				Usage:       "CA bundle used to verify api client certificates",
+				EnvVars:     []string{"FORWARD_PROXY_API_CLIENT_CA"},
+				Destination: &apiClientCAFile,
+			},
+			&cli.StringFlag{
+				Name:        "syslog",
+				Usage:       "ship events to syslog: udp://host:514, tcp://host:601 or unix:///dev/log",
+				EnvVars:     []string{"FORWARD_PROXY_SYSLOG"},
+				Destination: &syslogTarget,
+			},
+			&cli.StringFlag{
+				Name:        "syslogfacility",
+				Value:       "local0",
+				Destination: &syslogFacility,
+			},
+			&cli.StringFlag{
+				Name:        "webhook",
+				Usage:       "POST batches of events as JSON to this url",
+				EnvVars:     []string{"FORWARD_PROXY_WEBHOOK"},
+				Destination: &webhookURL,
+			},
+			&cli.StringFlag{
+				Name:        "webhookspool",
+				Usage:       "directory holding undelivered webhook batches",
+				Destination: &webhookSpoolDir,
+			},
+			&cli.Int64Flag{
+				Name:        "webhookspoolmax",
+				Value:       64 << 20,
+				Usage:       "maximum size of the webhook spool in bytes",
+				Destination: &webhookSpoolMax,
+			},
+			&cli.StringFlag{
+				Name:        "alertrules",
+				Usage:       "YAML list of watch rules that notify a webhook or command when triggered",
+				EnvVars:     []string{"FORWARD_PROXY_ALERT_RULES"},
+				Destination: &alertRulesFile,
+			},
 		},
 		Action: func(cCtx *cli.Context) error {
-			hlogger := newFileBasedHistLogger(histLoggerFile)
+			started := time.Now()
+			cfg := &proxyConfig{}
+			if configFile != "" {
+				v, err := loadProxyConfig(configFile)
+				if err != nil {
+					return err
+				}
+				if err := v.applyTo(cCtx); err != nil {
+					return err
+				}
+				cfg = v
+				if len(cfg.blockLists) > 0 && !cCtx.IsSet("blockfile") {
+					// the lists are all in the config file
+					blockFile = ""
+				}
+			}
+			hlogger, err := newHistStore(histLoggerFile, histRetention{
+				hourly: histHourlyRetention,
+				daily:  histDailyRetention,
+			})
+			if err != nil {
+				return err
+			}
+			sinks := newFanOutHistLogger(hlogger)
+			if syslogTarget != "" {
+				v, err := newSyslogHistLogger(syslogTarget, syslogFacility)
+				if err != nil {
+					return err
+				}
+				sinks.sinks = append(sinks.sinks, v)
+			}
+			if webhookURL != "" {
+				v, err := newWebhookHistLogger(webhookURL, webhookSpoolDir, webhookSpoolMax)
+				if err != nil {
+					return err
+				}
+				sinks.sinks = append(sinks.sinks, v)
+			}
+			if alertRulesFile != "" {
+				rules, err := alertRulesFromFile(alertRulesFile)
+				if err != nil {
+					return err
+				}
+				sinks.sinks = append(sinks.sinks, newAlertingHistLogger(rules))
+			}
+			feed := newConnFeed(sinks)
 
 			ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 			defer cancel()
+			// a successful restart hands the listeners over and then shuts down like SIGTERM
+			ctx, handOver := context.WithCancel(ctx)
+			defer handOver()
+			var handedOver atomic.Bool
 
 			var opts []socks5.Option
 			if !discardErrLogging {
 				opts = append(opts, socks5.WithLogger(socks5.NewLogger(log.New(os.Stdout, "socks5: ", log.LstdFlags))))
 			}
-			blocker, err := standardStaticFQDNBlocker(blockFile, acceptLogging, blockedLogging, hlogger, allowiponly, adminDomainName)
+			bindP, err := forwardproxy.ParseCommandPolicy(bindPolicy)
+			if err != nil {
+				return fmt.Errorf("bindpolicy: %w", err)
+			}
+			associateP, err := forwardproxy.ParseCommandPolicy(associatePolicy)
 			if err != nil {
+				return fmt.Errorf("udppolicy: %w", err)
+			}
+			blockerOpts := []forwardproxy.StaticFQDNBlockerOpt{
+				forwardproxy.WithBindPolicy(bindP),
+				forwardproxy.WithAssociatePolicy(associateP),
+			}
+			switch {
+			case strictSNI:
+				blockerOpts = append(blockerOpts, forwardproxy.WithStrictServerNameMatch())
+			case inspectSNI:
+				blockerOpts = append(blockerOpts, forwardproxy.WithServerNameInspection())
+			}
+			if blockPage {
+				if unblockURL == "" && apiPort != 0 {
+					unblockURL = defaultUnblockURL(hostname, apiPort, apiCertFile != "")
+				}
+				blockerOpts = append(blockerOpts, forwardproxy.WithBlockPage(unblockURL))
+			}
+			for name, bl := range cfg.blockLists {
+				blockerOpts = append(blockerOpts, forwardproxy.WithStaticFQDNBlockList(name, bl))
+			}
+			blocker, err := standardStaticFQDNBlocker(blockFile, acceptLogging, blockedLogging, feed, allowiponly, adminDomainName, blockerOpts...)
+			if err != nil {
+				return err
+			}
+			sources := cfg.blockSources
+			if blockSourcesFile != "" {
+				fromFile, err := blockListSourcesFromFile(blockSourcesFile)
+				if err != nil {
+					return fmt.Errorf("unable to load block list sources from %s: %w", blockSourcesFile, err)
+				}
+				sources = append(sources, fromFile...)
+			}
+			var refresher *blockListRefresher
+			if len(sources) > 0 {
+				refresher, err = newBlockListRefresher(blocker, sources, blockSourceCache)
+				if err != nil {
+					return err
+				}
+			}
+			var profiles map[string]*forwardproxy.PolicyProfile
+			if profilesFile != "" {
+				// like any flag, --profiles takes precedence over profiles written in the config
+				profiles, err = policyProfilesFromFile(profilesFile, blocker.BlockListSizes())
+				if err != nil {
+					return fmt.Errorf("unable to load profiles from %s: %w", profilesFile, err)
+				}
+			} else if profiles, err = cfg.policyProfiles(blocker.BlockListSizes()); err != nil {
 				return err
 			}
-			opts = append(opts, socks5.WithRule(blocker))
+			var specs []listenSpec
+			for _, v := range cCtx.StringSlice("listen") {
+				spec, err := parseListenSpec(v)
+				if err != nil {
+					return fmt.Errorf("invalid listen address %q: %w", v, err)
+				}
+				if _, ok := profiles[spec.profile]; spec.profile != "" && !ok {
+					return fmt.Errorf("listen address %s: unknown profile %s", v, spec.profile)
+				}
+				specs = append(specs, spec)
+			}
+			if len(specs) == 0 {
+				specs = append(specs, listenSpec{network: "tcp", address: fmt.Sprintf("%s:%d", hostname, port)})
+			}
 
 			// experimental
-			var dnsOverride map[string]net.IP
-			if dnsFile != "" {
-				v, err := dnsOverridesFromFile(dnsFile)
+			registry, err := newDNSRegistry(dnsFile)
+			if err != nil {
+				return err
+			}
+			for _, o := range cfg.dnsOverrides {
+				registry.RegisterStatic(o.FQDN, net.ParseIP(o.IP), "from "+configFile)
+			}
+			dr := newDNSResolver(adminDomainName, registry)
+			var rules socks5.RuleSet = blocker
+			var dial dialFunc
+			if upstreamsFile != "" {
+				router, err := upstreamRouterFromFile(upstreamsFile)
 				if err != nil {
 					return err
 				}
-				dnsOverride = v
+				router.lists = blocker
+				if err := router.checkNames(blocker.BlockListSizes(), profiles); err != nil {
+					return fmt.Errorf("%s: %w", upstreamsFile, err)
+				}
+				dr.upstreams = router
+				rules = dialClientRules{next: blocker}
+				dial = router.dial
+				opts = append(opts, socks5.WithDial(dial))
 			}
-			dr := newDNSResolver(adminDomainName, dnsOverride)
+			tracker := newConnTracker(limits)
+			trackingCtx, stopTracking := context.WithCancel(context.Background())
+			defer stopTracking()
+			rules = trackedRules{next: rules, tracker: tracker}
 			opts = append(opts, socks5.WithResolver(dr))
+			opts = append(opts, socks5.WithAssociateHandle(blocker.UDPAssociateHandle(dr)))
+			if inspectSNI || strictSNI || blockPage {
+				opts = append(opts, socks5.WithConnectHandle(blocker.ConnectHandle(dial)))
+			}
 
+			if (apiCertFile == "") != (apiKeyFile == "") {
+				return errors.New("both apicert and apikey are required for TLS")
+			}
+			if apiClientCAFile != "" && apiCertFile == "" {
+				return errors.New("apiclientca requires apicert and apikey")
+			}
+			var apiAuth *apiAuthenticator
+			switch {
+			case apiAuthFile != "":
+				v, err := apiAuthenticatorFromFile(apiAuthFile)
+				if err != nil {
+					return err
+				}
+				apiAuth = v
+			case len(cfg.apiClients) > 0:
+				v, err := newAPIAuthenticator(cfg.apiClients)
+				if err != nil {
+					return err
+				}
+				apiAuth = v
+			}
+			if apiAuth.usesCommonNames() && apiClientCAFile == "" {
+				// without a CA no client certificate is ever verified
+				return errors.New("api clients identified by commonname require apiclientca")
+			}
 			apiServer := apiServer{
-				hostname: hostname,
-				port:     apiPort,
-				dr:       dr,
+				hostname:     hostname,
+				port:         apiPort,
+				dr:           dr,
+				blocker:      blocker,
+				sources:      refresher,
+				hist:         hlogger,
+				feed:         feed,
+				unblock:      newUnblockRequests(),
+				conns:        tracker,
+				auth:         apiAuth,
+				certFile:     apiCertFile,
+				keyFile:      apiKeyFile,
+				clientCAFile: apiClientCAFile,
 			}
 
 			// Create a SOCKS5 server
-			server := socks5.NewServer(opts...)
-			l, err := net.Listen("tcp", fmt.Sprintf("%s:%d", hostname, port))
+			listeners, err := inheritListeners()
 			if err != nil {
 				return err
 			}
-
-			return nursery.RunConcurrently(
-				func(_ context.Context, errCh chan error) {
-					log.Printf("Serving on: %s", l.Addr().String())
+			var socksLs []net.Listener
+			var addrs []string
+			jobs := []nursery.ConcurrentJob{}
+			for _, spec := range specs {
+				l, err := listeners.listenOn(socksListenerName, spec)
+				if err != nil {
+					listeners.close()
+					return err
+				}
+				l = tracker.listener(l)
+				var listenerRules socks5.RuleSet = rules
+				desc := l.Addr().String()
+				if spec.profile != "" {
+					listenerRules = profileRules{next: rules, profile: profiles[spec.profile]}
+					desc += " (profile " + spec.profile + ")"
+				}
+				server := socks5.NewServer(append(opts[:len(opts):len(opts)], socks5.WithRule(listenerRules))...)
+				socksLs = append(socksLs, l)
+				addrs = append(addrs, l.Addr().String())
+				jobs = append(jobs, func(_ context.Context, errCh chan error) {
+					log.Printf("Serving on: %s", desc)
 					if err := server.Serve(l); err != nil {
 						select {
 						case <-ctx.Done():
@@ -150,24 +542,123 @@ func main() {
 						}
 						errCh <- err
 					}
+				})
+			}
+
+			var httpL net.Listener
+			httpSrv := newHTTPProxy(rules, dr, dial)
+			if httpPort != 0 {
+				httpL, err = listeners.listen(httpListenerName, "tcp", fmt.Sprintf("%s:%d", hostname, httpPort))
+				if err != nil {
+					listeners.close()
+					return err
+				}
+				httpL = tracker.listener(httpL)
+			}
+			if apiPort != 0 {
+				apiServer.listener, err = listeners.listen(apiListenerName, "tcp", fmt.Sprintf("%s:%d", hostname, apiPort))
+				if err != nil {
+					listeners.close()
+					return err
+				}
+			}
+			listeners.closeUnused()
+			signalReady()
+
+			jobs = append(jobs,
+				func(lctx context.Context, _ chan error) {
+					if len(restartSignals) == 0 {
+						return
+					}
+					restart := make(chan os.Signal, 1)
+					signal.Notify(restart, restartSignals...)
+					defer signal.Stop(restart)
+					for {
+						select {
+						case <-restart:
+							log.Printf("Restarting: handing listeners over to a new process")
+							if err := listeners.handoff(); err != nil {
+								log.Printf("restart failed, carrying on: %v", err)
+								continue
+							}
+							handedOver.Store(true)
+							handOver()
+							return
+						case <-ctx.Done():
+							return
+						case <-lctx.Done():
+							return
+						}
+					}
 				},
 				func(lctx context.Context, _ chan error) {
+					defer stopTracking()
 					select {
 					case <-ctx.Done():
-						log.Printf("Shutting down: %s", l.Addr().String())
-						l.Close()
-						apiServer.close()
+						log.Printf("Shutting down: %s, draining connections for up to %s", strings.Join(addrs, ", "), drainTimeout)
 					case <-lctx.Done():
+						// another job failed: don't linger
+						drainTimeout = 0
+					}
+					shutdownStarted := time.Now()
+					handedOff := handedOver.Load()
+					for _, l := range socksLs {
+						l.Close()
+					}
+					if handedOff {
+						// the new process serves the API now: changes made here would be lost
 						apiServer.close()
 					}
+					dctx, dcancel := context.WithTimeout(context.Background(), drainTimeout)
+					defer dcancel()
+					go httpSrv.shutdown(dctx)
+					open := tracker.stats().Active
+					remaining := tracker.drain(dctx)
+					httpSrv.close()
+					forced := tracker.closeAll()
+					apiServer.close()
+					if handedOff {
+						// the new process owns the histogram and overrides files and has loaded
+						// them already; writing them now would overwrite its changes
+						if err := sinks.abandon(); err != nil {
+							log.Printf("unable to close event sinks: %v", err)
+						}
+					} else {
+						if err := sinks.Close(); err != nil {
+							log.Printf("unable to flush histogram: %v", err)
+						}
+						if _, err := registry.removeExpired(); err != nil {
+							log.Printf("unable to persist dns overrides: %v", err)
+						}
+					}
+					stats := tracker.stats()
+					log.Printf("shutdown complete in %s after %s uptime: %d connections drained, %d closed at drain timeout, %d accepted in total",
+						time.Since(shutdownStarted).Round(time.Millisecond), time.Since(started).Round(time.Second),
+						open-remaining, forced, stats.Accepted)
 				},
 				func(lctx context.Context, _ chan error) {
-					var loggerCloser io.Closer = hlogger
-					select {
-					case <-ctx.Done():
-					case <-lctx.Done():
+					ectx, ecancel := contextDoneWithEither(ctx, lctx)
+					defer ecancel()
+					registry.expireRegistrations(ectx)
+				},
+				func(lctx context.Context, _ chan error) {
+					ectx, ecancel := contextDoneWithEither(ctx, lctx)
+					defer ecancel()
+					refresher.run(ectx)
+				},
+				func(lctx context.Context, _ chan error) {
+					// keeps reaping while shutdown drains
+					ectx, ecancel := contextDoneWithEither(trackingCtx, lctx)
+					defer ecancel()
+					tracker.run(ectx)
+				},
+				func(_ context.Context, errCh chan error) {
+					if httpL == nil {
+						return
+					}
+					if err := httpSrv.serve(httpL); err != nil {
+						errCh <- err
 					}
-					loggerCloser.Close()
 				},
 				func(_ context.Context, errCh chan error) {
 					if err := apiServer.serve(); err != nil {
@@ -175,6 +666,7 @@ func main() {
 					}
 				},
 			)
+			return nursery.RunConcurrently(jobs...)
 		},
 	}
 	if err := app.Run(os.Args); err != nil {
@@ -182,11 +674,27 @@ func main() {
 	}
 }
 
+// contextDoneWithEither returns a context that is done as soon as either a or b is done
+func contextDoneWithEither(a, b context.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(a)
+	go func() {
+		select {
+		case <-b.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
 type blockConfig struct {
 	BlockList map[string][]string
 }
 
-func standardStaticFQDNBlocker(blockFile string, acceptLogging, blockedLogging bool, hl forwardproxy.HistLogger, allowiponly bool, adminDomainName string) (socks5.RuleSet, error) {
+// defaultBlockFile is loaded when neither --blockfile nor the config file says otherwise
+const defaultBlockFile = "fqdn-block.yml"
+
+func blockListsFromFile(blockFile string) (map[string][]string, error) {
 	contents, err := os.ReadFile(blockFile)
 	if err != nil {
 		return nil, err
@@ -195,9 +703,19 @@ func standardStaticFQDNBlocker(blockFile string, acceptLogging, blockedLogging b
 	if err := yaml.Unmarshal(contents, &input); err != nil {
 		return nil, err
 	}
+	return input.BlockList, nil
+}
+
+func standardStaticFQDNBlocker(blockFile string, acceptLogging, blockedLogging bool, hl forwardproxy.HistLogger, allowiponly bool, adminDomainName string, extra ...forwardproxy.StaticFQDNBlockerOpt) (*forwardproxy.StaticFQDNBlocker, error) {
 	opts := []forwardproxy.StaticFQDNBlockerOpt{}
-	for name, bl := range input.BlockList {
-		opts = append(opts, forwardproxy.WithStaticFQDNBlockList(name, bl))
+	if blockFile != "" {
+		lists, err := blockListsFromFile(blockFile)
+		if err != nil {
+			return nil, err
+		}
+		for name, bl := range lists {
+			opts = append(opts, forwardproxy.WithStaticFQDNBlockList(name, bl))
+		}
 	}
 	if acceptLogging {
 		opts = append(opts, forwardproxy.WithAcceptLogging())
@@ -214,5 +732,6 @@ func standardStaticFQDNBlocker(blockFile string, acceptLogging, blockedLogging b
 	if adminDomainName != "" {
 		opts = append(opts, forwardproxy.WithAllowOverrideFQDN(map[string]struct{}{adminDomainName: {}}))
 	}
+	opts = append(opts, extra...)
 	return forwardproxy.NewStaticFQDNBlocker(opts...), nil
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"github.com/things-go/go-socks5"
+	"gopkg.in/yaml.v3"
+)
+
+// policyProfileConfig is one entry of the profiles file, keyed by profile name:
+//
+//	open:
+//	  unfiltered: true
+//	kids:
+//	  lists: [ads, adult]
+//	  allowiponly: false
+type policyProfileConfig struct {
+	Unfiltered  bool
+	Lists       []string
+	AllowIPOnly *bool
+}
+
+// policyProfilesFromFile reads the profiles file, checking that every list it names is one
+// of knownLists
+func policyProfilesFromFile(fname string, knownLists map[string]int) (map[string]*forwardproxy.PolicyProfile, error) {
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var configs map[string]policyProfileConfig
+	if err := yaml.Unmarshal(contents, &configs); err != nil {
+		return nil, err
+	}
+	return newPolicyProfiles(configs, knownLists)
+}
+
+func newPolicyProfiles(configs map[string]policyProfileConfig, knownLists map[string]int) (map[string]*forwardproxy.PolicyProfile, error) {
+	result := make(map[string]*forwardproxy.PolicyProfile, len(configs))
+	for name, cfg := range configs {
+		if err := cfg.validate(knownLists); err != nil {
+			return nil, fmt.Errorf("profile %s: %w", name, err)
+		}
+		result[name] = &forwardproxy.PolicyProfile{
+			Name:        name,
+			Unfiltered:  cfg.Unfiltered,
+			Lists:       cfg.Lists,
+			AllowIPOnly: cfg.AllowIPOnly,
+		}
+	}
+	return result, nil
+}
+
+// validate checks that every list the profile names is one of knownLists
+func (cfg policyProfileConfig) validate(knownLists map[string]int) error {
+	if cfg.Unfiltered && len(cfg.Lists) > 0 {
+		return errors.New("lists have no effect when unfiltered")
+	}
+	for _, l := range cfg.Lists {
+		if _, ok := knownLists[l]; !ok && l != forwardproxy.RuntimeBlockListName {
+			return fmt.Errorf("unknown block list %s", l)
+		}
+	}
+	return nil
+}
+
+// profileRules decides the requests of one listener under its policy profile
+type profileRules struct {
+	next    socks5.RuleSet
+	profile *forwardproxy.PolicyProfile
+}
+
+func (r profileRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	return r.next.Allow(forwardproxy.ContextWithPolicyProfile(ctx, r.profile), req)
+}
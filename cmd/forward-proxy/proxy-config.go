@@ -0,0 +1,571 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"github.com/urfave/cli/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// The --config file gathers the whole configuration in one YAML document. Its settings are
+// defaults for the flags of the same meaning, so flags and environment variables still win.
+// Block lists, DNS overrides, API clients and policy profiles may also be written inline.
+// Relative paths are resolved against the directory of the config file.
+//
+//	listen: [192.168.1.5:1080, "unix:///run/forward-proxy.sock?mode=0660@open"]
+//	api:
+//	  port: 8080
+//	  clients:
+//	    - {name: admin, token: s3cret, access: write}
+//	    - {name: grafana, token: t0ken, access: read, endpoints: [/v1/histogram]}
+//	blocking:
+//	  file: fqdn-block.yml
+//	  lists:
+//	    ads: [doubleclick.net]
+//	  sources:
+//	    - {name: stevenblack, url: "https://example.com/hosts", refresh: 12h}
+//	dns:
+//	  overrides:
+//	    printer.lan: 192.168.1.20
+//	profiles:
+//	  open: {unfiltered: true}
+//	logging:
+//	  histogram: {store: sqlite://hist.db}
+
+type settingKind uint8
+
+const (
+	stringSetting settingKind = iota
+	pathSetting
+	intSetting
+	boolSetting
+	durationSetting
+	listSetting
+)
+
+// configSetting maps a dotted path in the config file to the flag it provides a default for
+type configSetting struct {
+	path, flag string
+	kind       settingKind
+	check      func(string) error
+}
+
+var configSettings = []configSetting{
+	{path: "hostname", flag: "hostname"},
+	{path: "port", flag: "port", kind: intSetting},
+	{path: "listen", flag: "listen", kind: listSetting, check: checkListenSpec},
+	{path: "profiles", flag: "profiles", kind: pathSetting},
+	{path: "http.port", flag: "httpport", kind: intSetting},
+	{path: "api.port", flag: "api", kind: intSetting},
+	{path: "api.auth", flag: "apiauth", kind: pathSetting},
+	{path: "api.cert", flag: "apicert", kind: pathSetting},
+	{path: "api.key", flag: "apikey", kind: pathSetting},
+	{path: "api.clientca", flag: "apiclientca", kind: pathSetting},
+	{path: "api.admindomain", flag: "admindomain"},
+	{path: "blocking.file", flag: "blockfile", kind: pathSetting},
+	{path: "blocking.allowiponly", flag: "allowiponly", kind: boolSetting},
+	{path: "blocking.inspectsni", flag: "inspectsni", kind: boolSetting},
+	{path: "blocking.strictsni", flag: "strictsni", kind: boolSetting},
+	{path: "blocking.blockpage", flag: "blockpage", kind: boolSetting},
+	{path: "blocking.unblockurl", flag: "unblockurl"},
+	{path: "blocking.bindpolicy", flag: "bindpolicy", check: checkCommandPolicy},
+	{path: "blocking.udppolicy", flag: "udppolicy", check: checkCommandPolicy},
+	{path: "blocking.sources", flag: "blocksources", kind: pathSetting},
+	{path: "blocking.sourcecache", flag: "blocksourcecache", kind: pathSetting},
+	{path: "dns.file", flag: "dns", kind: pathSetting},
+	{path: "upstreams", flag: "upstreams", kind: pathSetting},
+	{path: "logging.accepted", flag: "acceptlogging", kind: boolSetting},
+	{path: "logging.blocked", flag: "blockedlogging", kind: boolSetting},
+	{path: "logging.discarderrors", flag: "discarderrlogging", kind: boolSetting},
+	{path: "logging.histogram.store", flag: "histlogger", kind: pathSetting},
+	{path: "logging.histogram.hourlyretention", flag: "histhourlyretention", kind: durationSetting},
+	{path: "logging.histogram.dailyretention", flag: "histdailyretention", kind: durationSetting},
+	{path: "logging.syslog.target", flag: "syslog"},
+	{path: "logging.syslog.facility", flag: "syslogfacility"},
+	{path: "logging.webhook.url", flag: "webhook"},
+	{path: "logging.webhook.spool", flag: "webhookspool", kind: pathSetting},
+	{path: "logging.webhook.spoolmax", flag: "webhookspoolmax", kind: intSetting},
+	{path: "logging.alertrules", flag: "alertrules", kind: pathSetting},
+	{path: "limits.maxconns", flag: "maxconns", kind: intSetting},
+	{path: "limits.maxconnsperclient", flag: "maxconnsperclient", kind: intSetting},
+	{path: "limits.handshaketimeout", flag: "handshaketimeout", kind: durationSetting},
+	{path: "limits.idletimeout", flag: "idletimeout", kind: durationSetting},
+	{path: "limits.maxtunnelduration", flag: "maxtunnelduration", kind: durationSetting},
+	{path: "limits.draintimeout", flag: "draintimeout", kind: durationSetting},
+}
+
+// inline sections decoded into proxyConfig rather than passed on as flags
+const (
+	blockListsSection   = "blocking.lists"
+	blockSourcesSection = "blocking.sources"
+	dnsOverridesSection = "dns.overrides"
+	apiClientsSection   = "api.clients"
+	profilesSection     = "profiles"
+)
+
+type proxyConfig struct {
+	fname string
+	// internal
+	values       []configValue
+	blockLists   map[string][]string
+	blockSources []blockListSourceConfig
+	dnsOverrides []dnsOverride
+	apiClients   []apiClient
+	profiles     map[string]policyProfileConfig
+	profileLines map[string]int
+	// blocking.file, if set, for checking profiles
+	blockFile     string
+	blockFileLine int
+	// blocking.sources, if it names a file, for checking profiles
+	blockSourcesFile     string
+	blockSourcesFileLine int
+}
+
+type configValue struct {
+	setting *configSetting
+	values  []string
+	line    int
+}
+
+// configError is a problem found on a line of the config file
+type configError struct {
+	line int
+	msg  string
+}
+
+// configErrors lists every problem found in a config file, one per line as file:line: message
+type configErrors struct {
+	fname  string
+	errors []configError
+}
+
+func (e *configErrors) add(line int, format string, args ...interface{}) {
+	e.errors = append(e.errors, configError{line: line, msg: fmt.Sprintf(format, args...)})
+}
+
+var yamlErrorLine = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// addYAML records the errors from the yaml package under their own line numbers
+func (e *configErrors) addYAML(err error, line int) {
+	var msgs []string
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		msgs = typeErr.Errors
+	} else {
+		msgs = []string{err.Error()}
+	}
+	for _, msg := range msgs {
+		if m := yamlErrorLine.FindStringSubmatch(msg); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			e.add(n, "%s", m[2])
+			continue
+		}
+		e.add(line, "%s", strings.TrimPrefix(msg, "yaml: "))
+	}
+}
+
+func (e *configErrors) Error() string {
+	sort.SliceStable(e.errors, func(i, j int) bool {
+		return e.errors[i].line < e.errors[j].line
+	})
+	lines := make([]string, 0, len(e.errors))
+	for _, v := range e.errors {
+		lines = append(lines, fmt.Sprintf("%s:%d: %s", e.fname, v.line, v.msg))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// loadProxyConfig reads and checks fname. When the file is invalid the error is a
+// *configErrors listing every problem found.
+func loadProxyConfig(fname string) (*proxyConfig, error) {
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	result, errs := parseProxyConfig(fname, contents)
+	if len(errs.errors) > 0 {
+		return nil, errs
+	}
+	return result, nil
+}
+
+// parseProxyConfig returns whatever could be understood of contents along with the problems
+func parseProxyConfig(fname string, contents []byte) (*proxyConfig, *configErrors) {
+	result := &proxyConfig{fname: fname}
+	errs := &configErrors{fname: fname}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(contents, &doc); err != nil {
+		errs.addYAML(err, 1)
+		return result, errs
+	}
+	if len(doc.Content) > 0 {
+		result.walk("", doc.Content[0], errs)
+	}
+	return result, errs
+}
+
+func (c *proxyConfig) walk(prefix string, node *yaml.Node, errs *configErrors) {
+	if node.Kind != yaml.MappingNode {
+		if prefix == "" {
+			errs.add(node.Line, "expected a mapping of settings")
+		} else {
+			errs.add(node.Line, "%s: expected a mapping of settings", prefix)
+		}
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		path := k.Value
+		if prefix != "" {
+			path = prefix + "." + k.Value
+		}
+		switch {
+		case path == blockListsSection:
+			c.decodeBlockLists(v, errs)
+		case path == dnsOverridesSection:
+			c.decodeDNSOverrides(v, errs)
+		case path == apiClientsSection:
+			c.decodeAPIClients(v, errs)
+		case path == blockSourcesSection && v.Kind == yaml.SequenceNode:
+			c.decodeBlockSources(v, errs)
+		case path == profilesSection && v.Kind == yaml.MappingNode:
+			c.decodeProfiles(v, errs)
+		case findConfigSetting(path) != nil:
+			c.decodeSetting(findConfigSetting(path), v, errs)
+		case v.Kind == yaml.MappingNode && isConfigSection(path):
+			c.walk(path, v, errs)
+		default:
+			errs.add(k.Line, "unknown setting %s", path)
+		}
+	}
+}
+
+func findConfigSetting(path string) *configSetting {
+	for i := range configSettings {
+		if configSettings[i].path == path {
+			return &configSettings[i]
+		}
+	}
+	return nil
+}
+
+func isConfigSection(path string) bool {
+	for _, s := range configSettings {
+		if strings.HasPrefix(s.path, path+".") {
+			return true
+		}
+	}
+	for _, s := range []string{blockListsSection, dnsOverridesSection, apiClientsSection} {
+		if strings.HasPrefix(s, path+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *proxyConfig) decodeSetting(s *configSetting, node *yaml.Node, errs *configErrors) {
+	var nodes []*yaml.Node
+	switch {
+	case s.kind == listSetting && node.Kind == yaml.SequenceNode:
+		nodes = node.Content
+	case node.Kind == yaml.ScalarNode:
+		nodes = []*yaml.Node{node}
+	default:
+		errs.add(node.Line, "%s: expected a single value", s.path)
+		return
+	}
+	result := configValue{setting: s, line: node.Line}
+	for _, n := range nodes {
+		if n.Kind != yaml.ScalarNode {
+			errs.add(n.Line, "%s: expected a single value", s.path)
+			continue
+		}
+		v := n.Value
+		if err := checkSettingValue(s, v); err != nil {
+			errs.add(n.Line, "%s: %v", s.path, err)
+			continue
+		}
+		switch {
+		case s.kind == pathSetting:
+			v = c.resolvePath(v)
+		case s.flag == "listen":
+			v = c.resolveListenSpec(v)
+		}
+		switch s.flag {
+		case "blockfile":
+			c.blockFile, c.blockFileLine = v, n.Line
+		case "blocksources":
+			c.blockSourcesFile, c.blockSourcesFileLine = v, n.Line
+		}
+		result.values = append(result.values, v)
+	}
+	c.values = append(c.values, result)
+}
+
+func checkSettingValue(s *configSetting, v string) error {
+	var err error
+	switch s.kind {
+	case intSetting:
+		_, err = strconv.ParseInt(v, 10, 64)
+	case boolSetting:
+		_, err = strconv.ParseBool(v)
+	case durationSetting:
+		_, err = time.ParseDuration(v)
+	}
+	if err != nil {
+		return fmt.Errorf("invalid value %q", v)
+	}
+	if s.check != nil {
+		return s.check(v)
+	}
+	return nil
+}
+
+// resolvePath makes a relative path, optionally behind a scheme such as sqlite://, relative to
+// the directory of the config file
+func (c *proxyConfig) resolvePath(v string) string {
+	scheme := ""
+	if i := strings.Index(v, "://"); i >= 0 {
+		scheme, v = v[:i+3], v[i+3:]
+	}
+	if v == "" || filepath.IsAbs(v) {
+		return scheme + v
+	}
+	return scheme + filepath.Join(filepath.Dir(c.fname), v)
+}
+
+// resolveListenSpec resolves the path of a unix socket like any other path
+func (c *proxyConfig) resolveListenSpec(v string) string {
+	spec, err := parseListenSpec(v)
+	if err != nil || spec.network != "unix" {
+		return v
+	}
+	spec.address = c.resolvePath(spec.address)
+	return spec.String()
+}
+
+func checkListenSpec(v string) error {
+	_, err := parseListenSpec(v)
+	return err
+}
+
+func checkCommandPolicy(v string) error {
+	_, err := forwardproxy.ParseCommandPolicy(v)
+	return err
+}
+
+func (c *proxyConfig) decodeBlockLists(node *yaml.Node, errs *configErrors) {
+	if err := node.Decode(&c.blockLists); err != nil {
+		errs.addYAML(err, node.Line)
+	}
+}
+
+func (c *proxyConfig) decodeBlockSources(node *yaml.Node, errs *configErrors) {
+	for _, n := range node.Content {
+		var source blockListSourceConfig
+		if err := n.Decode(&source); err != nil {
+			errs.addYAML(err, n.Line)
+			continue
+		}
+		if err := source.normalise(); err != nil {
+			errs.add(n.Line, "%s: %s: %v", blockSourcesSection, source.URL, err)
+			continue
+		}
+		c.blockSources = append(c.blockSources, source)
+	}
+}
+
+func (c *proxyConfig) decodeDNSOverrides(node *yaml.Node, errs *configErrors) {
+	if node.Kind != yaml.MappingNode {
+		errs.add(node.Line, "%s: expected a mapping of names to IP addresses", dnsOverridesSection)
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		if !validDomainPattern(k.Value) {
+			errs.add(k.Line, "%s: invalid name %q", dnsOverridesSection, k.Value)
+			continue
+		}
+		if v.Kind != yaml.ScalarNode || net.ParseIP(v.Value) == nil {
+			errs.add(v.Line, "%s: invalid IP address for %s", dnsOverridesSection, k.Value)
+			continue
+		}
+		c.dnsOverrides = append(c.dnsOverrides, dnsOverride{FQDN: k.Value, IP: v.Value})
+	}
+}
+
+func (c *proxyConfig) decodeAPIClients(node *yaml.Node, errs *configErrors) {
+	if node.Kind != yaml.SequenceNode {
+		errs.add(node.Line, "%s: expected a list of clients", apiClientsSection)
+		return
+	}
+	for _, n := range node.Content {
+		var client apiClient
+		if err := n.Decode(&client); err != nil {
+			errs.addYAML(err, n.Line)
+			continue
+		}
+		if err := client.validate(); err != nil {
+			errs.add(n.Line, "%s: %s: %v", apiClientsSection, client.Name, err)
+			continue
+		}
+		c.apiClients = append(c.apiClients, client)
+	}
+}
+
+func (c *proxyConfig) decodeProfiles(node *yaml.Node, errs *configErrors) {
+	c.profiles = make(map[string]policyProfileConfig)
+	c.profileLines = make(map[string]int)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		k, v := node.Content[i], node.Content[i+1]
+		var cfg policyProfileConfig
+		if err := v.Decode(&cfg); err != nil {
+			errs.addYAML(err, v.Line)
+			continue
+		}
+		c.profiles[k.Value] = cfg
+		c.profileLines[k.Value] = k.Line
+	}
+}
+
+// runtimeBlockFile is the block file the proxy loads with this config when --blockfile is
+// not given: FQDN_BLOCK_FILE, then blocking.file, then none when the lists are inline and
+// otherwise the flag's default
+func (c *proxyConfig) runtimeBlockFile() string {
+	switch {
+	case os.Getenv("FQDN_BLOCK_FILE") != "":
+		return os.Getenv("FQDN_BLOCK_FILE")
+	case c.blockFile != "":
+		return c.blockFile
+	case len(c.blockLists) > 0:
+		return ""
+	}
+	return defaultBlockFile
+}
+
+// checkBlockLists checks the inline profiles against the block lists that will be loaded:
+// those written inline, those in blockFile and the remote sources
+func (c *proxyConfig) checkBlockLists(blockFile string, errs *configErrors) {
+	known := make(map[string]int)
+	for name := range c.blockLists {
+		known[name] = 0
+	}
+	for _, source := range c.blockSources {
+		known[source.Name] = 0
+	}
+	if c.blockSourcesFile != "" {
+		sources, err := blockListSourcesFromFile(c.blockSourcesFile)
+		if err != nil {
+			errs.add(c.blockSourcesFileLine, "%s: %v", blockSourcesSection, err)
+			return
+		}
+		for _, source := range sources {
+			if err := source.normalise(); err != nil {
+				errs.add(c.blockSourcesFileLine, "%s: %s: %v", blockSourcesSection, source.URL, err)
+				continue
+			}
+			known[source.Name] = 0
+		}
+	}
+	if blockFile != "" {
+		lists, err := blockListsFromFile(blockFile)
+		if err != nil {
+			if c.blockFile == "" {
+				errs.add(0, "blocking.file not set and the default is unusable: %v", err)
+				return
+			}
+			errs.add(c.blockFileLine, "blocking.file: %v", err)
+			return
+		}
+		for name := range lists {
+			known[name] = 0
+		}
+	}
+	for name, cfg := range c.profiles {
+		if err := cfg.validate(known); err != nil {
+			errs.add(c.profileLines[name], "profile %s: %v", name, err)
+		}
+	}
+}
+
+// policyProfiles builds the inline profiles, reporting problems at their line in the file
+func (c *proxyConfig) policyProfiles(knownLists map[string]int) (map[string]*forwardproxy.PolicyProfile, error) {
+	errs := &configErrors{fname: c.fname}
+	for name, cfg := range c.profiles {
+		if err := cfg.validate(knownLists); err != nil {
+			errs.add(c.profileLines[name], "profile %s: %v", name, err)
+		}
+	}
+	if len(errs.errors) > 0 {
+		return nil, errs
+	}
+	return newPolicyProfiles(c.profiles, knownLists)
+}
+
+// applyTo sets every flag the command line and environment left unset to its value from
+// the config file
+func (c *proxyConfig) applyTo(cCtx *cli.Context) error {
+	for _, v := range c.values {
+		if cCtx.IsSet(v.setting.flag) {
+			continue
+		}
+		for _, value := range v.values {
+			if err := cCtx.Set(v.setting.flag, value); err != nil {
+				return fmt.Errorf("%s:%d: %s: %w", c.fname, v.line, v.setting.path, err)
+			}
+		}
+	}
+	return nil
+}
+
+// configCommand holds subcommands that work on a --config file without starting the proxy
+func configCommand() *cli.Command {
+	var fname string
+	return &cli.Command{
+		Name:  "config",
+		Usage: "work with the --config file",
+		Subcommands: []*cli.Command{
+			{
+				Name:      "validate",
+				Usage:     "check a config file and report problems with their line numbers",
+				ArgsUsage: "[file]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:        "config",
+						EnvVars:     []string{"FORWARD_PROXY_CONFIG"},
+						Destination: &fname,
+					},
+				},
+				Action: func(cCtx *cli.Context) error {
+					if cCtx.Args().Present() {
+						fname = cCtx.Args().First()
+					}
+					if fname == "" {
+						return errors.New("no config file given")
+					}
+					contents, err := os.ReadFile(fname)
+					if err != nil {
+						return err
+					}
+					cfg, errs := parseProxyConfig(fname, contents)
+					cfg.checkBlockLists(cfg.runtimeBlockFile(), errs)
+					if len(errs.errors) > 0 {
+						return cli.Exit(errs.Error(), 1)
+					}
+					fmt.Printf("%s: ok\n", fname)
+					return nil
+				},
+			},
+		},
+	}
+}
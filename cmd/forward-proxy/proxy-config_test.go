@@ -0,0 +1,104 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseProxyConfigReportsLines(t *testing.T) {
+	contents := `listen: [127.0.0.1:1080]
+api:
+  port: 8080
+  colour: blue
+  clients:
+    - {name: admin, access: write}
+blocking:
+  udppolicy: sometimes
+`
+	_, errs := parseProxyConfig("proxy.yml", []byte(contents))
+	want := []string{
+		"proxy.yml:4: unknown setting api.colour",
+		"proxy.yml:6: api.clients: admin: missing token or commonname",
+		"proxy.yml:8: blocking.udppolicy:",
+	}
+	got := strings.Split(errs.Error(), "\n")
+	if len(got) != len(want) {
+		t.Fatalf("errors:\n%s", errs)
+	}
+	for i := range want {
+		if !strings.HasPrefix(got[i], want[i]) {
+			t.Errorf("error %d = %q, want %q...", i, got[i], want[i])
+		}
+	}
+}
+
+func TestProxyConfigPolicyProfiles(t *testing.T) {
+	contents := `profiles:
+  open: {unfiltered: true}
+  kids:
+    lists: [adult]
+`
+	cfg, errs := parseProxyConfig("proxy.yml", []byte(contents))
+	if len(errs.errors) > 0 {
+		t.Fatal(errs)
+	}
+	profiles, err := cfg.policyProfiles(map[string]int{"adult": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(profiles) != 2 || !profiles["open"].Unfiltered || profiles["kids"].Lists[0] != "adult" {
+		t.Errorf("profiles = %v", profiles)
+	}
+	_, err = cfg.policyProfiles(map[string]int{})
+	if err == nil || err.Error() != "proxy.yml:3: profile kids: unknown block list adult" {
+		t.Errorf("error = %v", err)
+	}
+}
+
+func TestProxyConfigCheckBlockLists(t *testing.T) {
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the default block file is relative to the working directory, like the flag's
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	t.Setenv("FQDN_BLOCK_FILE", "")
+	profile := "profiles:\n  kids:\n    lists: [adult]\n"
+	check := func(contents string) string {
+		cfg, errs := parseProxyConfig(filepath.Join(dir, "proxy.yml"), []byte(contents))
+		cfg.checkBlockLists(cfg.runtimeBlockFile(), errs)
+		if len(errs.errors) == 0 {
+			return ""
+		}
+		return errs.Error()
+	}
+
+	if got := check(profile); !strings.Contains(got, "blocking.file not set and the default is unusable") {
+		t.Errorf("missing default block file: %q", got)
+	}
+	if got := check("blocking:\n  lists:\n    adult: [bad.com]\n" + profile); got != "" {
+		t.Errorf("inline lists: %q", got)
+	}
+	if err := os.WriteFile(defaultBlockFile, []byte("blocklist:\n  ads: [ads.com]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := check(profile); !strings.Contains(got, "proxy.yml:2: profile kids: unknown block list adult") {
+		t.Errorf("list missing from the default block file: %q", got)
+	}
+	if err := os.WriteFile("other.yml", []byte("blocklist:\n  adult: [bad.com]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got := check("blocking:\n  file: other.yml\n" + profile); got != "" {
+		t.Errorf("blocking.file: %q", got)
+	}
+	t.Setenv("FQDN_BLOCK_FILE", filepath.Join(dir, "other.yml"))
+	if got := check(profile); got != "" {
+		t.Errorf("FQDN_BLOCK_FILE: %q", got)
+	}
+}
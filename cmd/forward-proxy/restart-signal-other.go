@@ -0,0 +1,8 @@
+//go:build !unix
+
+package main
+
+import "os"
+
+// restartSignals is empty where listening sockets can't be passed to a child process
+var restartSignals []os.Signal
@@ -0,0 +1,11 @@
+//go:build unix
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// restartSignals ask a running proxy to hand its listeners over to a new process
+var restartSignals = []os.Signal{syscall.SIGUSR2}
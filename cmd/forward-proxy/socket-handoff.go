@@ -0,0 +1,260 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Listening sockets are passed to a restarted process as extra files starting at fd 3, named
+// in order by listenFDsEnv. systemd socket activation passes them the same way, described by
+// LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES (set FileDescriptorName= to socks, http or api).
+const (
+	listenFDsEnv        = "FORWARD_PROXY_LISTEN_FDS"
+	readyFDEnv          = "FORWARD_PROXY_READY_FD"
+	firstListenFD       = 3
+	handoffReadyTimeout = 30 * time.Second
+)
+
+const (
+	socksListenerName = "socks"
+	httpListenerName  = "http"
+	apiListenerName   = "api"
+)
+
+// listenerSet hands out listening sockets, taking over those inherited from a parent process
+// or systemd before opening new ones, and remembers them so they can be passed on. Several
+// listeners may share a name; they are handed out in the order they were passed.
+type listenerSet struct {
+	inherited map[string][]net.Listener
+	// fromParent is set when the listeners came from a handoff rather than from systemd,
+	// which keeps the unix socket files it created
+	fromParent bool
+	// internal
+	names  []string
+	opened []net.Listener
+}
+
+// inheritListeners picks up listening sockets passed by a parent process or by systemd
+func inheritListeners() (*listenerSet, error) {
+	result := &listenerSet{
+		inherited: make(map[string][]net.Listener),
+	}
+	names, fromParent, err := inheritedListenerNames()
+	if err != nil {
+		return nil, err
+	}
+	result.fromParent = fromParent
+	for i, name := range names {
+		f := os.NewFile(uintptr(firstListenFD+i), name)
+		l, err := net.FileListener(f)
+		f.Close()
+		if err != nil {
+			result.close()
+			return nil, fmt.Errorf("unable to use inherited %s listener: %w", name, err)
+		}
+		if ul, ok := l.(*net.UnixListener); ok && fromParent {
+			ul.SetUnlinkOnClose(true)
+		}
+		result.inherited[name] = append(result.inherited[name], l)
+	}
+	return result, nil
+}
+
+// inheritedListenerNames returns the names of the listeners from fd 3 onwards, and whether
+// they came from a parent process, and clears the environment that described them so it
+// isn't passed on by accident
+func inheritedListenerNames() ([]string, bool, error) {
+	if v := os.Getenv(listenFDsEnv); v != "" {
+		os.Unsetenv(listenFDsEnv)
+		return strings.Split(v, ":"), true, nil
+	}
+	names, err := systemdListenerNames()
+	return names, false, err
+}
+
+func systemdListenerNames() ([]string, error) {
+	pid, fds := os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS")
+	if fds == "" || pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	fdNames := os.Getenv("LISTEN_FDNAMES")
+	for _, k := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		os.Unsetenv(k)
+	}
+	n, err := strconv.Atoi(fds)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", fds)
+	}
+	names := strings.Split(fdNames, ":")
+	if fdNames == "" || len(names) != n {
+		// without names a single socket can only be meant for SOCKS5
+		if n == 1 {
+			return []string{socksListenerName}, nil
+		}
+		return nil, errors.New("systemd passed several sockets without names: set FileDescriptorName= to socks, http or api")
+	}
+	for _, name := range names {
+		switch name {
+		case socksListenerName, httpListenerName, apiListenerName:
+		default:
+			if n == 1 {
+				return []string{socksListenerName}, nil
+			}
+			return nil, fmt.Errorf("unknown systemd socket name %q: set FileDescriptorName= to socks, http or api", name)
+		}
+	}
+	return names, nil
+}
+
+// listen returns the next inherited listener called name or else listens on address
+func (s *listenerSet) listen(name, network, address string) (net.Listener, error) {
+	return s.listenOn(name, listenSpec{network: network, address: address})
+}
+
+// listenOn is listen for a listen spec, which may carry the mode of a unix socket
+func (s *listenerSet) listenOn(name string, spec listenSpec) (net.Listener, error) {
+	var l net.Listener
+	if inherited := s.inherited[name]; len(inherited) > 0 {
+		l, s.inherited[name] = inherited[0], inherited[1:]
+		log.Printf("using inherited %s listener on %s", name, l.Addr())
+	} else {
+		var err error
+		if spec.network == "unix" {
+			l, err = listenUnix(spec.address, spec.mode)
+		} else {
+			l, err = net.Listen(spec.network, spec.address)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.names = append(s.names, name)
+	s.opened = append(s.opened, l)
+	if l.Addr().Network() == "unix" {
+		return &unixPeerListener{Listener: l}, nil
+	}
+	return l, nil
+}
+
+// closeUnused closes inherited listeners that the configuration no longer asks for
+func (s *listenerSet) closeUnused() {
+	for name, inherited := range s.inherited {
+		for _, l := range inherited {
+			log.Printf("closing inherited %s listener on %s: not configured", name, l.Addr())
+			l.Close()
+		}
+		delete(s.inherited, name)
+	}
+}
+
+func (s *listenerSet) close() {
+	s.closeUnused()
+	for _, l := range s.opened {
+		l.Close()
+	}
+}
+
+// handoff starts a new copy of this executable with the same arguments, passing it the
+// listening sockets, and waits until it is ready to serve. The sockets stay open here so
+// both processes accept until the caller stops.
+func (s *listenerSet) handoff() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	for i, name := range s.names {
+		fl, ok := s.opened[i].(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("%s listener can't be passed on", name)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return fmt.Errorf("unable to pass on %s listener: %w", name, err)
+		}
+		files = append(files, f)
+	}
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+	cmd.ExtraFiles = append(files, readyW)
+	cmd.Env = append(environWithout(listenFDsEnv, readyFDEnv, "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"),
+		listenFDsEnv+"="+strings.Join(s.names, ":"),
+		fmt.Sprintf("%s=%d", readyFDEnv, firstListenFD+len(files)),
+	)
+	err = cmd.Start()
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+	// the child closes its end once serving, or dies; either way the read returns
+	ready.SetReadDeadline(time.Now().Add(handoffReadyTimeout))
+	buf := make([]byte, 1)
+	if _, err := ready.Read(buf); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return fmt.Errorf("new process not ready after %s", handoffReadyTimeout)
+		}
+		return errors.New("new process exited before it was ready")
+	}
+	for _, l := range s.opened {
+		if ul, ok := l.(*net.UnixListener); ok {
+			// the socket file now belongs to the new process
+			ul.SetUnlinkOnClose(false)
+		}
+	}
+	log.Printf("handed listeners over to new process %d", cmd.Process.Pid)
+	go cmd.Wait()
+	return nil
+}
+
+// signalReady tells the parent that handed over the listeners that this process is serving
+func signalReady() {
+	v := os.Getenv(readyFDEnv)
+	if v == "" {
+		return
+	}
+	os.Unsetenv(readyFDEnv)
+	fd, err := strconv.Atoi(v)
+	if err != nil {
+		log.Printf("invalid %s: %q", readyFDEnv, v)
+		return
+	}
+	f := os.NewFile(uintptr(fd), "ready")
+	f.Write([]byte{1})
+	f.Close()
+}
+
+func environWithout(keys ...string) []string {
+	var result []string
+	for _, kv := range os.Environ() {
+		drop := false
+		for _, k := range keys {
+			if strings.HasPrefix(kv, k+"=") {
+				drop = true
+				break
+			}
+		}
+		if !drop {
+			result = append(result, kv)
+		}
+	}
+	return result
+}
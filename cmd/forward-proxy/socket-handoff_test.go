@@ -0,0 +1,133 @@
+//go:build unix
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// handoffChildEnv makes TestHandoffChild act as the process listeners are handed to
+const handoffChildEnv = "FORWARD_PROXY_TEST_HANDOFF_CHILD"
+
+// TestListenerHandoff passes a TCP and a unix listener to a new copy of the test binary and
+// checks that connections to both are then answered by the child
+func TestListenerHandoff(t *testing.T) {
+	set := &listenerSet{inherited: make(map[string][]net.Listener)}
+	tcp, err := set.listen(socksListenerName, "tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if _, err := set.listen(httpListenerName, "unix", path); err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv(handoffChildEnv, "1")
+	args, stdout := os.Args, os.Stdout
+	os.Args = []string{args[0], "-test.run=^TestHandoffChild$"}
+	if devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0); err == nil {
+		// keep the child's test report out of ours
+		os.Stdout = devNull
+		defer devNull.Close()
+	}
+	err = set.handoff()
+	os.Args, os.Stdout = args, stdout
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the parent stops accepting; the unix socket file must survive for the child
+	set.close()
+
+	for _, target := range []struct{ network, address, want string }{
+		{"tcp", tcp.Addr().String(), socksListenerName},
+		{"unix", path, httpListenerName},
+	} {
+		c, err := net.Dial(target.network, target.address)
+		if err != nil {
+			t.Fatalf("dial %s: %v", target.want, err)
+		}
+		c.SetDeadline(time.Now().Add(5 * time.Second))
+		got, err := io.ReadAll(c)
+		c.Close()
+		if err != nil || string(got) != target.want {
+			t.Errorf("%s listener answered %q, %v", target.want, got, err)
+		}
+	}
+}
+
+func TestHandoffChild(t *testing.T) {
+	if os.Getenv(handoffChildEnv) == "" {
+		t.Skip("run by TestListenerHandoff")
+	}
+	time.AfterFunc(10*time.Second, func() { os.Exit(2) })
+	set, err := inheritListeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !set.fromParent {
+		t.Fatal("listeners not marked as handed over")
+	}
+	var wg sync.WaitGroup
+	for _, name := range []string{socksListenerName, httpListenerName} {
+		if len(set.inherited[name]) != 1 {
+			t.Fatalf("%s listener not inherited", name)
+		}
+		l, err := set.listen(name, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			io.WriteString(c, name)
+			c.Close()
+		}(name)
+	}
+	signalReady()
+	wg.Wait()
+	set.close()
+}
+
+func TestSystemdListenerNames(t *testing.T) {
+	pid := os.Getpid()
+	tests := []struct {
+		fds, names string
+		want       []string
+		wantErr    bool
+	}{
+		{"1", "", []string{socksListenerName}, false},
+		{"2", "socks:api", []string{socksListenerName, apiListenerName}, false},
+		{"2", "", nil, true},
+		{"2", "socks:ftp", nil, true},
+		{"x", "", nil, true},
+	}
+	for _, tt := range tests {
+		t.Setenv("LISTEN_PID", strconv.Itoa(pid))
+		t.Setenv("LISTEN_FDS", tt.fds)
+		t.Setenv("LISTEN_FDNAMES", tt.names)
+		got, err := systemdListenerNames()
+		if (err != nil) != tt.wantErr || !equalStrings(got, tt.want) {
+			t.Errorf("LISTEN_FDS=%s LISTEN_FDNAMES=%s: %v, %v", tt.fds, tt.names, got, err)
+		}
+		if os.Getenv("LISTEN_FDS") != "" {
+			t.Error("LISTEN_FDS left in the environment")
+		}
+	}
+	// sockets meant for another process are ignored
+	t.Setenv("LISTEN_PID", strconv.Itoa(pid+1))
+	t.Setenv("LISTEN_FDS", "1")
+	if got, err := systemdListenerNames(); got != nil || err != nil {
+		t.Errorf("foreign LISTEN_PID: %v, %v", got, err)
+	}
+}
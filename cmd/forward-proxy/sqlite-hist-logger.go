@@ -0,0 +1,565 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	_ "modernc.org/sqlite"
+)
+
+var (
+	sqliteFlushFrequency = time.Second
+	// failed flushes are retried after sqliteFlushFrequency, doubling up to this
+	sqliteMaxRetryBackoff = time.Minute
+	// events held while the database is failing; later ones are dropped until it recovers
+	maxSQLitePendingEvents = 100 * maxEventBatch
+)
+
+const (
+	blockedHistKind  = "blocked"
+	acceptedHistKind = "accepted"
+	hourlyBucketName = "hour"
+	dailyBucketName  = "day"
+)
+
+var sqliteHistSchema = []string{
+	`CREATE TABLE IF NOT EXISTS fqdn (
+		kind TEXT NOT NULL,
+		fqdn TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		first_seen INTEGER,
+		last_seen INTEGER,
+		PRIMARY KEY (kind, fqdn)
+	)`,
+	`CREATE INDEX IF NOT EXISTS fqdn_by_count ON fqdn (kind, count DESC)`,
+	`CREATE TABLE IF NOT EXISTS fqdn_bucket (
+		kind TEXT NOT NULL,
+		fqdn TEXT NOT NULL,
+		size TEXT NOT NULL,
+		start INTEGER NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (kind, fqdn, size, start)
+	)`,
+	`CREATE INDEX IF NOT EXISTS fqdn_bucket_by_start ON fqdn_bucket (kind, size, start)`,
+	`CREATE TABLE IF NOT EXISTS fqdn_list (
+		kind TEXT NOT NULL,
+		fqdn TEXT NOT NULL,
+		list TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (kind, fqdn, list)
+	)`,
+	`CREATE INDEX IF NOT EXISTS fqdn_list_by_list ON fqdn_list (list, kind)`,
+	`CREATE TABLE IF NOT EXISTS fqdn_client (
+		kind TEXT NOT NULL,
+		fqdn TEXT NOT NULL,
+		client TEXT NOT NULL,
+		count INTEGER NOT NULL,
+		PRIMARY KEY (kind, fqdn, client)
+	)`,
+	`CREATE INDEX IF NOT EXISTS fqdn_client_by_client ON fqdn_client (client, kind)`,
+}
+
+// sqliteHistLogger stores the histogram in SQLite as per-FQDN totals plus hourly/daily
+// bucket rows. Like fHistLogger it never blocks the caller: events are queued, aggregated
+// in memory and flushed in a single transaction every sqliteFlushFrequency.
+type sqliteHistLogger struct {
+	db        *sql.DB
+	retention histRetention
+	// internal
+	events    chan forwardproxy.HistEvent
+	resets    chan requestMessage[histReset, int]
+	dropped   atomic.Uint64
+	stop      context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
+	abandoned atomic.Bool
+}
+
+func newSQLiteHistLogger(path string, retention histRetention) (*sqliteHistLogger, error) {
+	db, err := openSQLiteHistDB(path)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result := &sqliteHistLogger{
+		db:        db,
+		retention: retention,
+		events:    make(chan forwardproxy.HistEvent, maxEventBuffer),
+		resets:    make(chan requestMessage[histReset, int]),
+		stop:      cancel,
+		done:      make(chan struct{}),
+	}
+	go result.run(ctx)
+	log.Printf("Histogram logger using SQLite database %s", path)
+	return result, nil
+}
+
+func openSQLiteHistDB(path string) (*sql.DB, error) {
+	if path == "" {
+		return nil, errors.New("missing sqlite database path")
+	}
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection keeps pragmas in effect and serialises writers
+	db.SetMaxOpenConns(1)
+	for _, stmt := range append([]string{
+		`PRAGMA journal_mode = WAL`,
+		`PRAGMA synchronous = NORMAL`,
+		`PRAGMA busy_timeout = 5000`,
+	}, sqliteHistSchema...) {
+		if _, err := db.Exec(stmt); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("unable to prepare sqlite database %s: %w", path, err)
+		}
+	}
+	return db, nil
+}
+
+func (shl *sqliteHistLogger) LogAccepted(fqdn string) {
+	shl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn})
+}
+
+func (shl *sqliteHistLogger) LogBlocked(fqdn string) {
+	shl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn, Blocked: true})
+}
+
+// LogEvent implements forwardproxy.HistEventLogger and never blocks
+func (shl *sqliteHistLogger) LogEvent(ev forwardproxy.HistEvent) {
+	select {
+	case shl.events <- ev:
+	default:
+		shl.dropped.Add(1)
+	}
+}
+
+func (shl *sqliteHistLogger) Close() error {
+	shl.closeOnce.Do(func() {
+		shl.stop()
+		<-shl.done
+		shl.closeErr = shl.db.Close()
+	})
+	return shl.closeErr
+}
+
+// abandon closes the database without flushing the queued events, as another process has
+// taken the database over
+func (shl *sqliteHistLogger) abandon() {
+	shl.abandoned.Store(true)
+	shl.Close()
+}
+
+func (shl *sqliteHistLogger) run(ctx context.Context) {
+	defer close(shl.done)
+	batch := newHistBatch()
+	var reportedDropped uint64
+	lastPruned := time.Time{}
+	var retryAt time.Time
+	backoff := sqliteFlushFrequency
+	flush := func(now time.Time) {
+		if batch.size == 0 || now.Before(retryAt) {
+			return
+		}
+		if err := shl.flush(batch); err != nil {
+			// the batch is kept and retried once the backoff has passed
+			retryAt = now.Add(backoff)
+			log.Printf("Error writing to sqlite histogram logger, retrying %d events in %v: %v", batch.size, backoff, err)
+			if backoff *= 2; backoff > sqliteMaxRetryBackoff {
+				backoff = sqliteMaxRetryBackoff
+			}
+			return
+		}
+		batch = newHistBatch()
+		retryAt = time.Time{}
+		backoff = sqliteFlushFrequency
+	}
+	add := func(ev forwardproxy.HistEvent) {
+		if batch.size >= maxSQLitePendingEvents {
+			shl.dropped.Add(1)
+			return
+		}
+		batch.add(ev)
+	}
+	ticker := time.NewTicker(sqliteFlushFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-shl.events:
+			add(ev)
+			if batch.size >= maxEventBatch {
+				flush(time.Now())
+			}
+		case msg := <-shl.resets:
+			// events logged before the reset must not come back with a later flush
+			for len(shl.events) > 0 {
+				add(<-shl.events)
+			}
+			removed, err := shl.reset(msg.req, batch)
+			msg.resp <- responsePayloadWithError[int]{payload: removed, err: err}
+		case now := <-ticker.C:
+			flush(now)
+			if dropped := shl.dropped.Load(); dropped != reportedDropped {
+				log.Printf("Histogram logger dropped %d events under backpressure (%d total)", dropped-reportedDropped, dropped)
+				reportedDropped = dropped
+			}
+			if now.Sub(lastPruned) >= histPruneFrequency {
+				lastPruned = now
+				if err := shl.prune(now); err != nil {
+					log.Printf("Error pruning sqlite histogram: %v", err)
+				}
+			}
+		case <-ctx.Done():
+			if shl.abandoned.Load() {
+				log.Printf("Histogram Logger SQLite writer abandoned %d queued events", batch.size+len(shl.events))
+				return
+			}
+			// this goroutine is the only reader so len can't race
+			for len(shl.events) > 0 {
+				add(<-shl.events)
+			}
+			retryAt = time.Time{}
+			flush(time.Now())
+			log.Println("Histogram Logger SQLite writer finished...")
+			return
+		}
+	}
+}
+
+// histBatch aggregates events between flushes so each FQDN costs one upsert per table
+type histBatch struct {
+	size     int
+	blocked  map[string]*fqdnStats
+	accepted map[string]*fqdnStats
+}
+
+func newHistBatch() *histBatch {
+	return &histBatch{
+		blocked:  make(map[string]*fqdnStats),
+		accepted: make(map[string]*fqdnStats),
+	}
+}
+
+func (b *histBatch) add(ev forwardproxy.HistEvent) {
+	b.size++
+	if ev.Blocked {
+		recordEvent(b.blocked, ev)
+	} else {
+		recordEvent(b.accepted, ev)
+	}
+}
+
+func (shl *sqliteHistLogger) flush(batch *histBatch) error {
+	tx, err := shl.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for kind, m := range map[string]map[string]*fqdnStats{blockedHistKind: batch.blocked, acceptedHistKind: batch.accepted} {
+		for fqdn, stats := range m {
+			if err := upsertFQDNStats(tx, kind, fqdn, stats); err != nil {
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
+
+func upsertFQDNStats(tx *sql.Tx, kind, fqdn string, stats *fqdnStats) error {
+	if _, err := tx.Exec(`INSERT INTO fqdn (kind, fqdn, count, first_seen, last_seen) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (kind, fqdn) DO UPDATE SET
+			count = count + excluded.count,
+			first_seen = COALESCE(first_seen, excluded.first_seen),
+			last_seen = COALESCE(MAX(last_seen, excluded.last_seen), last_seen, excluded.last_seen)`,
+		kind, fqdn, stats.count, nullableUnixNano(stats.firstSeen), nullableUnixNano(stats.lastSeen)); err != nil {
+		return err
+	}
+	for size, buckets := range map[string]map[int64]int{hourlyBucketName: stats.hourly, dailyBucketName: stats.daily} {
+		for start, count := range buckets {
+			if _, err := tx.Exec(`INSERT INTO fqdn_bucket (kind, fqdn, size, start, count) VALUES (?, ?, ?, ?, ?)
+				ON CONFLICT (kind, fqdn, size, start) DO UPDATE SET count = count + excluded.count`,
+				kind, fqdn, size, start, count); err != nil {
+				return err
+			}
+		}
+	}
+	for list, count := range stats.lists {
+		if _, err := tx.Exec(`INSERT INTO fqdn_list (kind, fqdn, list, count) VALUES (?, ?, ?, ?)
+			ON CONFLICT (kind, fqdn, list) DO UPDATE SET count = count + excluded.count`,
+			kind, fqdn, list, count); err != nil {
+			return err
+		}
+	}
+	for client, count := range stats.clients {
+		if _, err := tx.Exec(`INSERT INTO fqdn_client (kind, fqdn, client, count) VALUES (?, ?, ?, ?)
+			ON CONFLICT (kind, fqdn, client) DO UPDATE SET count = count + excluded.count`,
+			kind, fqdn, client, count); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (shl *sqliteHistLogger) prune(now time.Time) error {
+	_, err := shl.db.Exec(`DELETE FROM fqdn_bucket WHERE (size = ? AND start < ?) OR (size = ? AND start < ?)`,
+		hourlyBucketName, bucketStart(now.Add(-shl.retention.hourly), hourlyBucket),
+		dailyBucketName, bucketStart(now.Add(-shl.retention.daily), dailyBucket))
+	return err
+}
+
+// Query runs q against the database. Events still waiting to be flushed are not included.
+func (shl *sqliteHistLogger) Query(q histQuery) (histContent, error) {
+	result := histContent{Dropped: shl.dropped.Load()}
+	now := time.Now()
+	var err error
+	if q.blocked {
+		if result.Blocked, err = shl.query(blockedHistKind, q, now); err != nil {
+			return result, err
+		}
+	}
+	if q.accepted {
+		if result.Accepted, err = shl.query(acceptedHistKind, q, now); err != nil {
+			return result, err
+		}
+	}
+	return result, nil
+}
+
+func (shl *sqliteHistLogger) query(kind string, q histQuery, now time.Time) ([]fqdnDetails, error) {
+	var stmt strings.Builder
+	args := []interface{}{}
+	if q.timeFiltered() {
+		bucketSize := bucketSizeFor(q.from, shl.retention, now)
+		size := dailyBucketName
+		if bucketSize == hourlyBucket {
+			size = hourlyBucketName
+		}
+		stmt.WriteString(`SELECT f.fqdn, SUM(b.count) AS hits, f.first_seen, f.last_seen FROM fqdn f
+			JOIN fqdn_bucket b ON b.kind = f.kind AND b.fqdn = f.fqdn AND b.size = ?
+			WHERE f.kind = ?`)
+		args = append(args, size, kind)
+		if !q.from.IsZero() {
+			stmt.WriteString(` AND b.start >= ?`)
+			args = append(args, bucketStart(q.from, bucketSize))
+		}
+		if !q.to.IsZero() {
+			stmt.WriteString(` AND b.start < ?`)
+			args = append(args, q.to.Unix())
+		}
+	} else {
+		stmt.WriteString(`SELECT f.fqdn, f.count AS hits, f.first_seen, f.last_seen FROM fqdn f WHERE f.kind = ?`)
+		args = append(args, kind)
+	}
+	if q.contains != "" {
+		stmt.WriteString(` AND instr(f.fqdn, ?) > 0`)
+		args = append(args, q.contains)
+	}
+	if q.domain != "" {
+		stmt.WriteString(` AND (f.fqdn = ? OR substr(f.fqdn, -length(?)) = ?)`)
+		args = append(args, q.domain, "."+q.domain, "."+q.domain)
+	}
+	if q.list != "" {
+		stmt.WriteString(` AND EXISTS (SELECT 1 FROM fqdn_list l WHERE l.kind = f.kind AND l.fqdn = f.fqdn AND l.list = ?)`)
+		args = append(args, q.list)
+	}
+	if q.client != "" {
+		stmt.WriteString(` AND EXISTS (SELECT 1 FROM fqdn_client c WHERE c.kind = f.kind AND c.fqdn = f.fqdn AND c.client = ?)`)
+		args = append(args, q.client)
+	}
+	if q.timeFiltered() {
+		stmt.WriteString(` GROUP BY f.fqdn HAVING hits > 0`)
+	}
+	stmt.WriteString(` ORDER BY hits DESC, f.fqdn`)
+	if q.top > 0 {
+		stmt.WriteString(` LIMIT ?`)
+		args = append(args, q.top)
+	}
+	rows, err := shl.db.Query(stmt.String(), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := []fqdnDetails{}
+	for rows.Next() {
+		var d fqdnDetails
+		var firstSeen, lastSeen sql.NullInt64
+		if err := rows.Scan(&d.FQDN, &d.Count, &firstSeen, &lastSeen); err != nil {
+			return nil, err
+		}
+		d.FirstSeen, d.LastSeen = timeFromNullable(firstSeen), timeFromNullable(lastSeen)
+		result = append(result, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for c := range result {
+		if result[c].Lists, err = shl.counts(`SELECT list, count FROM fqdn_list WHERE kind = ? AND fqdn = ?`, kind, result[c].FQDN); err != nil {
+			return nil, err
+		}
+		if result[c].Clients, err = shl.counts(`SELECT client, count FROM fqdn_client WHERE kind = ? AND fqdn = ?`, kind, result[c].FQDN); err != nil {
+			return nil, err
+		}
+		result[c].List = topCount(result[c].Lists)
+	}
+	return result, nil
+}
+
+func (shl *sqliteHistLogger) counts(stmt string, args ...interface{}) (map[string]int, error) {
+	rows, err := shl.db.Query(stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[string]int)
+	for rows.Next() {
+		var k string
+		var v int
+		if err := rows.Scan(&k, &v); err != nil {
+			return nil, err
+		}
+		result[k] = v
+	}
+	return result, rows.Err()
+}
+
+// Reset clears counters, including those of events not yet flushed, and returns the number
+// of entries removed
+func (shl *sqliteHistLogger) Reset(r histReset) (int, error) {
+	resp := make(chan responsePayloadWithError[int], 1)
+	select {
+	case shl.resets <- requestMessage[histReset, int]{req: r, resp: resp}:
+	case <-shl.done:
+		return 0, errors.New("logger already closed")
+	}
+	v := <-resp
+	return v.payload, v.err
+}
+
+// reset runs on the writer goroutine, which owns batch
+func (shl *sqliteHistLogger) reset(r histReset, batch *histBatch) (int, error) {
+	kinds := map[string]map[string]*fqdnStats{}
+	if r.blocked {
+		kinds[blockedHistKind] = batch.blocked
+	}
+	if r.accepted {
+		kinds[acceptedHistKind] = batch.accepted
+	}
+	tx, err := shl.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	removed := 0
+	stored := make(map[string]map[string]bool)
+	for kind := range kinds {
+		stored[kind] = make(map[string]bool)
+		for _, table := range []string{"fqdn", "fqdn_bucket", "fqdn_list", "fqdn_client"} {
+			stmt := `DELETE FROM ` + table + ` WHERE kind = ?`
+			args := []interface{}{kind}
+			if r.fqdn != "" {
+				stmt += ` AND fqdn = ?`
+				args = append(args, r.fqdn)
+			}
+			if table != "fqdn" {
+				if _, err := tx.Exec(stmt, args...); err != nil {
+					return 0, err
+				}
+				continue
+			}
+			rows, err := tx.Query(stmt+` RETURNING fqdn`, args...)
+			if err != nil {
+				return 0, err
+			}
+			for rows.Next() {
+				var fqdn string
+				if err := rows.Scan(&fqdn); err != nil {
+					rows.Close()
+					return 0, err
+				}
+				stored[kind][fqdn] = true
+			}
+			if err := rows.Close(); err != nil {
+				return 0, err
+			}
+			removed += len(stored[kind])
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for kind, m := range kinds {
+		for fqdn, stats := range m {
+			if r.fqdn != "" && fqdn != r.fqdn {
+				continue
+			}
+			if !stored[kind][fqdn] {
+				removed++
+			}
+			batch.size -= stats.count
+			delete(m, fqdn)
+		}
+	}
+	return removed, nil
+}
+
+// importHistogramFile adds a YAML histogram written by fHistLogger to the database at path.
+// Counts are added to those already stored, so unless merge is set a database that already
+// holds a histogram is refused rather than risk counting the same file twice.
+func importHistogramFile(yamlFile, path string, merge bool) (int, error) {
+	content, err := readHistogramFile(yamlFile)
+	if err != nil {
+		return 0, err
+	}
+	db, err := openSQLiteHistDB(path)
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if !merge {
+		var populated bool
+		if err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM fqdn)`).Scan(&populated); err != nil {
+			return 0, err
+		}
+		if populated {
+			return 0, fmt.Errorf("%s already holds a histogram: pass --merge to add %s to its counts", path, yamlFile)
+		}
+	}
+	imported := 0
+	for kind, details := range map[string][]fqdnDetails{blockedHistKind: content.Blocked, acceptedHistKind: content.Accepted} {
+		for _, d := range details {
+			if err := upsertFQDNStats(tx, kind, d.FQDN, newFQDNStatsFromDetails(d)); err != nil {
+				return 0, err
+			}
+			imported++
+		}
+	}
+	return imported, tx.Commit()
+}
+
+func nullableUnixNano(t time.Time) sql.NullInt64 {
+	if t.IsZero() {
+		return sql.NullInt64{}
+	}
+	return sql.NullInt64{Int64: t.UnixNano(), Valid: true}
+}
+
+func timeFromNullable(v sql.NullInt64) time.Time {
+	if !v.Valid {
+		return time.Time{}
+	}
+	return time.Unix(0, v.Int64).UTC()
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+func TestSQLiteHistLoggerHoldsBoundedBatchWhileFailing(t *testing.T) {
+	oldFlush, oldBackoff, oldPending := sqliteFlushFrequency, sqliteMaxRetryBackoff, maxSQLitePendingEvents
+	sqliteFlushFrequency, sqliteMaxRetryBackoff, maxSQLitePendingEvents = 10*time.Millisecond, 20*time.Millisecond, 50
+	t.Cleanup(func() {
+		sqliteFlushFrequency, sqliteMaxRetryBackoff, maxSQLitePendingEvents = oldFlush, oldBackoff, oldPending
+	})
+
+	path := filepath.Join(t.TempDir(), "hist.db")
+	shl, err := newSQLiteHistLogger(path, defaultHistRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// every flush fails until the table is back
+	if _, err := shl.db.Exec(`DROP TABLE fqdn`); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 200; i++ {
+		shl.LogBlocked("ads.com")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for shl.dropped.Load() < 150 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if dropped := shl.dropped.Load(); dropped != 150 {
+		t.Fatalf("dropped %d events, want 150", dropped)
+	}
+	if _, err := shl.db.Exec(sqliteHistSchema[0]); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err := shl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := openSQLiteHistDB(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var count int
+	if err := db.QueryRow(`SELECT count FROM fqdn WHERE kind = ? AND fqdn = ?`, blockedHistKind, "ads.com").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	if count != 50 {
+		t.Errorf("stored %d events, want the 50 held", count)
+	}
+}
+
+func TestSQLiteHistLoggerResetIncludesPendingEvents(t *testing.T) {
+	oldFlush := sqliteFlushFrequency
+	// nothing is flushed until Close
+	sqliteFlushFrequency = time.Hour
+	t.Cleanup(func() { sqliteFlushFrequency = oldFlush })
+
+	path := filepath.Join(t.TempDir(), "hist.db")
+	shl, err := newSQLiteHistLogger(path, defaultHistRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shl.LogBlocked("ads.com")
+	if err := shl.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	shl, err = newSQLiteHistLogger(path, defaultHistRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fqdn := range []string{"ads.com", "ads.com", "tracker.com", "new.com"} {
+		shl.LogBlocked(fqdn)
+	}
+	shl.LogAccepted("ads.com")
+	// ads.com is both stored and pending but is one entry
+	if removed, err := shl.Reset(histReset{blocked: true, fqdn: "ads.com"}); err != nil || removed != 1 {
+		t.Errorf("Reset(ads.com) = %d, %v, want 1", removed, err)
+	}
+	if removed, err := shl.Reset(histReset{blocked: true, fqdn: "new.com"}); err != nil || removed != 1 {
+		t.Errorf("Reset(new.com) = %d, %v, want 1", removed, err)
+	}
+	if err := shl.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := shl.Reset(histReset{blocked: true}); err == nil {
+		t.Error("Reset after Close succeeded")
+	}
+
+	shl, err = newSQLiteHistLogger(path, defaultHistRetention)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer shl.Close()
+	content, err := shl.Query(histQuery{blocked: true, accepted: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(content.Blocked) != 1 || content.Blocked[0].FQDN != "tracker.com" {
+		t.Errorf("blocked after reset: %+v", content.Blocked)
+	}
+	if len(content.Accepted) != 1 || content.Accepted[0].Count != 1 {
+		t.Errorf("accepted after reset: %+v", content.Accepted)
+	}
+}
+
+func TestImportHistogramFile(t *testing.T) {
+	dir := t.TempDir()
+	yamlFile := filepath.Join(dir, "hist.yml")
+	fhl := newFileBasedHistLogger(yamlFile, histRetention{})
+	fhl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: "ads.com", Blocked: true, List: "ads"})
+	fhl.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: "ads.com", Blocked: true, List: "ads"})
+	fhl.LogAccepted("example.org")
+	if err := closeWithin(t, fhl, 5*time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "hist.db")
+	if n, err := importHistogramFile(yamlFile, path, false); err != nil || n != 2 {
+		t.Fatalf("import = %d, %v", n, err)
+	}
+	if _, err := importHistogramFile(yamlFile, path, false); err == nil || !strings.Contains(err.Error(), "--merge") {
+		t.Errorf("second import = %v, want a refusal", err)
+	}
+	count := func() int {
+		db, err := openSQLiteHistDB(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		var n int
+		if err := db.QueryRow(`SELECT count FROM fqdn WHERE kind = ? AND fqdn = ?`, blockedHistKind, "ads.com").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	if n := count(); n != 2 {
+		t.Errorf("after a refused import ads.com counts %d, want 2", n)
+	}
+	if _, err := importHistogramFile(yamlFile, path, true); err != nil {
+		t.Fatal(err)
+	}
+	if n := count(); n != 4 {
+		t.Errorf("after --merge ads.com counts %d, want 4", n)
+	}
+}
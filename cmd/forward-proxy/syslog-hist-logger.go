@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+var (
+	syslogDialTimeout   = 5 * time.Second
+	syslogWriteTimeout  = 5 * time.Second
+	syslogRetryInterval = 10 * time.Second
+)
+
+const (
+	syslogAppName = "forward-proxy"
+	// enterprise number reserved for documentation, used to namespace our SD-ID
+	syslogSDID = "forwardproxy@32473"
+
+	syslogSeverityWarning = 4
+	syslogSeverityInfo    = 6
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogHistLogger ships events as RFC 5424 messages over udp://host:port, tcp://host:port
+// (octet-counted framing per RFC 6587) or unix:///path/to/socket. Events are queued and sent
+// by a single goroutine; a dead collector costs dropped events, never proxy latency.
+type syslogHistLogger struct {
+	network  string
+	addr     string
+	facility int
+	hostname string
+	procID   string
+	// internal
+	events    chan forwardproxy.HistEvent
+	dropped   atomic.Uint64
+	conn      net.Conn
+	lastDial  time.Time
+	stop      context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newSyslogHistLogger(target string, facility string) (*syslogHistLogger, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid syslog target %s: %w", target, err)
+	}
+	result := &syslogHistLogger{
+		procID: fmt.Sprintf("%d", os.Getpid()),
+		events: make(chan forwardproxy.HistEvent, maxEventBuffer),
+		done:   make(chan struct{}),
+	}
+	switch u.Scheme {
+	case "udp", "tcp":
+		if u.Host == "" {
+			return nil, fmt.Errorf("missing host in syslog target %s", target)
+		}
+		result.network, result.addr = u.Scheme, u.Host
+	case "unix":
+		if u.Path == "" {
+			return nil, fmt.Errorf("missing socket path in syslog target %s", target)
+		}
+		result.network, result.addr = "unix", u.Path
+	default:
+		return nil, fmt.Errorf("unsupported syslog scheme %q: expected udp, tcp or unix", u.Scheme)
+	}
+	f, ok := syslogFacilities[strings.ToLower(facility)]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	result.facility = f
+	if result.hostname, err = os.Hostname(); err != nil || result.hostname == "" {
+		result.hostname = "-"
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result.stop = cancel
+	go result.run(ctx)
+	return result, nil
+}
+
+func (s *syslogHistLogger) LogAccepted(fqdn string) {
+	s.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn})
+}
+
+func (s *syslogHistLogger) LogBlocked(fqdn string) {
+	s.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn, Blocked: true})
+}
+
+// LogEvent implements forwardproxy.HistEventLogger and never blocks
+func (s *syslogHistLogger) LogEvent(ev forwardproxy.HistEvent) {
+	select {
+	case s.events <- ev:
+	default:
+		s.dropped.Add(1)
+	}
+}
+
+func (s *syslogHistLogger) Close() error {
+	s.closeOnce.Do(func() {
+		s.stop()
+		<-s.done
+	})
+	return nil
+}
+
+func (s *syslogHistLogger) run(ctx context.Context) {
+	defer close(s.done)
+	defer func() {
+		if s.conn != nil {
+			s.conn.Close()
+		}
+	}()
+	var reportedDropped uint64
+	ticker := time.NewTicker(writeFrequency)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-s.events:
+			s.send(ev)
+		case <-ticker.C:
+			if dropped := s.dropped.Load(); dropped != reportedDropped {
+				log.Printf("syslog logger dropped %d events (%d total)", dropped-reportedDropped, dropped)
+				reportedDropped = dropped
+			}
+		case <-ctx.Done():
+			for len(s.events) > 0 {
+				s.send(<-s.events)
+			}
+			return
+		}
+	}
+}
+
+// send writes ev, reconnecting once on failure. While the collector is unreachable redials
+// are limited to one per syslogRetryInterval and events in between are dropped.
+func (s *syslogHistLogger) send(ev forwardproxy.HistEvent) {
+	msg := s.format(ev)
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			if time.Since(s.lastDial) < syslogRetryInterval && attempt == 0 && !s.lastDial.IsZero() {
+				break
+			}
+			if err := s.dial(); err != nil {
+				log.Printf("unable to connect to syslog %s://%s: %v", s.network, s.addr, err)
+				break
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(syslogWriteTimeout))
+		if _, err := s.conn.Write(msg); err == nil {
+			return
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	s.dropped.Add(1)
+}
+
+func (s *syslogHistLogger) dial() error {
+	s.lastDial = time.Now()
+	if s.network == "unix" {
+		// /dev/log is usually a datagram socket but some daemons listen on a stream socket
+		conn, err := net.DialTimeout("unixgram", s.addr, syslogDialTimeout)
+		if err == nil {
+			s.conn = conn
+			return nil
+		}
+	}
+	conn, err := net.DialTimeout(s.network, s.addr, syslogDialTimeout)
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+// format renders ev as an RFC 5424 message, octet-counted when sent over a stream
+func (s *syslogHistLogger) format(ev forwardproxy.HistEvent) []byte {
+	severity, msgID, text := syslogSeverityInfo, "accepted", "accepted "+ev.FQDN
+	if ev.Blocked {
+		severity, msgID, text = syslogSeverityWarning, "blocked", fmt.Sprintf("blocked %s by %s", ev.FQDN, ev.List)
+	}
+	sd := strings.Builder{}
+	sd.WriteString("[" + syslogSDID)
+	for _, p := range []struct{ name, value string }{
+		{"fqdn", ev.FQDN},
+		{"list", ev.List},
+		{"client", ev.Client},
+		{"user", ev.User},
+		{"port", portString(ev.Port)},
+	} {
+		if p.value != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, p.name, escapeSDParam(p.value))
+		}
+	}
+	sd.WriteString("]")
+	msg := fmt.Sprintf("<%d>1 %s %s %s %s %s %s %s",
+		s.facility*8+severity,
+		ev.Time.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		s.hostname, syslogAppName, s.procID, msgID, sd.String(), text)
+	if s.network == "tcp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+	return []byte(msg)
+}
+
+func portString(port int) string {
+	if port == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", port)
+}
+
+var sdParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+func escapeSDParam(v string) string {
+	return sdParamEscaper.Replace(v)
+}
@@ -0,0 +1,172 @@
+(function () {
+  "use strict";
+
+  const feedLimit = 200;
+  const refreshInterval = 5000;
+
+  function token() {
+    return localStorage.getItem("forward-proxy-token") || "";
+  }
+
+  function headers() {
+    const result = { "Content-Type": "application/json" };
+    if (token()) {
+      result["Authorization"] = "Bearer " + token();
+    }
+    return result;
+  }
+
+  function setStatus(msg) {
+    document.getElementById("status").textContent = msg;
+  }
+
+  async function api(method, path, body) {
+    const resp = await fetch(path, {
+      method: method,
+      headers: headers(),
+      body: body === undefined ? undefined : JSON.stringify(body),
+    });
+    if (!resp.ok) {
+      let msg = resp.status + " " + resp.statusText;
+      try {
+        msg = (await resp.json()).error || msg;
+      } catch (e) {
+        // not a JSON error body
+      }
+      throw new Error(path + ": " + msg);
+    }
+    return resp.status === 204 ? null : resp.json();
+  }
+
+  function cell(row, text) {
+    const td = document.createElement("td");
+    td.textContent = text;
+    row.appendChild(td);
+    return td;
+  }
+
+  function policyButton(row, fqdn, blocked) {
+    const td = cell(row, "");
+    const btn = document.createElement("button");
+    btn.textContent = blocked ? "Allow" : "Block";
+    btn.addEventListener("click", async function () {
+      try {
+        await api("POST", blocked ? "/v1/policy/allow" : "/v1/policy/block", { fqdn: fqdn });
+        setStatus("");
+        refresh();
+      } catch (e) {
+        setStatus(e.message);
+      }
+    });
+    td.appendChild(btn);
+  }
+
+  function fillTable(id, rows, render) {
+    const tbody = document.querySelector("#" + id + " tbody");
+    tbody.replaceChildren();
+    rows.forEach(function (r) {
+      const tr = document.createElement("tr");
+      render(tr, r);
+      tbody.appendChild(tr);
+    });
+  }
+
+  async function refresh() {
+    try {
+      const [hist, lists, overrides] = await Promise.all([
+        api("GET", "/v1/histogram?top=25").catch(function () {
+          return { blocked: [], accepted: [] };
+        }),
+        api("GET", "/v1/blocklists"),
+        api("GET", "/v1/dns/overrides"),
+      ]);
+      fillTable("blocked", hist.blocked || [], function (tr, d) {
+        cell(tr, d.fqdn);
+        cell(tr, d.count);
+        policyButton(tr, d.fqdn, true);
+      });
+      fillTable("accepted", hist.accepted || [], function (tr, d) {
+        cell(tr, d.fqdn);
+        cell(tr, d.count);
+        policyButton(tr, d.fqdn, false);
+      });
+      fillTable("blocklists", lists, function (tr, l) {
+        cell(tr, l.name);
+        cell(tr, l.size);
+      });
+      fillTable("overrides", overrides, function (tr, o) {
+        cell(tr, o.addr);
+        cell(tr, o.ip);
+        cell(tr, o.expires ? new Date(o.expires).toLocaleString() : "never");
+        cell(tr, o.comment || "");
+      });
+      setStatus("");
+    } catch (e) {
+      setStatus(e.message);
+    }
+  }
+
+  function addFeedEvent(ev) {
+    const tbody = document.querySelector("#feed tbody");
+    const tr = document.createElement("tr");
+    if (ev.blocked) {
+      tr.className = "blocked";
+    }
+    cell(tr, new Date(ev.time).toLocaleTimeString());
+    cell(tr, ev.port ? ev.fqdn + ":" + ev.port : ev.fqdn);
+    cell(tr, ev.user ? ev.user + "@" + (ev.client || "") : ev.client || "");
+    cell(tr, ev.list || "");
+    policyButton(tr, ev.fqdn, ev.blocked);
+    tbody.insertBefore(tr, tbody.firstChild);
+    while (tbody.children.length > feedLimit) {
+      tbody.removeChild(tbody.lastChild);
+    }
+  }
+
+  // EventSource can't send an Authorization header so the stream is read with fetch
+  async function follow() {
+    for (;;) {
+      try {
+        const resp = await fetch("/v1/events", { headers: headers() });
+        if (!resp.ok) {
+          throw new Error("/v1/events: " + resp.status + " " + resp.statusText);
+        }
+        document.querySelector("#feed tbody").replaceChildren();
+        const reader = resp.body.getReader();
+        const decoder = new TextDecoder();
+        let buffer = "";
+        for (;;) {
+          const { value, done } = await reader.read();
+          if (done) {
+            break;
+          }
+          buffer += decoder.decode(value, { stream: true });
+          let idx;
+          while ((idx = buffer.indexOf("\n\n")) >= 0) {
+            const chunk = buffer.slice(0, idx);
+            buffer = buffer.slice(idx + 2);
+            if (chunk.startsWith("data: ")) {
+              addFeedEvent(JSON.parse(chunk.slice(6)));
+            }
+          }
+        }
+      } catch (e) {
+        setStatus(e.message);
+      }
+      await new Promise(function (resolve) {
+        setTimeout(resolve, refreshInterval);
+      });
+    }
+  }
+
+  document.getElementById("token").value = token();
+  document.getElementById("token-form").addEventListener("submit", function (e) {
+    e.preventDefault();
+    localStorage.setItem("forward-proxy-token", document.getElementById("token").value);
+    refresh();
+  });
+
+  refresh();
+  setInterval(refresh, refreshInterval);
+  follow();
+})();
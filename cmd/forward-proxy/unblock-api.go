@@ -0,0 +1,223 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	unblockPath              = "/unblock"
+	unblockRequestsV1Path    = "/v1/unblock-requests"
+	maxPendingUnblockRequest = 200
+	// the unblock page is public, so what it stores is bounded
+	maxUnblockFQDN   = 253
+	maxUnblockList   = 128
+	maxUnblockReason = 500
+)
+
+// defaultUnblockURL links to the unblock page of the api server listening on hostname:port.
+// "api" resolves to 127.0.0.1 for clients of the proxy, which only reaches the api server
+// when it listens on all addresses or on 127.0.0.1; otherwise the link names hostname.
+func defaultUnblockURL(hostname string, port int, useTLS bool) string {
+	scheme := "http"
+	if useTLS {
+		scheme = "https"
+	}
+	host := "api"
+	if ip := net.ParseIP(hostname); hostname != "" && (ip == nil || !(ip.IsUnspecified() || ip.Equal(net.IPv4(127, 0, 0, 1)))) {
+		host = hostname
+	}
+	return fmt.Sprintf("%s://%s%s", scheme, net.JoinHostPort(host, fmt.Sprint(port)), unblockPath)
+}
+
+// validUnblockFQDN accepts host names and the addresses a block page may show for IP-only
+// requests
+func validUnblockFQDN(fqdn string) bool {
+	if fqdn == "" || len(fqdn) > maxUnblockFQDN {
+		return false
+	}
+	for _, c := range fqdn {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune(".-_:[]", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// unblockRequest is raised from the link on the block page
+type unblockRequest struct {
+	FQDN      string    `json:"fqdn"`
+	List      string    `json:"list,omitempty"`
+	Client    string    `json:"client,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+	Count     int       `json:"count"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+}
+
+// unblockRequests holds pending requests per FQDN until an admin deals with them
+type unblockRequests struct {
+	mu       sync.Mutex
+	requests map[string]*unblockRequest
+}
+
+func newUnblockRequests() *unblockRequests {
+	return &unblockRequests{requests: make(map[string]*unblockRequest)}
+}
+
+func (u *unblockRequests) add(fqdn, list, client, reason string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	now := time.Now()
+	if v, ok := u.requests[fqdn]; ok {
+		v.Count++
+		v.LastSeen = now
+		v.Client = client
+		if reason != "" {
+			v.Reason = reason
+		}
+		return
+	}
+	if len(u.requests) >= maxPendingUnblockRequest {
+		u.evictOldest()
+	}
+	u.requests[fqdn] = &unblockRequest{
+		FQDN:      fqdn,
+		List:      list,
+		Client:    client,
+		Reason:    reason,
+		Count:     1,
+		FirstSeen: now,
+		LastSeen:  now,
+	}
+}
+
+func (u *unblockRequests) evictOldest() {
+	var oldest *unblockRequest
+	for _, v := range u.requests {
+		if oldest == nil || v.LastSeen.Before(oldest.LastSeen) {
+			oldest = v
+		}
+	}
+	if oldest != nil {
+		delete(u.requests, oldest.FQDN)
+	}
+}
+
+// list returns pending requests, most recent first
+func (u *unblockRequests) list() []unblockRequest {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	result := make([]unblockRequest, 0, len(u.requests))
+	for _, v := range u.requests {
+		result = append(result, *v)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	return result
+}
+
+// remove drops the request for fqdn, or all requests when fqdn is empty
+func (u *unblockRequests) remove(fqdn string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if fqdn == "" {
+		n := len(u.requests)
+		u.requests = make(map[string]*unblockRequest)
+		return n
+	}
+	if _, ok := u.requests[fqdn]; !ok {
+		return 0
+	}
+	delete(u.requests, fqdn)
+	return 1
+}
+
+var unblockPageTemplate = template.Must(template.New("unblock").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Request unblock: {{.FQDN}}</title>
+<style>body{font-family:sans-serif;max-width:40em;margin:4em auto;color:#333}code{background:#eee;padding:0 .3em}textarea{width:100%}</style>
+</head>
+<body>
+{{if .Sent}}<h1>Request sent</h1>
+<p>An administrator has been asked to unblock <code>{{.FQDN}}</code>.</p>
+{{else}}<h1>Request unblock</h1>
+<form method="post">
+<p>Ask for <code>{{.FQDN}}</code>{{if .List}} (blocked by <code>{{.List}}</code>){{end}} to be unblocked.</p>
+<input type="hidden" name="fqdn" value="{{.FQDN}}">
+<input type="hidden" name="list" value="{{.List}}">
+<p><textarea name="reason" rows="3" placeholder="Why do you need it? (optional)"></textarea></p>
+<p><button type="submit">Send request</button></p>
+</form>
+{{end}}</body>
+</html>
+`))
+
+// unblockHandler serves the page the block page links to. It is deliberately public: the
+// people who see block pages don't have api tokens.
+func unblockHandler(requests *unblockRequests) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodPost {
+			http.Error(w, "method not supported", http.StatusMethodNotAllowed)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, 16*1024)
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, "unable to parse request", http.StatusBadRequest)
+			return
+		}
+		data := struct {
+			FQDN, List string
+			Sent       bool
+		}{FQDN: r.Form.Get("fqdn"), List: r.Form.Get("list")}
+		switch {
+		case data.FQDN == "":
+			http.Error(w, "missing fqdn", http.StatusBadRequest)
+			return
+		case !validUnblockFQDN(data.FQDN):
+			http.Error(w, "invalid fqdn", http.StatusBadRequest)
+			return
+		case len(data.List) > maxUnblockList:
+			http.Error(w, "invalid list", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPost {
+			reason := r.Form.Get("reason")
+			if len(reason) > maxUnblockReason {
+				http.Error(w, fmt.Sprintf("reason longer than %d characters", maxUnblockReason), http.StatusBadRequest)
+				return
+			}
+			requests.add(data.FQDN, data.List, clientHost(r.RemoteAddr), reason)
+			log.Printf("unblock requested: %s (%s) from %s", data.FQDN, data.List, r.RemoteAddr)
+			data.Sent = true
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		unblockPageTemplate.Execute(w, data)
+	}
+}
+
+// unblockRequestsV1Handler lists pending unblock requests (GET) and dismisses them (DELETE,
+// optionally for a single fqdn); granting one is a POST to /v1/policy/allow
+func unblockRequestsV1Handler(requests *unblockRequests) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, requests.list())
+		case http.MethodDelete:
+			removed := requests.remove(r.URL.Query().Get("fqdn"))
+			writeJSON(w, http.StatusOK, map[string]int{"removed": removed})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "%s method not supported", r.Method)
+		}
+	}
+}
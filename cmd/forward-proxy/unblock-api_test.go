@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestUnblockHandler(t *testing.T) {
+	requests := newUnblockRequests()
+	handler := unblockHandler(requests)
+	call := func(method string, form url.Values) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		var r *http.Request
+		if method == http.MethodPost {
+			r = httptest.NewRequest(method, unblockPath, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, unblockPath+"?"+form.Encode(), nil)
+		}
+		handler(w, r)
+		return w
+	}
+
+	w := call(http.MethodGet, url.Values{"fqdn": {"ads.com"}, "list": {"<ads>"}})
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `<code>ads.com</code> (blocked by <code>&lt;ads&gt;</code>)`) {
+		t.Errorf("GET = %d:\n%s", w.Code, w.Body)
+	}
+	if len(requests.list()) != 0 {
+		t.Error("GET raised a request")
+	}
+
+	for _, tt := range []struct {
+		method string
+		form   url.Values
+		want   int
+	}{
+		{http.MethodDelete, url.Values{"fqdn": {"ads.com"}}, http.StatusMethodNotAllowed},
+		{http.MethodPut, url.Values{"fqdn": {"ads.com"}}, http.StatusMethodNotAllowed},
+		{http.MethodPost, url.Values{}, http.StatusBadRequest},
+		{http.MethodPost, url.Values{"fqdn": {"ads.com/<x>"}}, http.StatusBadRequest},
+		{http.MethodPost, url.Values{"fqdn": {strings.Repeat("a", maxUnblockFQDN+1)}}, http.StatusBadRequest},
+		{http.MethodPost, url.Values{"fqdn": {"ads.com"}, "list": {strings.Repeat("a", maxUnblockList+1)}}, http.StatusBadRequest},
+		{http.MethodPost, url.Values{"fqdn": {"ads.com"}, "reason": {strings.Repeat("a", maxUnblockReason+1)}}, http.StatusBadRequest},
+	} {
+		if w := call(tt.method, tt.form); w.Code != tt.want {
+			t.Errorf("%s %v = %d, want %d", tt.method, tt.form, w.Code, tt.want)
+		}
+	}
+	if len(requests.list()) != 0 {
+		t.Error("invalid requests recorded")
+	}
+
+	for _, reason := range []string{"homework", ""} {
+		w := call(http.MethodPost, url.Values{"fqdn": {"ads.com"}, "list": {"ads"}, "reason": {reason}})
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Request sent") {
+			t.Errorf("POST = %d:\n%s", w.Code, w.Body)
+		}
+	}
+	call(http.MethodPost, url.Values{"fqdn": {"[2001:db8::1]:80"}})
+	got := requests.list()
+	if len(got) != 2 {
+		t.Fatalf("requests = %+v", got)
+	}
+	if r := got[1]; r.FQDN != "ads.com" || r.List != "ads" || r.Count != 2 || r.Reason != "homework" || r.Client != "192.0.2.1" {
+		t.Errorf("request = %+v", r)
+	}
+}
+
+func TestDefaultUnblockURL(t *testing.T) {
+	tests := []struct {
+		hostname string
+		tls      bool
+		want     string
+	}{
+		{"", false, "http://api:8080/unblock"},
+		{"0.0.0.0", true, "https://api:8080/unblock"},
+		{"::", false, "http://api:8080/unblock"},
+		{"127.0.0.1", false, "http://api:8080/unblock"},
+		{"192.168.1.5", false, "http://192.168.1.5:8080/unblock"},
+		{"::1", false, "http://[::1]:8080/unblock"},
+		{"proxy.lan", true, "https://proxy.lan:8080/unblock"},
+	}
+	for _, tt := range tests {
+		if got := defaultUnblockURL(tt.hostname, 8080, tt.tls); got != tt.want {
+			t.Errorf("defaultUnblockURL(%q) = %s, want %s", tt.hostname, got, tt.want)
+		}
+	}
+}
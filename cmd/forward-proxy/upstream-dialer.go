@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	upstreamDialTimeout = 10 * time.Second
+	// a failed upstream is only retried after this, unless every upstream has failed
+	upstreamRetryAfter = 30 * time.Second
+)
+
+const directUpstream = "direct"
+
+// upstreamRuleConfig decides how connections are dialed. The first rule matching the
+// destination, the client and the listener applies: connections go via the first working
+// upstream in Via (direct when empty) and leave from Source or from the address of Interface
+// when given. Each of these conditions is optional, but a rule needs at least one:
+//   - Match is one or a list of FQDNs, *.domain wildcards (subdomains only), CIDRs or *
+//   - List is a block list the destination must be on, matched like blocking does
+//   - Client is a client IP or CIDR
+//   - Profile is the policy profile of the listener the client connected to
+//
+// A list also blocks wherever it applies, so a list only meant for routing is left out of
+// the profiles of the listeners it routes. Via entries are socks5://[user:pass@]host:port,
+// http://[user:pass@]host:port or direct.
+type upstreamRuleConfig struct {
+	Match     destinationPatterns
+	List      string
+	Client    string
+	Profile   string
+	Via       []string
+	Source    string
+	Interface string
+}
+
+// destinationPatterns accepts a single pattern or a list of them
+type destinationPatterns []string
+
+func (p *destinationPatterns) UnmarshalYAML(value *yaml.Node) error {
+	if value.Kind == yaml.ScalarNode {
+		*p = destinationPatterns{value.Value}
+		return nil
+	}
+	var v []string
+	if err := value.Decode(&v); err != nil {
+		return err
+	}
+	*p = v
+	return nil
+}
+
+type destinationPattern struct {
+	match string
+	cidr  *net.IPNet
+}
+
+func newDestinationPattern(v string) (destinationPattern, error) {
+	result := destinationPattern{match: strings.ToLower(v)}
+	switch {
+	case strings.Contains(result.match, "/"):
+		_, cidr, err := net.ParseCIDR(result.match)
+		if err != nil {
+			return result, err
+		}
+		result.cidr = cidr
+	case result.match != "*" && !validDomainPattern(result.match):
+		return result, fmt.Errorf("invalid match %s: wildcard only allowed as * or *.domain", v)
+	}
+	return result, nil
+}
+
+// matches name, or ip for CIDR patterns; ip is nil when the destination wasn't resolved
+func (p destinationPattern) matches(name string, ip net.IP) bool {
+	if p.cidr != nil {
+		return ip != nil && p.cidr.Contains(ip)
+	}
+	switch {
+	case p.match == "*":
+		return true
+	case isWildcardDomain(p.match):
+		return strings.HasSuffix(name, strings.TrimPrefix(p.match, "*"))
+	default:
+		return name == p.match
+	}
+}
+
+type upstreamRule struct {
+	patterns []destinationPattern
+	list     string
+	client   *net.IPNet
+	profile  string
+	route    upstreamRoute
+	bind     localBind
+}
+
+func (r *upstreamRule) matchesDestination(name string, ip net.IP, lists blockListMembership) bool {
+	if r.list != "" && (lists == nil || !lists.OnBlockList(r.list, name)) {
+		return false
+	}
+	if len(r.patterns) == 0 {
+		return true
+	}
+	for _, p := range r.patterns {
+		if p.matches(name, ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *upstreamRule) matchesClient(client net.IP, profile string) bool {
+	if r.profile != "" && r.profile != profile {
+		return false
+	}
+	return r.client == nil || (client != nil && r.client.Contains(client))
+}
+
+// blockListMembership tells the rules keyed by block list which names are on a list
+type blockListMembership interface {
+	OnBlockList(list, fqdn string) bool
+}
+
+// localBind is the address outgoing connections are made from
+type localBind struct {
+	ip    net.IP
+	iface string
+}
+
+// localAddr returns the address to dial remote from, nil for the system's choice. For an
+// interface its first address of the same family as remote is used, IPv4 when remote is unknown.
+func (b localBind) localAddr(network string, remote net.IP) (net.Addr, error) {
+	ip := b.ip
+	if b.iface != "" {
+		v, err := interfaceAddr(b.iface, remote == nil || remote.To4() != nil)
+		if err != nil {
+			return nil, err
+		}
+		ip = v
+	}
+	if ip == nil {
+		return nil, nil
+	}
+	if strings.HasPrefix(network, "udp") {
+		return &net.UDPAddr{IP: ip}, nil
+	}
+	return &net.TCPAddr{IP: ip}, nil
+}
+
+func interfaceAddr(name string, ipv4 bool) (net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok || ipNet.IP.IsLinkLocalUnicast() || (ipNet.IP.To4() != nil) != ipv4 {
+			continue
+		}
+		return ipNet.IP, nil
+	}
+	return nil, fmt.Errorf("interface %s has no usable address", name)
+}
+
+type upstream struct {
+	kind string // direct, socks5 or http
+	addr string
+	user *url.Userinfo
+	// internal
+	mu        sync.Mutex
+	downUntil time.Time
+}
+
+func (u *upstream) String() string {
+	if u.kind == directUpstream {
+		return directUpstream
+	}
+	return u.kind + "://" + u.addr
+}
+
+func (u *upstream) down(now time.Time) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return now.Before(u.downUntil)
+}
+
+func (u *upstream) markDown(now time.Time) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.downUntil = now.Add(upstreamRetryAfter)
+}
+
+type upstreamRoute []*upstream
+
+// direct reports whether the route never leaves this host, so names can be resolved locally
+func (r upstreamRoute) direct() bool {
+	for _, u := range r {
+		if u.kind != directUpstream {
+			return false
+		}
+	}
+	return true
+}
+
+var directRoute = upstreamRoute{{kind: directUpstream}}
+
+// upstreamRouter is the dialer for all outgoing connections. The resolver consults
+// resolvesRemotely and leaves names routed via an upstream for the upstream to resolve.
+type upstreamRouter struct {
+	rules []*upstreamRule
+	// optional; required by rules keyed by block list
+	lists blockListMembership
+}
+
+func upstreamRouterFromFile(fname string) (*upstreamRouter, error) {
+	contents, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	var configs []upstreamRuleConfig
+	if err := yaml.Unmarshal(contents, &configs); err != nil {
+		return nil, err
+	}
+	result := &upstreamRouter{}
+	for c, cfg := range configs {
+		rule, err := newUpstreamRule(cfg)
+		if err != nil {
+			return nil, fmt.Errorf("dial rule %d: %w", c+1, err)
+		}
+		result.rules = append(result.rules, rule)
+	}
+	return result, nil
+}
+
+func newUpstreamRule(cfg upstreamRuleConfig) (*upstreamRule, error) {
+	result := &upstreamRule{route: directRoute}
+	if len(cfg.Match) == 0 && cfg.List == "" && cfg.Client == "" && cfg.Profile == "" {
+		return nil, errors.New("missing match, list, client or profile")
+	}
+	result.list, result.profile = cfg.List, cfg.Profile
+	for _, m := range cfg.Match {
+		p, err := newDestinationPattern(m)
+		if err != nil {
+			return nil, err
+		}
+		result.patterns = append(result.patterns, p)
+	}
+	if cfg.Client != "" {
+		client, err := parseIPOrCIDR(cfg.Client)
+		if err != nil {
+			return nil, fmt.Errorf("invalid client: %w", err)
+		}
+		result.client = client
+	}
+	if len(cfg.Via) == 0 && cfg.Source == "" && cfg.Interface == "" {
+		return nil, errors.New("one of via, source or interface is required")
+	}
+	if cfg.Source != "" && cfg.Interface != "" {
+		return nil, errors.New("only one of source or interface allowed")
+	}
+	if cfg.Source != "" {
+		if result.bind.ip = net.ParseIP(cfg.Source); result.bind.ip == nil {
+			return nil, fmt.Errorf("invalid source address %s", cfg.Source)
+		}
+	}
+	if cfg.Interface != "" {
+		if _, err := net.InterfaceByName(cfg.Interface); err != nil {
+			return nil, err
+		}
+		result.bind.iface = cfg.Interface
+	}
+	if len(cfg.Via) > 0 {
+		result.route = nil
+	}
+	for _, v := range cfg.Via {
+		u, err := parseUpstream(v)
+		if err != nil {
+			return nil, err
+		}
+		result.route = append(result.route, u)
+	}
+	return result, nil
+}
+
+func parseIPOrCIDR(v string) (*net.IPNet, error) {
+	if strings.Contains(v, "/") {
+		_, result, err := net.ParseCIDR(v)
+		return result, err
+	}
+	ip := net.ParseIP(v)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %s", v)
+	}
+	bits := 8 * len(ip)
+	if ip4 := ip.To4(); ip4 != nil {
+		ip, bits = ip4, 32
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+}
+
+func parseUpstream(v string) (*upstream, error) {
+	if v == directUpstream {
+		return &upstream{kind: directUpstream}, nil
+	}
+	u, err := url.Parse(v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upstream %s: %w", v, err)
+	}
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &upstream{kind: "socks5", addr: u.Host, user: u.User}, nil
+	case "http":
+		return &upstream{kind: "http", addr: u.Host, user: u.User}, nil
+	default:
+		return nil, fmt.Errorf("unsupported upstream %s: expected socks5://, http:// or direct", v)
+	}
+}
+
+// checkNames checks that the block lists and profiles named by the rules exist
+func (r *upstreamRouter) checkNames(lists map[string]int, profiles map[string]*forwardproxy.PolicyProfile) error {
+	for c, rule := range r.rules {
+		if _, ok := lists[rule.list]; rule.list != "" && !ok {
+			return fmt.Errorf("dial rule %d: unknown block list %s", c+1, rule.list)
+		}
+		if _, ok := profiles[rule.profile]; rule.profile != "" && !ok {
+			return fmt.Errorf("dial rule %d: unknown profile %s", c+1, rule.profile)
+		}
+	}
+	return nil
+}
+
+// resolvesRemotely reports whether name may be sent via an upstream, in which case the
+// upstream resolves it. Clients and their listeners aren't known yet when names are
+// resolved, so any rule for the destination counts.
+func (r *upstreamRouter) resolvesRemotely(name string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, rule := range r.rules {
+		if rule.matchesDestination(name, nil, r.lists) && !rule.route.direct() {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the first rule for the destination and for the client connected to a listener
+// with the named profile, nil when none applies
+func (r *upstreamRouter) rule(name string, ip net.IP, client net.IP, profile string) *upstreamRule {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, rule := range r.rules {
+		if rule.matchesClient(client, profile) && rule.matchesDestination(name, ip, r.lists) {
+			return rule
+		}
+	}
+	return nil
+}
+
+type upstreamTargetKey struct{}
+
+// upstreamTarget travels from the resolver to the dialer in the request context. Local
+// targets, the admin domain and DNS overrides, are never sent via an upstream.
+type upstreamTarget struct {
+	name  string
+	local bool
+}
+
+func withUpstreamTarget(ctx context.Context, name string, local bool) context.Context {
+	return context.WithValue(ctx, upstreamTargetKey{}, upstreamTarget{name: name, local: local})
+}
+
+type dialClientKey struct{}
+
+// dialClientRules passes the client address on to the dialer in the context returned by Allow
+type dialClientRules struct {
+	next socks5.RuleSet
+}
+
+func (r dialClientRules) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
+	if addr, ok := req.RemoteAddr.(*net.TCPAddr); ok {
+		ctx = context.WithValue(ctx, dialClientKey{}, addr.IP)
+	}
+	return r.next.Allow(ctx, req)
+}
+
+// dial connects to addr, or to the name the resolver left unresolved, as the first matching
+// rule says: via the first upstream of its route that works, from its local address.
+// Upstreams that can't be reached or fail the handshake are skipped for a while; one that
+// answers the destination can't be reached is left in service.
+func (r *upstreamRouter) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host)
+	if ip != nil && ip.IsUnspecified() {
+		ip = nil
+	}
+	target, ok := ctx.Value(upstreamTargetKey{}).(upstreamTarget)
+	if !ok {
+		target = upstreamTarget{name: host}
+	}
+	client, _ := ctx.Value(dialClientKey{}).(net.IP)
+	profile := ""
+	if p := forwardproxy.PolicyProfileFrom(ctx); p != nil {
+		profile = p.Name
+	}
+	route, bind := directRoute, localBind{}
+	if rule := r.rule(target.name, ip, client, profile); rule != nil {
+		route, bind = rule.route, rule.bind
+		if target.local {
+			route = directRoute
+		}
+	}
+	if ip != nil && ip.IsLoopback() {
+		bind = localBind{}
+	}
+	remote := net.JoinHostPort(target.name, port)
+	if network != "tcp" || route.direct() {
+		if ip != nil {
+			// resolved here; dial what was checked
+			remote = addr
+		}
+		return directDial(ctx, network, remote, ip, bind)
+	}
+	now := time.Now()
+	wasDown := make([]bool, len(route))
+	for i, u := range route {
+		wasDown[i] = u.down(now)
+	}
+	var lastErr error
+	for _, retryDown := range []bool{false, true} {
+		for i, u := range route {
+			if wasDown[i] != retryDown {
+				continue
+			}
+			conn, err := u.dial(ctx, remote, ip, bind)
+			if err == nil {
+				return conn, nil
+			}
+			log.Printf("upstream %s to %s failed: %v", u, remote, err)
+			var derr destinationError
+			if errors.As(err, &derr) {
+				// the upstream works; another one won't reach the destination either
+				return nil, err
+			}
+			u.markDown(now)
+			lastErr = err
+		}
+	}
+	return nil, lastErr
+}
+
+// destinationError is an upstream's answer that it can't reach the destination. The upstream
+// itself works, so it isn't marked down.
+type destinationError struct {
+	err error
+}
+
+func (e destinationError) Error() string { return e.err.Error() }
+
+func (e destinationError) Unwrap() error { return e.err }
+
+// directDial dials addr from bind; remoteIP picks the address family for interface binds
+func directDial(ctx context.Context, network, addr string, remoteIP net.IP, bind localBind) (net.Conn, error) {
+	local, err := bind.localAddr(network, remoteIP)
+	if err != nil {
+		return nil, err
+	}
+	d := &net.Dialer{Timeout: upstreamDialTimeout}
+	if local != nil {
+		d.LocalAddr = local
+	}
+	return d.DialContext(ctx, network, addr)
+}
+
+// dial connects to remote through u; a direct upstream dials remote itself. The connection
+// to the upstream proxy leaves from bind.
+func (u *upstream) dial(ctx context.Context, remote string, remoteIP net.IP, bind localBind) (net.Conn, error) {
+	if u.kind == directUpstream {
+		if remoteIP != nil {
+			remote = net.JoinHostPort(remoteIP.String(), portOf(remote))
+		}
+		conn, err := directDial(ctx, "tcp", remote, remoteIP, bind)
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return nil, destinationError{err}
+		}
+		return conn, err
+	}
+	proxyHost, _, _ := net.SplitHostPort(u.addr)
+	conn, err := directDial(ctx, "tcp", u.addr, net.ParseIP(proxyHost), bind)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(upstreamDialTimeout))
+	switch u.kind {
+	case "socks5":
+		err = u.socks5Connect(conn, remote)
+	default:
+		conn, err = u.httpConnect(conn, remote)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+func (u *upstream) socks5Connect(conn net.Conn, remote string) error {
+	method := statute.MethodNoAuth
+	if u.user != nil {
+		method = statute.MethodUserPassAuth
+	}
+	if _, err := conn.Write(statute.NewMethodRequest(statute.VersionSocks5, []byte{method}).Bytes()); err != nil {
+		return err
+	}
+	reply, err := statute.ParseMethodReply(conn)
+	if err != nil {
+		return err
+	}
+	if reply.Method != method {
+		return statute.ErrNoSupportedAuth
+	}
+	if method == statute.MethodUserPassAuth {
+		pass, _ := u.user.Password()
+		if _, err := conn.Write(statute.NewUserPassRequest(statute.UserPassAuthVersion, []byte(u.user.Username()), []byte(pass)).Bytes()); err != nil {
+			return err
+		}
+		reply, err := statute.ParseUserPassReply(conn)
+		if err != nil {
+			return err
+		}
+		if reply.Status != statute.AuthSuccess {
+			return statute.ErrUserAuthFailed
+		}
+	}
+	dest, err := statute.ParseAddrSpec(remote)
+	if err != nil {
+		return err
+	}
+	req := statute.Request{Version: statute.VersionSocks5, Command: statute.CommandConnect, DstAddr: dest}
+	if _, err := conn.Write(req.Bytes()); err != nil {
+		return err
+	}
+	rep, err := statute.ParseReply(conn)
+	if err != nil {
+		return err
+	}
+	switch rep.Response {
+	case statute.RepSuccess:
+		return nil
+	case statute.RepRuleFailure, statute.RepNetworkUnreachable, statute.RepHostUnreachable,
+		statute.RepConnectionRefused, statute.RepTTLExpired:
+		return destinationError{fmt.Errorf("socks5 reply %d", rep.Response)}
+	default:
+		return fmt.Errorf("socks5 reply %d", rep.Response)
+	}
+}
+
+func (u *upstream) httpConnect(conn net.Conn, remote string) (net.Conn, error) {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: remote},
+		Host:   remote,
+		Header: http.Header{},
+	}
+	if u.user != nil {
+		pass, _ := u.user.Password()
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(u.user.Username()+":"+pass)))
+	}
+	if err := req.Write(conn); err != nil {
+		return conn, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return conn, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusProxyAuthRequired:
+		return conn, fmt.Errorf("CONNECT returned %s", resp.Status)
+	default:
+		// any other answer is the proxy's verdict on the destination
+		return conn, destinationError{fmt.Errorf("CONNECT returned %s", resp.Status)}
+	}
+	if br.Buffered() > 0 {
+		// the target spoke before we did; keep what was read along with the response
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// bufferedConn reads through r, which holds data already read from Conn
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+func portOf(addr string) string {
+	_, port, _ := net.SplitHostPort(addr)
+	return port
+}
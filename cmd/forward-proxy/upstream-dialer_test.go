@@ -0,0 +1,288 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+	"github.com/things-go/go-socks5"
+)
+
+// listen returns a loopback listener closed when the test ends
+func listen(t *testing.T) net.Listener {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	return l
+}
+
+// echoServer returns the address of a server that echoes whatever it receives
+func echoServer(t *testing.T) string {
+	l := listen(t)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				io.Copy(c, c)
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// closedAddr returns an address nothing listens on
+func closedAddr(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// countingListener counts accepted connections
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return c, err
+}
+
+func socks5Upstream(t *testing.T) (string, *countingListener) {
+	l := &countingListener{Listener: listen(t)}
+	go socks5.NewServer().Serve(l)
+	return l.Addr().String(), l
+}
+
+// httpConnectUpstream is a minimal CONNECT proxy that answers 502 when the target can't be dialed
+func httpConnectUpstream(t *testing.T) (string, *countingListener) {
+	l := &countingListener{Listener: listen(t)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil || req.Method != http.MethodConnect {
+					return
+				}
+				target, err := net.Dial("tcp", req.Host)
+				if err != nil {
+					io.WriteString(c, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+					return
+				}
+				defer target.Close()
+				io.WriteString(c, "HTTP/1.1 200 Connection established\r\n\r\n")
+				go io.Copy(target, c)
+				io.Copy(c, target)
+			}()
+		}
+	}()
+	return l.Addr().String(), l
+}
+
+func testRouter(t *testing.T, via ...string) *upstreamRouter {
+	t.Helper()
+	rule, err := newUpstreamRule(upstreamRuleConfig{Match: destinationPatterns{"*"}, Via: via})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &upstreamRouter{rules: []*upstreamRule{rule}}
+}
+
+func assertEcho(t *testing.T, conn net.Conn) {
+	t.Helper()
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "ping"); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("echo = %q, %v", buf, err)
+	}
+}
+
+func TestUpstreamDial(t *testing.T) {
+	echo := echoServer(t)
+	socksAddr, _ := socks5Upstream(t)
+	httpAddr, _ := httpConnectUpstream(t)
+	for _, via := range []string{"socks5://" + socksAddr, "http://" + httpAddr} {
+		t.Run(via, func(t *testing.T) {
+			conn, err := testRouter(t, via).dial(context.Background(), "tcp", echo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertEcho(t, conn)
+		})
+	}
+}
+
+func TestUpstreamFailover(t *testing.T) {
+	echo := echoServer(t)
+	socksAddr, _ := socks5Upstream(t)
+	r := testRouter(t, "socks5://"+closedAddr(t), "socks5://"+socksAddr)
+	conn, err := r.dial(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	route := r.rules[0].route
+	if !route[0].down(time.Now()) {
+		t.Error("unreachable upstream not marked down")
+	}
+	if route[1].down(time.Now()) {
+		t.Error("working upstream marked down")
+	}
+}
+
+// An upstream that reports the destination unreachable is healthy: it stays in service and
+// the next upstream isn't tried for the same destination
+func TestUpstreamDestinationErrorKeepsUpstream(t *testing.T) {
+	unreachable := closedAddr(t)
+	socksAddr, _ := socks5Upstream(t)
+	httpAddr, httpL := httpConnectUpstream(t)
+	tests := []struct {
+		name     string
+		via      []string
+		fallback *countingListener
+	}{
+		{"socks5", []string{"socks5://" + socksAddr, "http://" + httpAddr}, httpL},
+		{"http", []string{"http://" + httpAddr}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var before int64
+			if tt.fallback != nil {
+				before = tt.fallback.accepted.Load()
+			}
+			r := testRouter(t, tt.via...)
+			_, err := r.dial(context.Background(), "tcp", unreachable)
+			var derr destinationError
+			if !errors.As(err, &derr) {
+				t.Fatalf("dial error = %v, want a destination error", err)
+			}
+			if r.rules[0].route[0].down(time.Now()) {
+				t.Error("upstream marked down for an unreachable destination")
+			}
+			if tt.fallback != nil && tt.fallback.accepted.Load() != before {
+				t.Error("fell over to the next upstream")
+			}
+		})
+	}
+}
+
+func TestUpstreamRuleMatching(t *testing.T) {
+	rules := []upstreamRuleConfig{
+		{Match: destinationPatterns{"*.corp.example"}, Via: []string{"socks5://10.0.0.1:1080"}},
+		{Match: destinationPatterns{"10.1.0.0/16"}, Via: []string{"http://10.0.0.2:3128"}},
+		{Client: "192.168.1.0/24", Source: "127.0.0.1"},
+		{List: "streaming", Via: []string{"socks5://10.0.0.3:1080"}},
+		{Profile: "vpn", Client: "10.8.0.0/24", Source: "127.0.0.1"},
+	}
+	r := &upstreamRouter{lists: forwardproxy.NewStaticFQDNBlocker(
+		forwardproxy.WithStaticFQDNBlockList("streaming", []string{"netflix.com"}),
+	)}
+	for _, cfg := range rules {
+		rule, err := newUpstreamRule(cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	tests := []struct {
+		name    string
+		ip      string
+		client  string
+		profile string
+		want    int
+	}{
+		{"git.corp.example", "", "", "", 0},
+		{"corp.example", "", "", "", -1},
+		{"db.internal", "10.1.2.3", "", "", 1},
+		{"example.com", "", "192.168.1.7", "", 2},
+		{"example.com", "", "192.168.2.7", "", -1},
+		{"www.netflix.com", "", "", "", 3},
+		{"example.com", "", "10.8.0.9", "vpn", 4},
+		{"example.com", "", "10.8.0.9", "", -1},
+		{"example.com", "", "10.9.0.9", "vpn", -1},
+	}
+	for _, tt := range tests {
+		got := r.rule(tt.name, net.ParseIP(tt.ip), net.ParseIP(tt.client), tt.profile)
+		want := (*upstreamRule)(nil)
+		if tt.want >= 0 {
+			want = r.rules[tt.want]
+		}
+		if got != want {
+			t.Errorf("rule(%s, %s, %s) = %v, want rule %d", tt.name, tt.ip, tt.client, got, tt.want)
+		}
+	}
+	if !r.resolvesRemotely("git.corp.example") || !r.resolvesRemotely("netflix.com") || r.resolvesRemotely("example.com") {
+		t.Error("resolvesRemotely disagrees with the rules")
+	}
+
+	profiles := map[string]*forwardproxy.PolicyProfile{"vpn": {Name: "vpn"}}
+	if err := r.checkNames(map[string]int{"streaming": 1}, profiles); err != nil {
+		t.Error(err)
+	}
+	if err := r.checkNames(map[string]int{}, profiles); err == nil {
+		t.Error("unknown block list accepted")
+	}
+	if err := r.checkNames(map[string]int{"streaming": 1}, nil); err == nil {
+		t.Error("unknown profile accepted")
+	}
+}
+
+// The profile of the listener travels in the request context from the rules to the dialer
+func TestUpstreamDialByProfile(t *testing.T) {
+	echo := echoServer(t)
+	socksAddr, socksL := socks5Upstream(t)
+	rule, err := newUpstreamRule(upstreamRuleConfig{Profile: "vpn", Via: []string{"socks5://" + socksAddr}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &upstreamRouter{rules: []*upstreamRule{rule}}
+
+	conn, err := r.dial(context.Background(), "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if socksL.accepted.Load() != 0 {
+		t.Fatal("connection without the profile went via the upstream")
+	}
+	ctx := forwardproxy.ContextWithPolicyProfile(context.Background(), &forwardproxy.PolicyProfile{Name: "vpn"})
+	conn, err = r.dial(ctx, "tcp", echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertEcho(t, conn)
+	if socksL.accepted.Load() != 1 {
+		t.Fatal("connection with the profile didn't go via the upstream")
+	}
+}
@@ -0,0 +1,331 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+var (
+	webhookBatchSize     = 100
+	webhookFlushInterval = 2 * time.Second
+	webhookTimeout       = 10 * time.Second
+	webhookRetries       = 3
+	webhookRetryBackoff  = time.Second
+	// bounds Close; deliveries still running then give up and go to the spool
+	webhookCloseTimeout = 5 * time.Second
+)
+
+// webhookHistLogger POSTs events to an HTTP endpoint as JSON arrays of up to webhookBatchSize
+// events. A batch that still fails after webhookRetries attempts is written to the spool, if
+// one is configured, and replayed oldest first when the logger starts and whenever the
+// endpoint accepts a batch again.
+type webhookHistLogger struct {
+	endpoint string
+	client   *http.Client
+	spool    *fileSpool
+	// internal
+	events    chan forwardproxy.HistEvent
+	dropped   atomic.Uint64
+	stop      context.CancelFunc
+	sendCtx   context.Context
+	abort     context.CancelFunc
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newWebhookHistLogger(endpoint string, spoolDir string, spoolMaxBytes int64) (*webhookHistLogger, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook url %s: %w", endpoint, err)
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("unsupported webhook scheme %q: expected http or https", u.Scheme)
+	}
+	result := &webhookHistLogger{
+		endpoint: endpoint,
+		client:   &http.Client{Timeout: webhookTimeout},
+		events:   make(chan forwardproxy.HistEvent, maxEventBuffer),
+		done:     make(chan struct{}),
+	}
+	if spoolDir != "" {
+		spool, err := newFileSpool(spoolDir, spoolMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		result.spool = spool
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	result.stop = cancel
+	result.sendCtx, result.abort = context.WithCancel(context.Background())
+	go result.run(ctx)
+	return result, nil
+}
+
+func (w *webhookHistLogger) LogAccepted(fqdn string) {
+	w.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn})
+}
+
+func (w *webhookHistLogger) LogBlocked(fqdn string) {
+	w.LogEvent(forwardproxy.HistEvent{Time: time.Now(), FQDN: fqdn, Blocked: true})
+}
+
+// LogEvent implements forwardproxy.HistEventLogger and never blocks
+func (w *webhookHistLogger) LogEvent(ev forwardproxy.HistEvent) {
+	select {
+	case w.events <- ev:
+	default:
+		w.dropped.Add(1)
+	}
+}
+
+// Close flushes queued events, spooling them if the endpoint is unavailable or doesn't take
+// them within webhookCloseTimeout
+func (w *webhookHistLogger) Close() error {
+	w.closeOnce.Do(func() {
+		deadline := time.AfterFunc(webhookCloseTimeout, w.abort)
+		defer deadline.Stop()
+		w.stop()
+		<-w.done
+		w.abort()
+	})
+	return nil
+}
+
+func (w *webhookHistLogger) run(ctx context.Context) {
+	defer close(w.done)
+	// batches left over from the last run go first
+	w.replaySpool(ctx)
+	var reportedDropped uint64
+	batch := make([]jsonHistEvent, 0, webhookBatchSize)
+	flush := func(sendCtx context.Context) {
+		if len(batch) == 0 {
+			return
+		}
+		w.deliver(sendCtx, batch)
+		batch = make([]jsonHistEvent, 0, webhookBatchSize)
+	}
+	ticker := time.NewTicker(webhookFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case ev := <-w.events:
+			batch = append(batch, newJSONHistEvent(ev))
+			if len(batch) >= webhookBatchSize {
+				flush(ctx)
+			}
+		case <-ticker.C:
+			flush(ctx)
+			if dropped := w.dropped.Load(); dropped != reportedDropped {
+				log.Printf("webhook logger dropped %d events (%d total)", dropped-reportedDropped, dropped)
+				reportedDropped = dropped
+			}
+		case <-ctx.Done():
+			// one last attempt without retries; whatever fails goes to the spool
+			for len(w.events) > 0 {
+				batch = append(batch, newJSONHistEvent(<-w.events))
+				if len(batch) >= webhookBatchSize {
+					flush(ctx)
+				}
+			}
+			flush(ctx)
+			return
+		}
+	}
+}
+
+// deliver sends batch, falling back to the spool, and drains the spool after a success
+func (w *webhookHistLogger) deliver(ctx context.Context, batch []jsonHistEvent) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		log.Printf("unable to encode webhook batch: %v", err)
+		return
+	}
+	if err := w.postWithRetry(ctx, body); err != nil {
+		if w.spool == nil {
+			w.dropped.Add(uint64(len(batch)))
+			log.Printf("webhook delivery of %d events failed: %v", len(batch), err)
+			return
+		}
+		if err := w.spool.push(body); err != nil {
+			w.dropped.Add(uint64(len(batch)))
+			log.Printf("unable to spool %d webhook events: %v", len(batch), err)
+		}
+		return
+	}
+	w.replaySpool(ctx)
+}
+
+func (w *webhookHistLogger) replaySpool(ctx context.Context) {
+	if w.spool == nil {
+		return
+	}
+	for {
+		name, body, ok := w.spool.oldest()
+		if !ok {
+			return
+		}
+		if err := w.post(body); err != nil {
+			if w.sendCtx.Err() == nil {
+				log.Printf("webhook replay of %s failed: %v", filepath.Base(name), err)
+			}
+			return
+		}
+		w.spool.remove(name)
+		if ctx.Err() != nil {
+			// shutting down: leave the rest for the next start
+			return
+		}
+	}
+}
+
+// postWithRetry retries with exponential backoff; once ctx is done a single attempt is made
+func (w *webhookHistLogger) postWithRetry(ctx context.Context, body []byte) error {
+	backoff := webhookRetryBackoff
+	var err error
+	for attempt := 0; attempt < webhookRetries; attempt++ {
+		if err = w.post(body); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+			backoff *= 2
+		}
+	}
+	return err
+}
+
+// post ignores shutdown so the final flush still gets a chance to be delivered; only the
+// Close deadline cuts it short
+func (w *webhookHistLogger) post(body []byte) error {
+	req, err := http.NewRequestWithContext(w.sendCtx, http.MethodPost, w.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+const spoolFileSuffix = ".json"
+
+// fileSpool is a directory of undelivered batches, one file each, bounded to maxBytes by
+// evicting the oldest batches
+type fileSpool struct {
+	dir      string
+	maxBytes int64
+}
+
+func newFileSpool(dir string, maxBytes int64) (*fileSpool, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create webhook spool %s: %w", dir, err)
+	}
+	return &fileSpool{dir: dir, maxBytes: maxBytes}, nil
+}
+
+func (s *fileSpool) push(body []byte) error {
+	if s.maxBytes > 0 && int64(len(body)) > s.maxBytes {
+		return fmt.Errorf("batch of %d bytes exceeds spool limit", len(body))
+	}
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d%s", time.Now().UnixNano(), spoolFileSuffix))
+	if err := writeFileAtomic(name, body, 0644, ""); err != nil {
+		return err
+	}
+	s.evict()
+	return nil
+}
+
+// oldest returns the oldest spooled batch
+func (s *fileSpool) oldest() (string, []byte, bool) {
+	files := s.files()
+	for _, f := range files {
+		body, err := os.ReadFile(f.name)
+		if err != nil {
+			log.Printf("unable to read spooled webhook batch %s: %v", f.name, err)
+			s.remove(f.name)
+			continue
+		}
+		return f.name, body, true
+	}
+	return "", nil, false
+}
+
+func (s *fileSpool) remove(name string) {
+	if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+		log.Printf("unable to remove spooled webhook batch %s: %v", name, err)
+	}
+}
+
+func (s *fileSpool) evict() {
+	if s.maxBytes <= 0 {
+		return
+	}
+	files := s.files()
+	var total int64
+	for _, f := range files {
+		total += f.size
+	}
+	evicted := 0
+	for _, f := range files {
+		if total <= s.maxBytes {
+			break
+		}
+		s.remove(f.name)
+		total -= f.size
+		evicted++
+	}
+	if evicted > 0 {
+		log.Printf("webhook spool full: evicted %d oldest batches", evicted)
+	}
+}
+
+type spoolFile struct {
+	name string
+	size int64
+}
+
+// files lists spooled batches oldest first; names are zero-padded timestamps so they sort
+func (s *fileSpool) files() []spoolFile {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		log.Printf("unable to read webhook spool %s: %v", s.dir, err)
+		return nil
+	}
+	result := make([]spoolFile, 0, len(entries))
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasSuffix(e.Name(), spoolFileSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		result = append(result, spoolFile{name: filepath.Join(s.dir, e.Name()), size: info.Size()})
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].name < result[j].name })
+	return result
+}
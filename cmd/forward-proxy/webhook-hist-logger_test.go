@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	forwardproxy "github.com/arunsworld/forward-proxy"
+)
+
+// webhookEndpoint records the events of every batch it accepts
+type webhookEndpoint struct {
+	mu     sync.Mutex
+	events []jsonHistEvent
+}
+
+func (e *webhookEndpoint) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var batch []jsonHistEvent
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	e.mu.Lock()
+	e.events = append(e.events, batch...)
+	e.mu.Unlock()
+}
+
+func (e *webhookEndpoint) received() []jsonHistEvent {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return append([]jsonHistEvent(nil), e.events...)
+}
+
+func setWebhookTiming(t *testing.T, flush, closeTimeout time.Duration) {
+	oldFlush, oldClose, oldBackoff := webhookFlushInterval, webhookCloseTimeout, webhookRetryBackoff
+	webhookFlushInterval, webhookCloseTimeout, webhookRetryBackoff = flush, closeTimeout, 10*time.Millisecond
+	t.Cleanup(func() {
+		webhookFlushInterval, webhookCloseTimeout, webhookRetryBackoff = oldFlush, oldClose, oldBackoff
+	})
+}
+
+func TestWebhookHistLoggerDelivers(t *testing.T) {
+	setWebhookTiming(t, 20*time.Millisecond, time.Second)
+	endpoint := &webhookEndpoint{}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+	w, err := newWebhookHistLogger(srv.URL, "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.LogEvent(forwardproxy.HistEvent{FQDN: "ads.com", Blocked: true, List: "ads"})
+	w.LogAccepted("example.com")
+	w.Close()
+	if got := endpoint.received(); len(got) != 2 || got[0].FQDN != "ads.com" || got[1].FQDN != "example.com" {
+		t.Errorf("received %+v", got)
+	}
+}
+
+func TestWebhookHistLoggerCloseIsBounded(t *testing.T) {
+	setWebhookTiming(t, time.Hour, 100*time.Millisecond)
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+		<-release
+	}))
+	defer srv.Close()
+	defer close(release)
+	dir := t.TempDir()
+	w, err := newWebhookHistLogger(srv.URL, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*webhookBatchSize; i++ {
+		w.LogBlocked("ads.com")
+	}
+
+	start := time.Now()
+	w.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Close took %v", elapsed)
+	}
+	spool, _ := newFileSpool(dir, 0)
+	if files := spool.files(); len(files) != 3 {
+		t.Errorf("spooled %d batches, want 3", len(files))
+	}
+}
+
+func TestWebhookHistLoggerReplaysSpoolAtStartup(t *testing.T) {
+	setWebhookTiming(t, time.Hour, time.Second)
+	dir := t.TempDir()
+	spool, err := newFileSpool(dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal([]jsonHistEvent{newJSONHistEvent(forwardproxy.HistEvent{FQDN: "spooled.com"})})
+	if err := spool.push(body); err != nil {
+		t.Fatal(err)
+	}
+
+	endpoint := &webhookEndpoint{}
+	srv := httptest.NewServer(endpoint)
+	defer srv.Close()
+	w, err := newWebhookHistLogger(srv.URL, dir, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(endpoint.received()) == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := endpoint.received(); len(got) != 1 || got[0].FQDN != "spooled.com" {
+		t.Fatalf("received %+v", got)
+	}
+	if files := spool.files(); len(files) != 0 {
+		t.Errorf("%d batches left in the spool", len(files))
+	}
+}
@@ -1,6 +1,42 @@
 package forwardproxy
 
+import "time"
+
 type HistLogger interface {
 	LogAccepted(fqdn string)
 	LogBlocked(fqdn string)
 }
+
+// HistEvent describes a single accepted or blocked request
+type HistEvent struct {
+	Time    time.Time
+	FQDN    string
+	Blocked bool
+	// List is the block list responsible for a block
+	List string
+	// Client is the address of the proxy client
+	Client string
+	// User is the authenticated SOCKS5 user, if any
+	User string
+	// Port is the destination port
+	Port int
+}
+
+// HistEventLogger is implemented by HistLoggers that want the full event rather than just the FQDN
+type HistEventLogger interface {
+	HistLogger
+	LogEvent(ev HistEvent)
+}
+
+// LogHistEvent hands ev to hl, using LogEvent when hl supports it and the simple methods otherwise
+func LogHistEvent(hl HistLogger, ev HistEvent) {
+	if el, ok := hl.(HistEventLogger); ok {
+		el.LogEvent(ev)
+		return
+	}
+	if ev.Blocked {
+		hl.LogBlocked(ev.FQDN)
+	} else {
+		hl.LogAccepted(ev.FQDN)
+	}
+}
@@ -0,0 +1,33 @@
+package forwardproxy
+
+import (
+	"encoding/csv"
+	"io"
+	"log"
+)
+
+// ParseIPHostFile returns the host names of a hosts-style block list with lines such as
+// "0.0.0.0 example.com". Fields are separated by comma and lines starting with comment are
+// skipped, as are malformed lines, which are logged.
+func ParseIPHostFile(r io.Reader, comma, comment rune) []string {
+	cr := csv.NewReader(r)
+	cr.Comma = comma
+	cr.TrimLeadingSpace = true
+	cr.LazyQuotes = true
+	cr.FieldsPerRecord = 2
+	cr.Comment = comment
+
+	result := []string{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("\terror while reading: %v", err)
+			continue
+		}
+		result = append(result, record[1])
+	}
+	return result
+}
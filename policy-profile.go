@@ -0,0 +1,53 @@
+package forwardproxy
+
+import "context"
+
+// PolicyProfile adjusts the decisions of a StaticFQDNBlocker for requests whose context
+// carries it, for example all requests arriving on one listener
+type PolicyProfile struct {
+	Name string
+	// Unfiltered allows every destination; outcomes are still logged and recorded
+	Unfiltered bool
+	// Lists limits blocking to the named block lists and the runtime list; empty applies them all
+	Lists []string
+	// AllowIPOnly overrides WithIPOnlyTrafficAllowed when set
+	AllowIPOnly *bool
+}
+
+type policyProfileKey struct{}
+
+// ContextWithPolicyProfile returns a copy of ctx whose requests are decided under p
+func ContextWithPolicyProfile(ctx context.Context, p *PolicyProfile) context.Context {
+	return context.WithValue(ctx, policyProfileKey{}, p)
+}
+
+// PolicyProfileFrom returns the profile carried by ctx, or nil for the blocker's own policy
+func PolicyProfileFrom(ctx context.Context) *PolicyProfile {
+	p, _ := ctx.Value(policyProfileKey{}).(*PolicyProfile)
+	return p
+}
+
+func unfiltered(ctx context.Context) bool {
+	p := PolicyProfileFrom(ctx)
+	return p != nil && p.Unfiltered
+}
+
+func (p *PolicyProfile) appliesList(name string) bool {
+	if p == nil || len(p.Lists) == 0 || name == RuntimeBlockListName {
+		return true
+	}
+	for _, v := range p.Lists {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsIPOnly reports whether destinations given only as an IP address are allowed under p
+func (cc *StaticFQDNBlocker) allowsIPOnly(p *PolicyProfile) bool {
+	if p != nil && p.AllowIPOnly != nil {
+		return *p.AllowIPOnly
+	}
+	return cc.allowIPOnlyTraffic
+}
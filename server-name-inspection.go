@@ -0,0 +1,347 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// ServerNameMismatchList is reported as the block list when, under WithStrictServerNameMatch,
+// the server named by TLS SNI or the HTTP Host header differs from the FQDN the client asked
+// the proxy for
+const ServerNameMismatchList = "Server name mismatch"
+
+const recordTypeHandshake = 0x16
+
+var (
+	// serverNamePeekTimeout bounds how long a connection waits for the client to speak
+	serverNamePeekTimeout = 10 * time.Second
+	// bounds the ClientHello, split over however many records, and the HTTP request head we
+	// look at
+	maxServerNamePeek = 64 << 10
+
+	errServerNameFound = errors.New("server name found")
+)
+
+// WithServerNameInspection checks the TLS SNI or HTTP Host header of CONNECT streams against
+// the block lists. Connections to IP literals are then decided by the name the client sends,
+// falling back to WithIPOnlyTrafficAllowed when there is none, and a connection to an allowed
+// FQDN is still blocked when it names a blocked server. Requires ConnectHandle to be installed.
+//
+// Only the start of a stream is inspected: later requests on a keep-alive HTTP connection are
+// relayed without looking at their Host, as is anything a TLS session carries.
+func WithServerNameInspection() StaticFQDNBlockerOpt {
+	return func(cc *StaticFQDNBlocker) {
+		cc.inspectServerName = true
+	}
+}
+
+// WithStrictServerNameMatch is WithServerNameInspection that also blocks connections whose
+// server name differs from the requested FQDN, reporting ServerNameMismatchList. Names
+// legitimately differ for CDN-fronted sites or a CONNECT to example.com that sends
+// www.example.com, so this is only for clients known to name servers consistently.
+func WithStrictServerNameMatch() StaticFQDNBlockerOpt {
+	return func(cc *StaticFQDNBlocker) {
+		cc.inspectServerName = true
+		cc.strictServerName = true
+	}
+}
+
+// ConnectHandle returns a handler for socks5.WithConnectHandle that behaves like the default
+// handler but, with WithServerNameInspection, peeks at what the client sends first and applies
+// the block lists to the server name found there before relaying anything to the target.
+//
+// A SOCKS client only speaks once it has been told the connection succeeded, so the name always
+// arrives after the success reply. When the destination is allowed on its own the target is
+// dialled first, as the default handler does, so that dial errors reach the client and servers
+// that speak first (SSH, SMTP) work. When only the name can allow the connection, or a block
+// page may be served, the reply is sent without dialling and the target is dialled once the
+// name has been checked, so a blocked server is never contacted.
+func (cc *StaticFQDNBlocker) ConnectHandle(dial func(ctx context.Context, network, addr string) (net.Conn, error)) func(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	return func(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+		if info, ok := ctx.Value(blockPageKey{}).(blockPageInfo); ok {
+			return cc.serveBlockPageConnect(writer, req, info)
+		}
+		errCh := make(chan error, 2)
+		toClient := func(target net.Conn) {
+			_, err := io.Copy(writer, target)
+			closeWrite(writer)
+			errCh <- err
+		}
+		if !cc.inspectServerName {
+			target, err := connectTarget(ctx, dial, writer, req)
+			if err != nil {
+				return err
+			}
+			defer target.Close()
+			go toClient(target)
+			go func() {
+				_, err := io.Copy(target, req.Reader)
+				closeWrite(target)
+				errCh <- err
+			}()
+			return waitForRelay(errCh)
+		}
+
+		servesBlockPage := cc.blockPage != nil && req.DestAddr.Port == 80
+		early := (req.DestAddr.FQDN != "" || cc.allowsIPOnly(PolicyProfileFrom(ctx))) && !servesBlockPage
+		var target net.Conn
+		if early {
+			var err error
+			if target, err = connectTarget(ctx, dial, writer, req); err != nil {
+				return err
+			}
+			defer target.Close()
+			go toClient(target)
+		} else if err := socks5.SendReply(writer, statute.RepSuccess, bindAddrOf(writer)); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+
+		client := bufio.NewReaderSize(req.Reader, maxServerNamePeek)
+		conn, _ := writer.(net.Conn)
+		if conn != nil {
+			conn.SetReadDeadline(time.Now().Add(serverNamePeekTimeout))
+		}
+		name, kind := peekServerName(client)
+		if conn != nil {
+			conn.SetReadDeadline(time.Time{})
+		}
+		if reason := cc.checkServerName(ctx, req, name, kind); reason != "" {
+			if servesBlockPage {
+				cc.serveBlockPage(writer, client, blockPageInfo{fqdn: blockPageName(req, name), list: reason})
+			}
+			return fmt.Errorf("connect to %v blocked by %s %s", req.RawDestAddr, kind, name)
+		}
+		if target == nil {
+			var err error
+			if target, err = dial(ctx, "tcp", req.DestAddr.String()); err != nil {
+				// too late for an error reply; closing the connection is all the client gets
+				return fmt.Errorf("connect to %v failed, %v", req.RawDestAddr, err)
+			}
+			defer target.Close()
+			go toClient(target)
+		}
+		go func() {
+			_, err := io.Copy(target, client)
+			closeWrite(target)
+			errCh <- err
+		}()
+		return waitForRelay(errCh)
+	}
+}
+
+// connectTarget dials the destination and answers the client with the outcome
+func connectTarget(ctx context.Context, dial func(ctx context.Context, network, addr string) (net.Conn, error), writer io.Writer, req *socks5.Request) (net.Conn, error) {
+	target, err := dial(ctx, "tcp", req.DestAddr.String())
+	if err != nil {
+		msg := err.Error()
+		resp := statute.RepHostUnreachable
+		if strings.Contains(msg, "refused") {
+			resp = statute.RepConnectionRefused
+		} else if strings.Contains(msg, "network is unreachable") {
+			resp = statute.RepNetworkUnreachable
+		}
+		if err := socks5.SendReply(writer, resp, nil); err != nil {
+			return nil, fmt.Errorf("failed to send reply, %v", err)
+		}
+		return nil, fmt.Errorf("connect to %v failed, %v", req.RawDestAddr, err)
+	}
+	if err := socks5.SendReply(writer, statute.RepSuccess, target.LocalAddr()); err != nil {
+		target.Close()
+		return nil, fmt.Errorf("failed to send reply, %v", err)
+	}
+	return target, nil
+}
+
+// bindAddrOf is the address reported to a client answered without dialling the target
+func bindAddrOf(writer io.Writer) net.Addr {
+	if conn, ok := writer.(net.Conn); ok {
+		return conn.LocalAddr()
+	}
+	return &net.TCPAddr{IP: net.IPv4zero}
+}
+
+// checkServerName decides a connection once the client has (or hasn't) named the server and
+// returns why it is blocked, or "" when it is allowed
+func (cc *StaticFQDNBlocker) checkServerName(ctx context.Context, req *socks5.Request, name, kind string) string {
+	fqdn := req.DestAddr.FQDN
+	switch {
+	case name == "" && fqdn == "":
+		_, reason := cc.decide(ctx, req, req.DestAddr)
+		return reason
+	case name == "":
+		// already checked by Allow
+		return ""
+	case fqdn == "":
+		dest := *req.DestAddr
+		dest.FQDN = name
+		_, reason := cc.decide(ctx, req, &dest)
+		return reason
+	case strings.EqualFold(strings.TrimSuffix(fqdn, "."), name):
+		return ""
+	case cc.strictServerName && !unfiltered(ctx):
+		log.Printf("[StaticFQDNBlocker] %s %s does not match requested %s", kind, name, fqdn)
+		dest := *req.DestAddr
+		dest.FQDN = name
+		cc.report(req, &dest, ServerNameMismatchList)
+		return ServerNameMismatchList
+	}
+	// the requested FQDN was allowed by Allow; only a block of the name is worth reporting
+	name = strings.ToLower(name)
+	if allow, reason := cc.allow(PolicyProfileFrom(ctx), name); !allow {
+		log.Printf("[StaticFQDNBlocker] %s %s requested as %s", kind, name, fqdn)
+		dest := *req.DestAddr
+		dest.FQDN = name
+		cc.report(req, &dest, reason)
+		return reason
+	}
+	return ""
+}
+
+func waitForRelay(errCh chan error) error {
+	for i := 0; i < 2; i++ {
+		if err := <-errCh; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func closeWrite(v interface{}) {
+	if c, ok := v.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	}
+}
+
+// peekServerName returns the server named by a TLS ClientHello ("SNI") or an HTTP request
+// ("Host") at the start of r without consuming anything. An empty name means none was found.
+func peekServerName(r *bufio.Reader) (string, string) {
+	head, err := r.Peek(5)
+	if err != nil {
+		return "", ""
+	}
+	if head[0] == recordTypeHandshake && head[1] == 0x03 {
+		return normaliseServerName(serverNameFromClientHello(peekClientHello(r))), "SNI"
+	}
+	if looksLikeHTTPMethod(head) {
+		return normaliseServerName(hostFromHTTPHead(r)), "Host"
+	}
+	return "", ""
+}
+
+// peekClientHello returns the TLS records that carry the first handshake message, which a
+// client may split across as many records as it likes, or nil when they don't fit the buffer
+func peekClientHello(r *bufio.Reader) []byte {
+	var msgHead []byte // type and length of the handshake message
+	carried := 0
+	for n := 0; ; {
+		head, err := r.Peek(n + 5)
+		if err != nil || head[n] != recordTypeHandshake {
+			return nil
+		}
+		end := n + 5 + (int(head[n+3])<<8 | int(head[n+4]))
+		if end > maxServerNamePeek {
+			return nil
+		}
+		records, err := r.Peek(end)
+		if err != nil {
+			return nil
+		}
+		fragment := records[n+5:]
+		for len(msgHead) < 4 && len(fragment) > 0 {
+			msgHead = append(msgHead, fragment[0])
+			fragment = fragment[1:]
+		}
+		carried += end - n - 5
+		if len(msgHead) == 4 && carried >= 4+(int(msgHead[1])<<16|int(msgHead[2])<<8|int(msgHead[3])) {
+			return records
+		}
+		n = end
+	}
+}
+
+// serverNameFromClientHello lets crypto/tls parse the ClientHello and stops the handshake
+// as soon as the SNI is known
+func serverNameFromClientHello(record []byte) string {
+	var name string
+	srv := tls.Server(&peekedConn{r: bytes.NewReader(record)}, &tls.Config{
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			name = hello.ServerName
+			return nil, errServerNameFound
+		},
+	})
+	srv.Handshake()
+	return name
+}
+
+func looksLikeHTTPMethod(head []byte) bool {
+	for i, c := range head {
+		if c == ' ' && i > 2 {
+			return true
+		}
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// hostFromHTTPHead waits for a complete request head and returns its Host
+func hostFromHTTPHead(r *bufio.Reader) string {
+	for n := r.Buffered(); n < maxServerNamePeek; n = r.Buffered() {
+		buf, _ := r.Peek(n)
+		if i := bytes.Index(buf, []byte("\r\n\r\n")); i >= 0 {
+			req, err := http.ReadRequest(bufio.NewReader(bytes.NewReader(buf[:i+4])))
+			if err != nil {
+				return ""
+			}
+			return req.Host
+		}
+		if _, err := r.Peek(n + 1); err != nil {
+			return ""
+		}
+	}
+	return ""
+}
+
+func normaliseServerName(name string) string {
+	if host, _, err := net.SplitHostPort(name); err == nil {
+		name = host
+	}
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	if net.ParseIP(strings.Trim(name, "[]")) != nil {
+		// an IP literal names nothing more than the destination already does
+		return ""
+	}
+	return name
+}
+
+// peekedConn feeds already peeked bytes to crypto/tls and discards whatever it writes
+type peekedConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *peekedConn) Read(p []byte) (int, error)         { return c.r.Read(p) }
+func (c *peekedConn) Write(p []byte) (int, error)        { return len(p), nil }
+func (c *peekedConn) Close() error                       { return nil }
+func (c *peekedConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *peekedConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *peekedConn) SetDeadline(t time.Time) error      { return nil }
+func (c *peekedConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *peekedConn) SetWriteDeadline(t time.Time) error { return nil }
@@ -0,0 +1,212 @@
+package forwardproxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// helloRecorder keeps what a TLS client writes; its reads fail so the handshake stops there
+type helloRecorder struct {
+	peekedConn
+	buf bytes.Buffer
+}
+
+func (c *helloRecorder) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+// clientHello returns the ClientHello record a TLS client sends for name
+func clientHello(t *testing.T, name string) []byte {
+	t.Helper()
+	rec := &helloRecorder{peekedConn: peekedConn{r: bytes.NewReader(nil)}}
+	tls.Client(rec, &tls.Config{ServerName: name}).Handshake()
+	if rec.buf.Len() < 5 || rec.buf.Bytes()[0] != recordTypeHandshake {
+		t.Fatalf("no ClientHello recorded: %x", rec.buf.Bytes())
+	}
+	return rec.buf.Bytes()
+}
+
+// fragment splits the payload of a single TLS record into records of at most size bytes
+func fragment(record []byte, size int) []byte {
+	var out []byte
+	for payload := record[5:]; len(payload) > 0; {
+		n := size
+		if n > len(payload) {
+			n = len(payload)
+		}
+		out = append(out, record[0], record[1], record[2], byte(n>>8), byte(n))
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+func TestPeekServerName(t *testing.T) {
+	hello := clientHello(t, "www.Example.com")
+	tests := []struct {
+		name     string
+		stream   []byte
+		wantName string
+		wantKind string
+	}{
+		{"ClientHello", hello, "www.example.com", "SNI"},
+		{"ClientHello in small records", fragment(hello, 16), "www.example.com", "SNI"},
+		{"handshake header split", fragment(hello, 1), "www.example.com", "SNI"},
+		{"truncated ClientHello", fragment(hello, 16)[:100], "", "SNI"},
+		{"HTTP", []byte("GET / HTTP/1.1\r\nHost: Example.org:8080\r\nAccept: */*\r\n\r\n"), "example.org", "Host"},
+		{"HTTP to an IP", []byte("GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n"), "", "Host"},
+		{"SSH", []byte("SSH-2.0-OpenSSH_9.6\r\n"), "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := bufio.NewReaderSize(bytes.NewReader(tt.stream), maxServerNamePeek)
+			name, kind := peekServerName(r)
+			if name != tt.wantName || kind != tt.wantKind {
+				t.Errorf("peekServerName() = %q, %q, want %q, %q", name, kind, tt.wantName, tt.wantKind)
+			}
+			if rest, _ := io.ReadAll(r); !bytes.Equal(rest, tt.stream) {
+				t.Error("peekServerName consumed the stream")
+			}
+		})
+	}
+}
+
+// socksConn returns the two ends of a loopback connection, the second playing the client
+func socksConn(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return server, client
+}
+
+func TestConnectHandleChecksNameBeforeDialling(t *testing.T) {
+	cc := NewStaticFQDNBlocker(
+		WithStaticFQDNBlockList("ads", []string{"ads.com"}),
+		WithServerNameInspection(),
+	)
+	tests := []struct {
+		sni     string
+		allowed bool
+	}{
+		{"tracker.ads.com", false},
+		{"www.example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.sni, func(t *testing.T) {
+			var dialled []string
+			targetEnd, target := net.Pipe()
+			defer targetEnd.Close()
+			handle := cc.ConnectHandle(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				dialled = append(dialled, addr)
+				return target, nil
+			})
+			server, client := socksConn(t)
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			req := connectRequest("", net.ParseIP("10.0.0.1"), 443)
+			req.Reader = server
+			done := make(chan error, 1)
+			go func() {
+				done <- handle(context.Background(), server, req)
+				server.Close()
+			}()
+
+			reply := make([]byte, 10)
+			if _, err := io.ReadFull(client, reply); err != nil || reply[1] != 0 {
+				t.Fatalf("reply = %x, %v", reply, err)
+			}
+			if len(dialled) != 0 {
+				t.Fatal("target dialled before the client named the server")
+			}
+			hello := fragment(clientHello(t, tt.sni), 64)
+			if _, err := client.Write(hello); err != nil {
+				t.Fatal(err)
+			}
+			if !tt.allowed {
+				if err := <-done; err == nil || !strings.Contains(err.Error(), "blocked") {
+					t.Errorf("handler returned %v", err)
+				}
+				if len(dialled) != 0 {
+					t.Errorf("blocked server dialled: %v", dialled)
+				}
+				return
+			}
+			got := make([]byte, len(hello))
+			targetEnd.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := io.ReadFull(targetEnd, got); err != nil || !bytes.Equal(got, hello) {
+				t.Fatalf("target received %d bytes, %v", len(got), err)
+			}
+			if len(dialled) != 1 || dialled[0] != "10.0.0.1:443" {
+				t.Errorf("dialled %v", dialled)
+			}
+			client.Close()
+			targetEnd.Close()
+			<-done
+		})
+	}
+}
+
+func TestCheckServerName(t *testing.T) {
+	open := ContextWithPolicyProfile(context.Background(), &PolicyProfile{Name: "open", Unfiltered: true})
+	tests := []struct {
+		name        string
+		ctx         context.Context
+		strict      bool
+		fqdn, sni   string
+		wantReason  string
+		wantBlocked string
+	}{
+		{"same name", context.Background(), false, "example.com", "EXAMPLE.com", "", ""},
+		{"www of the requested name", context.Background(), false, "example.com", "www.example.com", "", ""},
+		{"cdn fronted", context.Background(), false, "cdn.example.net", "www.example.com", "", ""},
+		{"blocked name behind an allowed fqdn", context.Background(), false, "example.com", "Tracker.Ads.com", "ads", "tracker.ads.com"},
+		{"ip literal named blocked", context.Background(), false, "", "ads.com", "ads", "ads.com"},
+		{"strict mismatch", context.Background(), true, "example.com", "www.example.com", ServerNameMismatchList, "www.example.com"},
+		{"strict match", context.Background(), true, "example.com.", "example.com", "", ""},
+		{"strict under an unfiltered profile", open, true, "example.com", "www.example.com", "", ""},
+		{"blocked name under an unfiltered profile", open, false, "example.com", "ads.com", "", ""},
+	}
+	for _, tt := range tests {
+		hl := &recordingHistLogger{}
+		opts := []StaticFQDNBlockerOpt{WithStaticFQDNBlockList("ads", []string{"ads.com"}), WithHistLogger(hl), WithServerNameInspection()}
+		if tt.strict {
+			opts = append(opts, WithStrictServerNameMatch())
+		}
+		cc := NewStaticFQDNBlocker(opts...)
+		var ip net.IP
+		if tt.fqdn == "" {
+			ip = net.ParseIP("10.0.0.1")
+		}
+		if got := cc.checkServerName(tt.ctx, connectRequest(tt.fqdn, ip, 443), tt.sni, "SNI"); got != tt.wantReason {
+			t.Errorf("%s: reason %q, want %q", tt.name, got, tt.wantReason)
+		}
+		var blocked []string
+		for _, ev := range hl.events {
+			if ev.Blocked {
+				blocked = append(blocked, ev.FQDN)
+			}
+		}
+		if tt.wantBlocked == "" && len(blocked) > 0 || tt.wantBlocked != "" && (len(blocked) != 1 || blocked[0] != tt.wantBlocked) {
+			t.Errorf("%s: recorded blocks %v, want %q", tt.name, blocked, tt.wantBlocked)
+		}
+	}
+}
@@ -2,15 +2,23 @@ package forwardproxy
 
 import (
 	"context"
-	"fmt"
 	"log"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/things-go/go-socks5"
 	"github.com/things-go/go-socks5/statute"
 )
 
-func NewStaticFQDNBlocker(opts ...StaticFQDNBlockerOpt) socks5.RuleSet {
+// RuntimeBlockListName is the block list holding FQDNs blocked through BlockFQDN
+const RuntimeBlockListName = "Runtime"
+
+// IPOnlyList is reported as the block list for destinations given only as an IP address
+// while IP-only traffic isn't allowed
+const IPOnlyList = "ip-only"
+
+func NewStaticFQDNBlocker(opts ...StaticFQDNBlockerOpt) *StaticFQDNBlocker {
 	result := &StaticFQDNBlocker{
 		allowOverrideFQDN: make(map[string]struct{}),
 	}
@@ -24,11 +32,16 @@ type StaticFQDNBlockerOpt func(*StaticFQDNBlocker)
 
 type StaticFQDNBlocker struct {
 	// internal
+	mu                            sync.RWMutex
 	blockedFQDN                   []blockList
 	acceptLogging, blockedLogging bool
 	histLogger                    HistLogger
 	allowIPOnlyTraffic            bool
 	allowOverrideFQDN             map[string]struct{}
+	bindPolicy, associatePolicy   CommandPolicy
+	inspectServerName             bool
+	strictServerName              bool
+	blockPage                     *blockPage
 }
 
 type blockList struct {
@@ -39,70 +52,226 @@ type blockList struct {
 func (cc *StaticFQDNBlocker) Allow(ctx context.Context, req *socks5.Request) (context.Context, bool) {
 	switch req.Command {
 	case statute.CommandConnect:
-		if allow, reason := cc.allow(req.DestAddr.FQDN, req.DestAddr.String()); !allow {
-			if cc.blockedLogging {
-				log.Printf("[StaticFQDNBlocker] Blocked traffic by %s to %s", reason, req.DestAddr.FQDN)
-			}
-			if cc.histLogger != nil {
-				cc.histLogger.LogBlocked(req.DestAddr.FQDN)
-			}
-			return ctx, false
-		} else {
-			if cc.acceptLogging {
-				if req.DestAddr.FQDN == "" {
-					log.Printf("[StaticFQDNBlocker] Allowed traffic to %s", req.DestAddr.String())
-				} else {
-					log.Printf("[StaticFQDNBlocker] Allowed traffic to %s", req.DestAddr.FQDN)
-				}
-			}
-			if cc.histLogger != nil {
-				if req.DestAddr.FQDN == "" {
-					cc.histLogger.LogAccepted(req.DestAddr.String())
-				} else {
-					cc.histLogger.LogAccepted(req.DestAddr.FQDN)
-				}
-			}
+		if cc.inspectServerName && req.DestAddr.FQDN == "" && req.Reader != nil {
+			// decided by ConnectHandle once the client has named the server; requests
+			// without a client stream to inspect are checked here as usual
 			return ctx, true
 		}
+		allow, reason := cc.decide(ctx, req, req.DestAddr)
+		if !allow && cc.blockPage != nil && req.DestAddr.Port == 80 && req.Reader != nil {
+			// accept the tunnel so ConnectHandle can explain the block to the browser
+			return context.WithValue(ctx, blockPageKey{}, blockPageInfo{
+				fqdn: blockPageName(req, ""),
+				list: reason,
+			}), true
+		}
+		return ctx, allow
 	case statute.CommandBind:
-		log.Println("[MyProxy] CommandBind")
+		switch cc.bindPolicy {
+		case CommandDisabled:
+			log.Printf("[StaticFQDNBlocker] Refused BIND from %s", req.RemoteAddr)
+			return ctx, false
+		case CommandFiltered:
+			return ctx, cc.check(ctx, req, req.DestAddr)
+		}
 	case statute.CommandAssociate:
-		log.Println("[MyProxy] CommandAssociate")
+		// DestAddr of an ASSOCIATE is where the client will send from, not a destination;
+		// filtering happens per datagram in UDPAssociateHandle
+		if cc.associatePolicy == CommandDisabled {
+			log.Printf("[StaticFQDNBlocker] Refused UDP ASSOCIATE from %s", req.RemoteAddr)
+			return ctx, false
+		}
 	}
 	return ctx, true
 }
 
-func (cc *StaticFQDNBlocker) allow(fqdn, address string) (bool, string) {
+// check applies the block lists to dest on behalf of req under the profile carried by ctx,
+// logging and recording the outcome
+func (cc *StaticFQDNBlocker) check(ctx context.Context, req *socks5.Request, dest *statute.AddrSpec) bool {
+	allow, _ := cc.decide(ctx, req, dest)
+	return allow
+}
+
+// decide is check that also returns the reason for a block
+func (cc *StaticFQDNBlocker) decide(ctx context.Context, req *socks5.Request, dest *statute.AddrSpec) (bool, string) {
+	allow, reason := cc.allow(PolicyProfileFrom(ctx), dest.FQDN)
+	cc.report(req, dest, reason)
+	return allow, reason
+}
+
+// report logs and records the outcome for dest; a non-empty reason means it was blocked.
+// Destinations without an FQDN are recorded under their address.
+func (cc *StaticFQDNBlocker) report(req *socks5.Request, dest *statute.AddrSpec, reason string) {
+	fqdn := dest.FQDN
 	if fqdn == "" {
-		if cc.allowIPOnlyTraffic {
+		fqdn = dest.String()
+	}
+	if reason != "" {
+		if cc.blockedLogging {
+			log.Printf("[StaticFQDNBlocker] Blocked traffic by %s to %s", reason, fqdn)
+		}
+	} else if cc.acceptLogging {
+		log.Printf("[StaticFQDNBlocker] Allowed traffic to %s", fqdn)
+	}
+	if cc.histLogger != nil {
+		LogHistEvent(cc.histLogger, newHistEvent(req, dest, fqdn, reason))
+	}
+}
+
+// newHistEvent describes req to dest; a non-empty list means it was blocked by that list
+func newHistEvent(req *socks5.Request, dest *statute.AddrSpec, fqdn, list string) HistEvent {
+	result := HistEvent{
+		Time:    time.Now(),
+		FQDN:    fqdn,
+		Blocked: list != "",
+		List:    list,
+		Port:    dest.Port,
+	}
+	if req.RemoteAddr != nil {
+		result.Client = req.RemoteAddr.String()
+	}
+	if req.AuthContext != nil {
+		result.User = req.AuthContext.Payload["username"]
+	}
+	return result
+}
+
+// allow decides fqdn under profile p, nil meaning the blocker's own policy; an empty fqdn is
+// an IP-only destination
+func (cc *StaticFQDNBlocker) allow(p *PolicyProfile, fqdn string) (bool, string) {
+	if p != nil && p.Unfiltered {
+		return true, ""
+	}
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	if fqdn == "" {
+		if cc.allowsIPOnly(p) {
 			return true, ""
 		}
-		return false, fmt.Sprintf("Empty FQDN for address: %s", address)
+		return false, IPOnlyList
 	}
 	if _, ok := cc.allowOverrideFQDN[fqdn]; ok {
 		return true, ""
 	}
-	var domainName string
-	// we need to extract domainName from fqdn to do our checks
-	fqdnSplits := strings.Split(fqdn, ".")
-	switch len(fqdnSplits) < 2 {
-	case true:
-		domainName = fqdn
-	case false:
-		lenfqdnSplits := len(fqdnSplits)
-		domainName = fqdnSplits[lenfqdnSplits-2] + "." + fqdnSplits[lenfqdnSplits-1]
-	}
+	domainName := domainNameOf(fqdn)
 	for _, bl := range cc.blockedFQDN {
-		if _, ok := bl.blockedFQDN[fqdn]; ok {
-			return false, bl.name
+		if !p.appliesList(bl.name) {
+			continue
 		}
-		if _, ok := bl.blockedFQDN[domainName]; ok {
+		if bl.contains(fqdn, domainName) {
 			return false, bl.name
 		}
 	}
 	return true, ""
 }
 
+// domainNameOf returns the last two labels of fqdn, the domain name lists also match it by
+func domainNameOf(fqdn string) string {
+	fqdnSplits := strings.Split(fqdn, ".")
+	if len(fqdnSplits) < 2 {
+		return fqdn
+	}
+	lenfqdnSplits := len(fqdnSplits)
+	return fqdnSplits[lenfqdnSplits-2] + "." + fqdnSplits[lenfqdnSplits-1]
+}
+
+func (bl blockList) contains(fqdn, domainName string) bool {
+	if _, ok := bl.blockedFQDN[fqdn]; ok {
+		return true
+	}
+	_, ok := bl.blockedFQDN[domainName]
+	return ok
+}
+
+// OnBlockList reports whether the named block list holds fqdn or its domain name, regardless
+// of allow overrides and policy profiles
+func (cc *StaticFQDNBlocker) OnBlockList(list, fqdn string) bool {
+	if fqdn == "" {
+		return false
+	}
+	domainName := domainNameOf(fqdn)
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	for _, bl := range cc.blockedFQDN {
+		if bl.name == list && bl.contains(fqdn, domainName) {
+			return true
+		}
+	}
+	return false
+}
+
+// BlockedBy returns the name of the block list that currently blocks fqdn, if any
+func (cc *StaticFQDNBlocker) BlockedBy(fqdn string) (string, bool) {
+	if fqdn == "" {
+		return "", false
+	}
+	if allow, reason := cc.allow(nil, fqdn); !allow {
+		return reason, true
+	}
+	return "", false
+}
+
+// BlockListSizes returns the number of FQDNs in each block list
+func (cc *StaticFQDNBlocker) BlockListSizes() map[string]int {
+	cc.mu.RLock()
+	defer cc.mu.RUnlock()
+	result := make(map[string]int, len(cc.blockedFQDN))
+	for _, bl := range cc.blockedFQDN {
+		result[bl.name] += len(bl.blockedFQDN)
+	}
+	return result
+}
+
+// AllowFQDN allows fqdn regardless of the block lists and undoes any earlier BlockFQDN
+func (cc *StaticFQDNBlocker) AllowFQDN(fqdn string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.allowOverrideFQDN[fqdn] = struct{}{}
+	for _, bl := range cc.blockedFQDN {
+		if bl.name == RuntimeBlockListName {
+			delete(bl.blockedFQDN, fqdn)
+		}
+	}
+}
+
+// BlockFQDN adds fqdn to the runtime block list and removes any allow override for it
+func (cc *StaticFQDNBlocker) BlockFQDN(fqdn string) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	delete(cc.allowOverrideFQDN, fqdn)
+	for _, bl := range cc.blockedFQDN {
+		if bl.name == RuntimeBlockListName {
+			bl.blockedFQDN[fqdn] = struct{}{}
+			return
+		}
+	}
+	cc.blockedFQDN = append(cc.blockedFQDN, blockList{
+		name:        RuntimeBlockListName,
+		blockedFQDN: map[string]struct{}{fqdn: {}},
+	})
+}
+
+// ReplaceBlockList swaps in a new set of FQDNs for the named block list, adding the list if
+// it doesn't exist yet
+func (cc *StaticFQDNBlocker) ReplaceBlockList(name string, fqdns []string) {
+	blockedFQDN := make(map[string]struct{}, len(fqdns))
+	for _, v := range fqdns {
+		blockedFQDN[v] = struct{}{}
+	}
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	for i, bl := range cc.blockedFQDN {
+		if bl.name == name {
+			cc.blockedFQDN[i].blockedFQDN = blockedFQDN
+			return
+		}
+	}
+	cc.blockedFQDN = append(cc.blockedFQDN, blockList{
+		name:        name,
+		blockedFQDN: blockedFQDN,
+	})
+}
+
 func WithStaticFQDNBlockList(name string, bl []string) StaticFQDNBlockerOpt {
 	return func(cc *StaticFQDNBlocker) {
 		blockedFQDN := make(map[string]struct{})
@@ -147,3 +316,18 @@ func WithAllowOverrideFQDN(overrides map[string]struct{}) StaticFQDNBlockerOpt {
 		}
 	}
 }
+
+// WithBindPolicy decides how BIND requests are treated; the default is CommandAllowed
+func WithBindPolicy(p CommandPolicy) StaticFQDNBlockerOpt {
+	return func(cc *StaticFQDNBlocker) {
+		cc.bindPolicy = p
+	}
+}
+
+// WithAssociatePolicy decides how UDP ASSOCIATE requests are treated; the default is CommandAllowed.
+// CommandFiltered only takes effect when UDPAssociateHandle is installed on the server.
+func WithAssociatePolicy(p CommandPolicy) StaticFQDNBlockerOpt {
+	return func(cc *StaticFQDNBlocker) {
+		cc.associatePolicy = p
+	}
+}
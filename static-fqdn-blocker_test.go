@@ -0,0 +1,146 @@
+package forwardproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+type recordingHistLogger struct {
+	mu     sync.Mutex
+	events []HistEvent
+}
+
+func (l *recordingHistLogger) LogAccepted(fqdn string) {
+	l.LogEvent(HistEvent{FQDN: fqdn})
+}
+
+func (l *recordingHistLogger) LogBlocked(fqdn string) {
+	l.LogEvent(HistEvent{FQDN: fqdn, Blocked: true})
+}
+
+func (l *recordingHistLogger) LogEvent(ev HistEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.events = append(l.events, ev)
+}
+
+func connectRequest(fqdn string, ip net.IP, port int) *socks5.Request {
+	dest := &statute.AddrSpec{FQDN: fqdn, IP: ip, Port: port}
+	return &socks5.Request{
+		Request:     statute.Request{Command: statute.CommandConnect},
+		RemoteAddr:  &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 50000},
+		DestAddr:    dest,
+		RawDestAddr: dest,
+	}
+}
+
+func TestStaticFQDNBlockerAllow(t *testing.T) {
+	cc := NewStaticFQDNBlocker(
+		WithStaticFQDNBlockList("ads", []string{"doubleclick.net", "ads.example.com"}),
+		WithStaticFQDNBlockList("adult", []string{"bad.com"}),
+	)
+	tests := []struct {
+		fqdn string
+		want bool
+	}{
+		{"doubleclick.net", false},
+		{"stats.g.doubleclick.net", false},
+		{"ads.example.com", false},
+		{"www.example.com", true},
+		{"bad.com", false},
+		{"good.com", true},
+	}
+	for _, tt := range tests {
+		if _, got := cc.Allow(context.Background(), connectRequest(tt.fqdn, nil, 443)); got != tt.want {
+			t.Errorf("Allow(%s) = %v, want %v", tt.fqdn, got, tt.want)
+		}
+	}
+
+	cc.AllowFQDN("bad.com")
+	if _, got := cc.Allow(context.Background(), connectRequest("bad.com", nil, 443)); !got {
+		t.Error("AllowFQDN override ignored")
+	}
+	cc.BlockFQDN("good.com")
+	if list, ok := cc.BlockedBy("good.com"); !ok || list != RuntimeBlockListName {
+		t.Errorf("BlockedBy(good.com) = %q, %v", list, ok)
+	}
+}
+
+func TestStaticFQDNBlockerPolicyProfile(t *testing.T) {
+	cc := NewStaticFQDNBlocker(
+		WithStaticFQDNBlockList("ads", []string{"ads.com"}),
+		WithStaticFQDNBlockList("adult", []string{"bad.com"}),
+	)
+	kids := ContextWithPolicyProfile(context.Background(), &PolicyProfile{Name: "kids", Lists: []string{"adult"}})
+	if _, ok := cc.Allow(kids, connectRequest("ads.com", nil, 443)); !ok {
+		t.Error("list outside the profile applied")
+	}
+	if _, ok := cc.Allow(kids, connectRequest("bad.com", nil, 443)); ok {
+		t.Error("list of the profile not applied")
+	}
+	open := ContextWithPolicyProfile(context.Background(), &PolicyProfile{Name: "open", Unfiltered: true})
+	if _, ok := cc.Allow(open, connectRequest("", net.ParseIP("10.0.0.1"), 443)); !ok {
+		t.Error("unfiltered profile blocked IP-only traffic")
+	}
+}
+
+func TestStaticFQDNBlockerRecordsIPOnlyUnderOneList(t *testing.T) {
+	hl := &recordingHistLogger{}
+	cc := NewStaticFQDNBlocker(WithHistLogger(hl))
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2"} {
+		if _, ok := cc.Allow(context.Background(), connectRequest("", net.ParseIP(ip), 443)); ok {
+			t.Fatalf("IP-only traffic to %s allowed", ip)
+		}
+	}
+	if len(hl.events) != 2 {
+		t.Fatalf("got %d events", len(hl.events))
+	}
+	for c, want := range []string{"10.0.0.1:443", "10.0.0.2:443"} {
+		ev := hl.events[c]
+		if !ev.Blocked || ev.List != IPOnlyList || ev.FQDN != want || ev.Client != "192.168.1.10:50000" || ev.Port != 443 {
+			t.Errorf("event %d = %+v", c, ev)
+		}
+	}
+}
+
+// discardHistLogger is the cheapest possible logger, so the benchmark shows what reporting costs
+type discardHistLogger struct{}
+
+func (discardHistLogger) LogAccepted(string) {}
+func (discardHistLogger) LogBlocked(string)  {}
+func (discardHistLogger) LogEvent(HistEvent) {}
+
+// benchmarkAllow runs Allow from parallel goroutines over a mix of blocked and accepted names
+func benchmarkAllow(b *testing.B, opts ...StaticFQDNBlockerOpt) {
+	list := make([]string, 10000)
+	for i := range list {
+		list[i] = fmt.Sprintf("ads%d.example.com", i)
+	}
+	cc := NewStaticFQDNBlocker(append([]StaticFQDNBlockerOpt{WithStaticFQDNBlockList("ads", list)}, opts...)...)
+	reqs := make([]*socks5.Request, 64)
+	for i := range reqs {
+		if i%2 == 0 {
+			reqs[i] = connectRequest(fmt.Sprintf("tracker.ads%d.example.com", i), nil, 443)
+		} else {
+			reqs[i] = connectRequest(fmt.Sprintf("www%d.example.org", i), nil, 443)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			cc.Allow(context.Background(), reqs[i%len(reqs)])
+		}
+	})
+}
+
+func BenchmarkAllow(b *testing.B) {
+	b.Run("no logger", func(b *testing.B) { benchmarkAllow(b) })
+	b.Run("with logger", func(b *testing.B) { benchmarkAllow(b, WithHistLogger(discardHistLogger{})) })
+}
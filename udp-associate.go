@@ -0,0 +1,236 @@
+package forwardproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/things-go/go-socks5"
+	"github.com/things-go/go-socks5/statute"
+)
+
+// CommandPolicy decides how BIND and UDP ASSOCIATE requests are treated
+type CommandPolicy uint8
+
+const (
+	// CommandAllowed lets requests through unchecked
+	CommandAllowed CommandPolicy = iota
+	// CommandDisabled refuses requests
+	CommandDisabled
+	// CommandFiltered applies the block lists to every destination
+	CommandFiltered
+)
+
+func (p CommandPolicy) String() string {
+	switch p {
+	case CommandDisabled:
+		return "disabled"
+	case CommandFiltered:
+		return "filtered"
+	default:
+		return "allowed"
+	}
+}
+
+// ParseCommandPolicy parses disabled, allowed or filtered
+func ParseCommandPolicy(v string) (CommandPolicy, error) {
+	switch strings.ToLower(v) {
+	case "allowed":
+		return CommandAllowed, nil
+	case "disabled":
+		return CommandDisabled, nil
+	case "filtered":
+		return CommandFiltered, nil
+	default:
+		return CommandAllowed, fmt.Errorf("unknown command policy %q: expected disabled, allowed or filtered", v)
+	}
+}
+
+const (
+	maxUDPDatagram = 64 * 1024
+	// destinations, and the peers allowed to answer, remembered per association before both
+	// are reset
+	maxUDPDestinations = 1024
+)
+
+// UDPAssociateHandle returns a handler for socks5.WithAssociateHandle that relays each datagram
+// to the destination named in its header. With CommandFiltered every new destination is checked
+// against the block lists and recorded like a CONNECT; datagrams to blocked destinations are
+// dropped. The association lasts as long as the client's TCP control connection.
+func (cc *StaticFQDNBlocker) UDPAssociateHandle(resolver socks5.NameResolver) func(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+	return func(ctx context.Context, writer io.Writer, req *socks5.Request) error {
+		bindIP := net.IPv4zero
+		if c, ok := writer.(net.Conn); ok {
+			addr, ok := c.LocalAddr().(*net.TCPAddr)
+			if !ok {
+				// a client on a unix socket has no address to relay datagrams for
+				socks5.SendReply(writer, statute.RepCommandNotSupported, nil)
+				return fmt.Errorf("udp associate over %s not supported", c.LocalAddr().Network())
+			}
+			bindIP = addr.IP
+		}
+		relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+		if err != nil {
+			socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return fmt.Errorf("listen udp failed, %v", err)
+		}
+		defer relay.Close()
+		upstream, err := net.ListenUDP("udp", nil)
+		if err != nil {
+			socks5.SendReply(writer, statute.RepServerFailure, nil)
+			return fmt.Errorf("listen udp failed, %v", err)
+		}
+		defer upstream.Close()
+		if err := socks5.SendReply(writer, statute.RepSuccess, relay.LocalAddr()); err != nil {
+			return fmt.Errorf("failed to send reply, %v", err)
+		}
+
+		a := &udpAssociation{
+			cc:           cc,
+			resolver:     resolver,
+			req:          req,
+			relay:        relay,
+			upstream:     upstream,
+			destinations: make(map[string]*net.UDPAddr),
+			peers:        make(map[string]struct{}),
+		}
+		go a.fromClient(ctx)
+		go a.fromUpstream()
+
+		io.Copy(io.Discard, req.Reader)
+		return nil
+	}
+}
+
+type udpAssociation struct {
+	cc       *StaticFQDNBlocker
+	resolver socks5.NameResolver
+	req      *socks5.Request
+	relay    *net.UDPConn
+	upstream *net.UDPConn
+	// internal
+	// destinations caches the decision per destination as sent by the client; nil means dropped
+	destinations map[string]*net.UDPAddr
+	mu           sync.Mutex
+	client       *net.UDPAddr
+	peers        map[string]struct{}
+}
+
+// fromClient relays datagrams from the client to their destinations
+func (a *udpAssociation) fromClient(ctx context.Context) {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, src, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		if !a.acceptClient(src) {
+			continue
+		}
+		pk, err := statute.ParseDatagram(buf[:n])
+		if err != nil || pk.Frag != 0 {
+			// fragmentation is optional in RFC 1928 and not supported
+			continue
+		}
+		dest := a.destination(ctx, pk.DstAddr)
+		if dest == nil {
+			continue
+		}
+		if _, err := a.upstream.WriteToUDP(pk.Data, dest); err != nil {
+			log.Printf("[StaticFQDNBlocker] UDP write to %s failed: %v", dest, err)
+		}
+	}
+}
+
+// fromUpstream relays replies back to the client, only from destinations it has sent to
+func (a *udpAssociation) fromUpstream() {
+	buf := make([]byte, maxUDPDatagram)
+	for {
+		n, src, err := a.upstream.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		a.mu.Lock()
+		client := a.client
+		_, known := a.peers[src.String()]
+		a.mu.Unlock()
+		if client == nil || !known {
+			continue
+		}
+		pk, err := statute.NewDatagram(src.String(), buf[:n])
+		if err != nil {
+			continue
+		}
+		if _, err := a.relay.WriteToUDP(append(pk.Header(), pk.Data...), client); err != nil {
+			return
+		}
+	}
+}
+
+// acceptClient only accepts datagrams from the host of the control connection, and from the
+// address announced in the ASSOCIATE request when one was given. The first accepted datagram
+// fixes the client address.
+func (a *udpAssociation) acceptClient(src *net.UDPAddr) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.client != nil {
+		return a.client.IP.Equal(src.IP) && a.client.Port == src.Port
+	}
+	if tcp, ok := a.req.RemoteAddr.(*net.TCPAddr); ok && !tcp.IP.Equal(src.IP) {
+		return false
+	}
+	if announced := a.req.DestAddr; announced != nil {
+		if len(announced.IP) != 0 && !announced.IP.IsUnspecified() && !announced.IP.Equal(src.IP) {
+			return false
+		}
+		if announced.Port != 0 && announced.Port != src.Port {
+			return false
+		}
+	}
+	a.client = src
+	return true
+}
+
+// destination resolves and, when filtering, checks dest; nil means the datagram is dropped
+func (a *udpAssociation) destination(ctx context.Context, dest statute.AddrSpec) *net.UDPAddr {
+	key := dest.String()
+	if addr, ok := a.destinations[key]; ok {
+		return addr
+	}
+	spec := statute.AddrSpec{FQDN: dest.FQDN, Port: dest.Port}
+	if dest.FQDN != "" {
+		_, ip, err := a.resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			log.Printf("[StaticFQDNBlocker] UDP destination %s: %v", dest.FQDN, err)
+			return nil
+		}
+		if ip.IsUnspecified() {
+			// left for an upstream proxy to resolve; UDP is never relayed upstream
+			log.Printf("[StaticFQDNBlocker] UDP destination %s: not resolved locally", dest.FQDN)
+			return nil
+		}
+		spec.IP = ip
+	} else {
+		spec.IP = append(net.IP(nil), dest.IP...)
+	}
+	if len(a.destinations) >= maxUDPDestinations {
+		// destinations still in use are decided again and their peers let back in
+		a.destinations = make(map[string]*net.UDPAddr)
+		a.mu.Lock()
+		a.peers = make(map[string]struct{})
+		a.mu.Unlock()
+	}
+	var addr *net.UDPAddr
+	if a.cc.associatePolicy != CommandFiltered || a.cc.check(ctx, a.req, &spec) {
+		addr = &net.UDPAddr{IP: spec.IP, Port: spec.Port}
+		a.mu.Lock()
+		a.peers[addr.String()] = struct{}{}
+		a.mu.Unlock()
+	}
+	a.destinations[key] = addr
+	return addr
+}
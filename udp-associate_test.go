@@ -0,0 +1,121 @@
+package forwardproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/things-go/go-socks5/statute"
+)
+
+// loopbackResolver resolves every name to 127.0.0.1
+type loopbackResolver struct{}
+
+func (loopbackResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, net.IPv4(127, 0, 0, 1), nil
+}
+
+func udpEchoServer(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, src, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			conn.WriteToUDP(buf[:n], src)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func TestCommandPoliciesDefaultToAllowed(t *testing.T) {
+	cc := NewStaticFQDNBlocker(WithStaticFQDNBlockList("ads", []string{"ads.com"}))
+	for _, cmd := range []byte{statute.CommandBind, statute.CommandAssociate} {
+		req := connectRequest("ads.com", nil, 443)
+		req.Command = cmd
+		if _, ok := cc.Allow(context.Background(), req); !ok {
+			t.Errorf("command %d refused by default", cmd)
+		}
+	}
+}
+
+func TestUDPAssociateFiltersDestinations(t *testing.T) {
+	echo := udpEchoServer(t)
+	cc := NewStaticFQDNBlocker(
+		WithStaticFQDNBlockList("ads", []string{"ads.com"}),
+		WithAssociatePolicy(CommandFiltered),
+	)
+	server, control := socksConn(t)
+	req := connectRequest("", net.IPv4zero, 0)
+	req.Command = statute.CommandAssociate
+	req.RemoteAddr = control.LocalAddr()
+	req.Reader = server
+	go cc.UDPAssociateHandle(loopbackResolver{})(context.Background(), server, req)
+
+	reply := make([]byte, 10)
+	control.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := control.Read(reply); err != nil || reply[1] != statute.RepSuccess {
+		t.Fatalf("reply = %x, %v", reply, err)
+	}
+	relay := &net.UDPAddr{IP: net.IP(reply[4:8]), Port: int(reply[8])<<8 | int(reply[9])}
+	client, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func(fqdn string) (string, bool) {
+		pk, err := statute.NewDatagram(fmt.Sprintf("%s:%d", fqdn, echo.Port), []byte("ping "+fqdn))
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Write(pk.Bytes())
+		client.SetReadDeadline(time.Now().Add(300 * time.Millisecond))
+		buf := make([]byte, 1500)
+		n, err := client.Read(buf)
+		if err != nil {
+			return "", false
+		}
+		got, err := statute.ParseDatagram(buf[:n])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(got.Data), true
+	}
+	if got, ok := send("tracker.ads.com"); ok {
+		t.Errorf("datagram to a blocked destination relayed: %q", got)
+	}
+	if got, ok := send("example.com"); !ok || got != "ping example.com" {
+		t.Errorf("echo = %q, %v", got, ok)
+	}
+}
+
+func TestUDPAssociationForgetsPeersWithDestinations(t *testing.T) {
+	a := &udpAssociation{
+		cc:           NewStaticFQDNBlocker(),
+		resolver:     loopbackResolver{},
+		req:          connectRequest("", net.IPv4zero, 0),
+		destinations: make(map[string]*net.UDPAddr),
+		peers:        make(map[string]struct{}),
+	}
+	for port := 1; port <= 3*maxUDPDestinations; port++ {
+		if a.destination(context.Background(), statute.AddrSpec{IP: net.IPv4(10, 0, 0, 1), Port: port}) == nil {
+			t.Fatalf("destination %d dropped", port)
+		}
+	}
+	if len(a.peers) > maxUDPDestinations || len(a.destinations) > maxUDPDestinations {
+		t.Errorf("association remembers %d peers and %d destinations", len(a.peers), len(a.destinations))
+	}
+	if _, ok := a.peers[fmt.Sprintf("10.0.0.1:%d", 3*maxUDPDestinations)]; !ok {
+		t.Error("latest peer forgotten")
+	}
+}